@@ -2,6 +2,7 @@ package videoserver
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/LdDl/video-server/configuration"
 	"github.com/LdDl/video-server/storage"
@@ -20,8 +21,20 @@ type Application struct {
 	VideoServerCfg VideoConfiguration `json:"video"`
 	Streams        StreamsStorage     `json:"streams"`
 	HLS            HLSInfo            `json:"hls"`
+	RTSPServerCfg  RTSPServerInfo     `json:"rtsp_server"`
 	CorsConfig     *cors.Config       `json:"-"`
 	minioClient    *minio.Client
+	publishers     *publishersRegistry
+	webrtc         *webrtcPlayback
+	hlsPlaylists   *hlsRegistry
+	llhls          *llhlsRegistry
+	dashManifests  *dashRegistry
+	hlsStorage     hlsStorage
+	archiveExports *archiveExportRegistry
+	// Interval of checking archive retention policies
+	archiveRetentionInterval time.Duration
+	// Default reconnect policy for streams which are added via API
+	reconnectPolicy ReconnectPolicy
 }
 
 // APIConfiguration is just copy of configuration.APIConfiguration but with some not exported fields
@@ -41,12 +54,27 @@ type VideoConfiguration struct {
 	Verbose VerboseLevel `json:"-"`
 }
 
+// RTSPServerInfo is just copy of configuration.RTSPServerConfiguration but with some not exported fields
+type RTSPServerInfo struct {
+	Enabled bool         `json:"enabled"`
+	Host    string       `json:"host"`
+	Port    int32        `json:"port"`
+	Verbose VerboseLevel `json:"-"`
+}
+
 // HLSInfo is an information about HLS parameters for server
 type HLSInfo struct {
 	MsPerSegment int64  `json:"hls_ms_per_segment"`
 	Directory    string `json:"-"`
 	WindowSize   uint   `json:"hls_window_size"`
 	Capacity     uint   `json:"hls_window_capacity"`
+	LowLatency   bool   `json:"hls_low_latency"`
+	MsPerPart    int64  `json:"hls_ms_per_part"`
+	// Default segment format for streams
+	SegmentFormat HLSSegmentFormat `json:"hls_segment_format"`
+	InMemory      bool             `json:"hls_in_memory"`
+	// Memory limit of the single stream in bytes
+	MemoryLimit int64 `json:"hls_memory_limit"`
 }
 
 // ServerInfo is an information about server
@@ -77,8 +105,38 @@ func NewApplication(cfg *configuration.Configuration) (*Application, error) {
 			Directory:    cfg.HLSCfg.Directory,
 			WindowSize:   cfg.HLSCfg.WindowSize,
 			Capacity:     cfg.HLSCfg.Capacity,
+			LowLatency:   cfg.HLSCfg.LowLatency,
+			MsPerPart:    cfg.HLSCfg.MsPerPart,
+			InMemory:     cfg.HLSCfg.InMemory,
+			MemoryLimit:  cfg.HLSCfg.MemoryLimitMB * 1024 * 1024,
 		},
+		RTSPServerCfg: RTSPServerInfo{
+			Enabled: cfg.RTSPServerCfg.Enabled,
+			Host:    cfg.RTSPServerCfg.Host,
+			Port:    cfg.RTSPServerCfg.Port,
+			Verbose: NewVerboseLevelFrom(cfg.RTSPServerCfg.Verbose),
+		},
+	}
+	hlsSegmentFormat, ok := hlsSegmentFormatExists(cfg.HLSCfg.SegmentFormat)
+	if !ok {
+		return nil, errors.Wrapf(ErrHLSSegmentFormatNotExists, "Format: '%s'", cfg.HLSCfg.SegmentFormat)
+	}
+	tmp.HLS.SegmentFormat = hlsSegmentFormat
+	tmp.reconnectPolicy = NewReconnectPolicyFrom(cfg.ReconnectCfg)
+	if cfg.RTSPServerCfg.Enabled {
+		tmp.publishers = newPublishersRegistry()
+	}
+	webrtcPlayback, err := newWebRTCPlayback(cfg.WebRTCCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't prepare WebRTC")
 	}
+	tmp.webrtc = webrtcPlayback
+	tmp.hlsPlaylists = newHLSRegistry()
+	tmp.llhls = newLLHLSRegistry()
+	tmp.dashManifests = newDASHRegistry()
+	tmp.hlsStorage = newHLSStorage(tmp.HLS)
+	tmp.archiveExports = newArchiveExportRegistry(cfg.ArchiveCfg.ExportDirectory, time.Duration(cfg.ArchiveCfg.ExportTTLMs)*time.Millisecond)
+	tmp.archiveRetentionInterval = time.Duration(cfg.ArchiveCfg.RetentionIntervalMs) * time.Millisecond
 	if cfg.CorsConfig.Enabled {
 		tmp.setCors(cfg.CorsConfig)
 	}
@@ -102,9 +160,40 @@ func NewApplication(cfg *configuration.Configuration) (*Application, error) {
 			outputTypes = append(outputTypes, typ)
 		}
 
-		tmp.Streams.store[validUUID] = NewStreamConfiguration(rtspStream.URL, outputTypes)
+		urls := sourceURLs(rtspStream.URL, rtspStream.URLs)
+		sourceType, ok := sourceTypeFor(rtspStream.Type, urls[0])
+		if !ok {
+			return nil, errors.Wrapf(ErrSourceTypeNotExists, "Type: '%s'", rtspStream.Type)
+		}
+
+		streamHLSSegmentFormat, ok := hlsSegmentFormatFor(rtspStream.HLS.SegmentFormat, tmp.HLS.SegmentFormat)
+		if !ok {
+			return nil, errors.Wrapf(ErrHLSSegmentFormatNotExists, "Format: '%s'", rtspStream.HLS.SegmentFormat)
+		}
+
+		tmp.Streams.store[validUUID] = NewStreamConfiguration(urls[0], outputTypes)
+		tmp.Streams.store[validUUID].URLs = urls
+		tmp.Streams.store[validUUID].SourceType = sourceType
 		tmp.Streams.store[validUUID].verboseLevel = NewVerboseLevelFrom(rtspStream.Verbose)
-		if rtspStream.Archive.Enabled && cfg.ArchiveCfg.Enabled {
+		tmp.Streams.store[validUUID].audioEnabled = rtspStream.Audio
+		tmp.Streams.store[validUUID].HLSSegmentFormat = streamHLSSegmentFormat
+		tmp.Streams.store[validUUID].publishUser = rtspStream.Publish.User
+		tmp.Streams.store[validUUID].publishPassword = rtspStream.Publish.Password
+		tmp.Streams.store[validUUID].reconnectPolicy = NewReconnectPolicyFrom(rtspStream.Reconnect)
+		// Archive must be recorded regardless of viewers
+		archiveEnabled := rtspStream.Archive.Enabled && cfg.ArchiveCfg.Enabled
+		tmp.Streams.store[validUUID].OnDemand = rtspStream.OnDemand && !archiveEnabled
+		tmp.Streams.store[validUUID].idleTimeout = time.Duration(rtspStream.IdleTimeoutMs) * time.Millisecond
+		if rtspStream.OnDemand && archiveEnabled {
+			log.Warn().Str("scope", SCOPE_CONFIGURATION).Str("stream_id", rtspStream.GUID).Msg("Stream with enabled archive can't be on-demand. It will be always connected")
+		}
+		if typeExists(STREAM_TYPE_RTSP, outputTypes) && !cfg.RTSPServerCfg.Enabled {
+			log.Warn().Str("scope", SCOPE_CONFIGURATION).Str("stream_id", rtspStream.GUID).Msg("RTSP output is configured, but RTSP server is disabled. Stream won't be served over RTSP")
+		}
+		if sourceType == SOURCE_TYPE_RTSP_PUSH && rtspStream.Publish.User == "" {
+			log.Warn().Str("scope", SCOPE_CONFIGURATION).Str("stream_id", rtspStream.GUID).Msg("No publishing credentials for pushed stream. Publishers will be rejected")
+		}
+		if archiveEnabled {
 			if rtspStream.Archive.MsPerSegment == 0 {
 				return nil, fmt.Errorf("bad ms per segment archive stream")
 			}
@@ -149,6 +238,12 @@ func NewApplication(cfg *configuration.Configuration) (*Application, error) {
 			default:
 				return nil, fmt.Errorf("unsupported archive type")
 			}
+			archiveStorage.retention = NewArchiveRetentionPolicyFrom(rtspStream.Archive.Retention)
+			// Index is kept next to temporary files regardless of storage type
+			archiveStorage.index, err = newArchiveIndex(validUUID, rtspStream.Archive.Directory)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't load archive index for given stream")
+			}
 			err = tmp.Streams.UpdateArchiveStorageForStream(validUUID, &archiveStorage)
 			if err != nil {
 				return nil, errors.Wrap(err, "can't set archive for given stream")
@@ -0,0 +1,350 @@
+package videoserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/LdDl/video-server/storage"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type ArchiveExportState uint16
+
+const (
+	ARCHIVE_EXPORT_PENDING = ArchiveExportState(iota)
+	ARCHIVE_EXPORT_RUNNING
+	ARCHIVE_EXPORT_DONE
+	ARCHIVE_EXPORT_FAILED
+)
+
+func (iotaIdx ArchiveExportState) String() string {
+	return [...]string{"pending", "running", "done", "failed"}[iotaIdx]
+}
+
+// MarshalJSON returns name of the export state
+func (iotaIdx ArchiveExportState) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + iotaIdx.String() + `"`), nil
+}
+
+// ArchiveExportJob is a state of the single export of the archive time range
+type ArchiveExportJob struct {
+	ID       uuid.UUID          `json:"id"`
+	StreamID uuid.UUID          `json:"stream_id"`
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	State    ArchiveExportState `json:"state"`
+	// Share of the processed source segments (by size), from 0 to 1
+	Progress float64 `json:"progress"`
+	Segments int     `json:"segments"`
+	// Segments which have codecs different from the first one can't be put into the same file
+	SkippedSegments []string `json:"skipped_segments,omitempty"`
+	// Actual time range of the exported file: start is moved to the keyframe
+	Start      *time.Time `json:"start,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+	Size       int64      `json:"size"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	fileName   string
+	done       chan struct{}
+}
+
+// archiveExportRegistry keeps export jobs. Finished jobs and their files are removed after TTL
+type archiveExportRegistry struct {
+	sync.Mutex
+	directory string
+	ttl       time.Duration
+	jobs      map[uuid.UUID]*ArchiveExportJob
+}
+
+func newArchiveExportRegistry(directory string, ttl time.Duration) *archiveExportRegistry {
+	return &archiveExportRegistry{
+		directory: directory,
+		ttl:       ttl,
+		jobs:      make(map[uuid.UUID]*ArchiveExportJob),
+	}
+}
+
+// Start runs export of the given time range in background. Returned channel is closed when the job is finished
+func (registry *archiveExportRegistry) Start(streamID uuid.UUID, archive *StreamArchiveWrapper, from, to time.Time) (ArchiveExportJob, <-chan struct{}, error) {
+	if archive == nil || archive.index == nil {
+		return ArchiveExportJob{}, nil, ErrNullArchive
+	}
+	if err := ensureDir(registry.directory); err != nil {
+		return ArchiveExportJob{}, nil, errors.Wrap(err, "Can't create directory for exported files")
+	}
+	segments := archive.index.Find(from, to)
+	if len(segments) == 0 {
+		return ArchiveExportJob{}, nil, ErrArchiveExportEmpty
+	}
+	job := &ArchiveExportJob{
+		ID:        uuid.New(),
+		StreamID:  streamID,
+		From:      from,
+		To:        to,
+		State:     ARCHIVE_EXPORT_PENDING,
+		Segments:  len(segments),
+		CreatedAt: time.Now().UTC(),
+		done:      make(chan struct{}),
+	}
+	job.fileName = filepath.Join(registry.directory, fmt.Sprintf("%s_export_%s.mp4", streamID, job.ID))
+	registry.Lock()
+	registry.jobs[job.ID] = job
+	snapshot := job.snapshot()
+	registry.Unlock()
+	go registry.run(job, archive.store, segments)
+	return snapshot, job.done, nil
+}
+
+// Get returns copy of the job
+func (registry *archiveExportRegistry) Get(jobID uuid.UUID) (ArchiveExportJob, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	job, ok := registry.jobs[jobID]
+	if !ok {
+		return ArchiveExportJob{}, false
+	}
+	return job.snapshot(), true
+}
+
+func (registry *archiveExportRegistry) update(job *ArchiveExportJob, fn func(job *ArchiveExportJob)) {
+	registry.Lock()
+	defer registry.Unlock()
+	fn(job)
+}
+
+func (registry *archiveExportRegistry) run(job *ArchiveExportJob, store storage.ArchiveStorage, segments []ArchiveSegment) {
+	defer close(job.done)
+	registry.update(job, func(job *ArchiveExportJob) {
+		job.State = ARCHIVE_EXPORT_RUNNING
+	})
+	log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_EXPORT).Str("stream_id", job.StreamID.String()).Str("job_id", job.ID.String()).Time("from", job.From).Time("to", job.To).Int("segments", len(segments)).Msg("Start export")
+	st := time.Now()
+	remuxer, err := registry.export(job, store, segments)
+	registry.update(job, func(job *ArchiveExportJob) {
+		finishedAt := time.Now().UTC()
+		job.FinishedAt = &finishedAt
+		if err != nil {
+			job.State = ARCHIVE_EXPORT_FAILED
+			job.Error = err.Error()
+			return
+		}
+		job.State = ARCHIVE_EXPORT_DONE
+		job.Progress = 1
+		start, end := remuxer.start(), remuxer.end()
+		job.Start, job.End = &start, &end
+		if info, err := os.Stat(job.fileName); err == nil {
+			job.Size = info.Size()
+		}
+	})
+	if err != nil {
+		log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_EXPORT).Str("stream_id", job.StreamID.String()).Str("job_id", job.ID.String()).Dur("elapsed", time.Since(st)).Msg("Can't export archive")
+		os.Remove(job.fileName)
+	} else {
+		log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_EXPORT).Str("stream_id", job.StreamID.String()).Str("job_id", job.ID.String()).Str("filename", job.fileName).Dur("elapsed", time.Since(st)).Msg("Export has been finished")
+	}
+	time.AfterFunc(registry.ttl, func() {
+		registry.Lock()
+		delete(registry.jobs, job.ID)
+		registry.Unlock()
+		if err := os.Remove(job.fileName); err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_EXPORT).Str("stream_id", job.StreamID.String()).Str("job_id", job.ID.String()).Str("filename", job.fileName).Msg("Can't remove exported file")
+		}
+	})
+}
+
+// export remuxes segments into the file of the job
+func (registry *archiveExportRegistry) export(job *ArchiveExportJob, store storage.ArchiveStorage, segments []ArchiveSegment) (*archiveRemuxer, error) {
+	outFile, err := os.Create(job.fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't create file for export")
+	}
+	defer outFile.Close()
+	remuxer := newArchiveRemuxer(outFile, job.From, job.To)
+	total, processed := int64(0), int64(0)
+	for _, segment := range segments {
+		total += segment.Size
+	}
+	for _, segment := range segments {
+		ok, err := remuxer.writeSegment(store, segment)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Segment '%s'", segment.Name)
+		}
+		processed += segment.Size
+		registry.update(job, func(job *ArchiveExportJob) {
+			if !ok {
+				job.SkippedSegments = append(job.SkippedSegments, segment.Name)
+			}
+			if total > 0 {
+				job.Progress = float64(processed) / float64(total)
+			}
+		})
+		if remuxer.finished {
+			break
+		}
+	}
+	if err = remuxer.close(); err != nil {
+		return nil, err
+	}
+	return remuxer, outFile.Close()
+}
+
+// snapshot must be called under lock of the registry
+func (job *ArchiveExportJob) snapshot() ArchiveExportJob {
+	snapshot := *job
+	snapshot.SkippedSegments = append([]string(nil), job.SkippedSegments...)
+	return snapshot
+}
+
+// archiveRemuxer joins archive segments into the single MP4. Output starts on the keyframe at or before 'from' (so it could be decoded) and ends on the last frame before 'to'.
+// Packet times are relative to 'from': the segment is placed by its start time, but never overlaps the previous one
+type archiveRemuxer struct {
+	muxer    *mp4.Muxer
+	codecs   []av.CodecData
+	mainIdx  int8
+	hasVideo bool
+	from     time.Time
+	to       time.Duration
+	// Packets of the last GOP before 'from'
+	gop      []av.Packet
+	started  bool
+	finished bool
+	// Time of the first written packet
+	origin time.Duration
+	last   time.Duration
+	frame  time.Duration
+	// At least one packet has been read
+	touched bool
+}
+
+func newArchiveRemuxer(w io.WriteSeeker, from, to time.Time) *archiveRemuxer {
+	return &archiveRemuxer{
+		muxer: mp4.NewMuxer(w),
+		from:  from,
+		to:    to.Sub(from),
+	}
+}
+
+func (remuxer *archiveRemuxer) start() time.Time {
+	return remuxer.from.Add(remuxer.origin).UTC()
+}
+
+func (remuxer *archiveRemuxer) end() time.Time {
+	return remuxer.from.Add(remuxer.last + remuxer.frame).UTC()
+}
+
+// writeSegment reads the whole segment. Returns false if segment has been skipped because of other codecs
+func (remuxer *archiveRemuxer) writeSegment(store storage.ArchiveStorage, segment ArchiveSegment) (bool, error) {
+	file, err := store.OpenFile(context.Background(), storage.ArchiveUnit{Bucket: segment.Bucket, SegmentName: segment.Name})
+	if err != nil {
+		return false, errors.Wrap(err, "Can't open segment")
+	}
+	defer file.Close()
+	demuxer := mp4.NewDemuxer(file)
+	codecData, err := demuxer.Streams()
+	if err != nil {
+		return false, errors.Wrap(err, "Can't read segment header")
+	}
+	if remuxer.codecs == nil {
+		if err = remuxer.muxer.WriteHeader(codecData); err != nil {
+			return false, errors.Wrap(err, "Can't write header for mp4 muxer")
+		}
+		remuxer.codecs = codecData
+		for idx, codec := range codecData {
+			if codec.Type().IsVideo() {
+				remuxer.mainIdx, remuxer.hasVideo = int8(idx), true
+				break
+			}
+		}
+	} else if !sameCodecs(remuxer.codecs, codecData) {
+		return false, nil
+	}
+	base := segment.Start.Sub(remuxer.from)
+	// Wall clock of segments could be a bit inaccurate
+	if remuxer.touched && base < remuxer.last+remuxer.frame {
+		base = remuxer.last + remuxer.frame
+	}
+	for !remuxer.finished {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, errors.Wrap(err, "Can't read packet")
+		}
+		pkt.Time += base
+		if err = remuxer.writePacket(pkt); err != nil {
+			return true, errors.Wrap(err, "Can't write packet for mp4 muxer")
+		}
+	}
+	return true, nil
+}
+
+func (remuxer *archiveRemuxer) writePacket(pkt av.Packet) error {
+	isMain := pkt.Idx == remuxer.mainIdx
+	isBoundary := isMain && (pkt.IsKeyFrame || !remuxer.hasVideo)
+	if isMain {
+		if dur := pkt.Time - remuxer.last; remuxer.touched && dur > 0 {
+			remuxer.frame = dur
+		}
+	}
+	if !remuxer.touched || pkt.Time > remuxer.last {
+		remuxer.last = pkt.Time
+	}
+	remuxer.touched = true
+	if !remuxer.started {
+		if pkt.Time < 0 {
+			if isBoundary {
+				remuxer.gop = remuxer.gop[:0]
+			}
+			if isBoundary || len(remuxer.gop) > 0 {
+				remuxer.gop = append(remuxer.gop, pkt)
+			}
+			return nil
+		}
+		if len(remuxer.gop) == 0 && !isBoundary {
+			return nil
+		}
+		remuxer.started = true
+		pending := append(remuxer.gop, pkt)
+		remuxer.gop = nil
+		remuxer.origin = pending[0].Time
+		for _, p := range pending {
+			if err := remuxer.write(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if isMain && pkt.Time >= remuxer.to {
+		remuxer.finished = true
+		remuxer.last = pkt.Time - remuxer.frame
+		return nil
+	}
+	return remuxer.write(pkt)
+}
+
+func (remuxer *archiveRemuxer) write(pkt av.Packet) error {
+	pkt.Time -= remuxer.origin
+	return remuxer.muxer.WritePacket(pkt)
+}
+
+// close writes trailer. Fails if no keyframes have been met in the time range
+func (remuxer *archiveRemuxer) close() error {
+	if !remuxer.started {
+		return ErrArchiveExportEmpty
+	}
+	if err := remuxer.muxer.WriteTrailer(); err != nil {
+		return errors.Wrap(err, "Can't write trailer for mp4 muxer")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package videoserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// startArchiveExport validates the request and starts export job. Returns HTTP status on failure
+func startArchiveExport(app *Application, ctx *gin.Context) (ArchiveExportJob, <-chan struct{}, int, error) {
+	streamIDSTR := ctx.Param("stream_id")
+	streamID, err := uuid.Parse(streamIDSTR)
+	if err != nil {
+		return ArchiveExportJob{}, nil, http.StatusBadRequest, fmt.Errorf("Not valid UUID: '%s'", streamIDSTR)
+	}
+	bounds := [2]time.Time{}
+	for i, param := range []string{"from", "to"} {
+		bounds[i], err = parseArchiveTime(ctx.Query(param))
+		if err != nil || bounds[i].IsZero() {
+			return ArchiveExportJob{}, nil, http.StatusBadRequest, fmt.Errorf("Not valid '%s' time: '%s'", param, ctx.Query(param))
+		}
+	}
+	if !bounds[1].After(bounds[0]) {
+		return ArchiveExportJob{}, nil, http.StatusBadRequest, ErrArchiveExportBadRange
+	}
+	job, done, err := app.archiveExports.Start(streamID, app.Streams.GetStreamArchiveStorage(streamID), bounds[0], bounds[1])
+	if err != nil {
+		switch errors.Cause(err) {
+		case ErrNullArchive:
+			return job, nil, http.StatusNotFound, errors.New("No archive for the stream")
+		case ErrArchiveExportEmpty:
+			return job, nil, http.StatusNotFound, err
+		}
+		return job, nil, http.StatusInternalServerError, err
+	}
+	return job, done, http.StatusOK, nil
+}
+
+// serveArchiveExport sends exported file. Range requests are supported
+func serveArchiveExport(ctx *gin.Context, job ArchiveExportJob) error {
+	file, err := os.Open(job.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Write timeout of the server is too short for large files
+	if err = http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		return err
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%d_%d.mp4"`, job.StreamID, job.From.Unix(), job.To.Unix()))
+	http.ServeContent(ctx.Writer, ctx.Request, "export.mp4", info.ModTime(), file)
+	return nil
+}
+
+// ArchiveExportWrapper exports time range of the archive into the single MP4 and sends it in the same response
+func ArchiveExportWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call archive export")
+		}
+		job, done, status, err := startArchiveExport(app, ctx)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Can't start archive export")
+			}
+			ctx.JSON(status, gin.H{"Error": err.Error()})
+			return
+		}
+		select {
+		case <-ctx.Request.Context().Done():
+			// Job is kept, so it could be downloaded later
+			return
+		case <-done:
+		}
+		job, _ = app.archiveExports.Get(job.ID)
+		if job.State != ARCHIVE_EXPORT_DONE {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("job_id", job.ID.String()).Str("reason", job.Error).Msg("Archive export has been failed")
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": job.Error})
+			return
+		}
+		if err = serveArchiveExport(ctx, job); err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("job_id", job.ID.String()).Msg("Can't send exported file")
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		}
+	}
+}
+
+// ArchiveExportJobWrapper starts export of the archive time range in background. Response is the job which could be polled for progress
+func ArchiveExportJobWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call archive export job")
+		}
+		job, _, status, err := startArchiveExport(app, ctx)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Can't start archive export")
+			}
+			ctx.JSON(status, gin.H{"Error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusAccepted, job)
+	}
+}
+
+// ExportJobWrapper returns state of the export job
+func ExportJobWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call export job state")
+		}
+		jobIDSTR := ctx.Param("job_id")
+		jobID, err := uuid.Parse(jobIDSTR)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Not valid UUID: '%s'", jobIDSTR)})
+			return
+		}
+		job, ok := app.archiveExports.Get(jobID)
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": ErrArchiveExportNotFound.Error()})
+			return
+		}
+		ctx.JSON(200, job)
+	}
+}
+
+// ExportFileWrapper sends file of the finished export job. Range requests are supported
+func ExportFileWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call export file")
+		}
+		jobIDSTR := ctx.Param("job_id")
+		jobID, err := uuid.Parse(jobIDSTR)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Not valid UUID: '%s'", jobIDSTR)})
+			return
+		}
+		job, ok := app.archiveExports.Get(jobID)
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": ErrArchiveExportNotFound.Error()})
+			return
+		}
+		switch job.State {
+		case ARCHIVE_EXPORT_DONE:
+		case ARCHIVE_EXPORT_FAILED:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": job.Error})
+			return
+		default:
+			ctx.JSON(http.StatusConflict, gin.H{"Error": ErrArchiveExportNotReady.Error(), "progress": job.Progress})
+			return
+		}
+		if err = serveArchiveExport(ctx, job); err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("job_id", job.ID.String()).Msg("Can't send exported file")
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+		}
+	}
+}
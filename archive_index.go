@@ -0,0 +1,170 @@
+package videoserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ArchiveSegment is an entry of the archive index
+type ArchiveSegment struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMs int64     `json:"duration_ms"`
+	Size       int64     `json:"size"`
+	// Type of the storage: 'filesystem' or 'minio'
+	Storage string `json:"storage"`
+	// Directory for filesystem storage
+	Bucket string `json:"bucket"`
+	// Path to the file for filesystem storage and name of the object for MinIO
+	Object string   `json:"object"`
+	Codecs []string `json:"codecs"`
+}
+
+// archiveIndex is a catalog of the archive segments of the single stream. Entries are kept sorted by start time and persisted as JSON lines
+type archiveIndex struct {
+	sync.RWMutex
+	streamID uuid.UUID
+	fileName string
+	segments []ArchiveSegment
+}
+
+// newArchiveIndex loads index of the stream from the given directory (if it exists)
+func newArchiveIndex(streamID uuid.UUID, directory string) (*archiveIndex, error) {
+	index := &archiveIndex{
+		streamID: streamID,
+		fileName: filepath.Join(directory, streamID.String()+"_index.jsonl"),
+		segments: []ArchiveSegment{},
+	}
+	file, err := os.Open(index.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, errors.Wrap(err, "Can't open archive index")
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var segment ArchiveSegment
+		if err := json.Unmarshal(scanner.Bytes(), &segment); err != nil {
+			// Last line could be truncated if the server has been killed in the middle of writing
+			log.Warn().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_INDEX).Str("stream_id", streamID.String()).Str("filename", index.fileName).Msg("Skip broken entry of archive index")
+			continue
+		}
+		index.insert(segment)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Can't read archive index")
+	}
+	return index, nil
+}
+
+// insert puts segment to its place in time order
+func (index *archiveIndex) insert(segment ArchiveSegment) {
+	i, _ := slices.BinarySearchFunc(index.segments, segment, func(a, b ArchiveSegment) int {
+		return a.Start.Compare(b.Start)
+	})
+	index.segments = slices.Insert(index.segments, i, segment)
+}
+
+// Add registers closed segment
+func (index *archiveIndex) Add(segment ArchiveSegment) error {
+	line, err := json.Marshal(segment)
+	if err != nil {
+		return err
+	}
+	index.Lock()
+	defer index.Unlock()
+	file, err := os.OpenFile(index.fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Can't open archive index")
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return errors.Wrap(err, "Can't write archive index")
+	}
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, "Can't close archive index")
+	}
+	index.insert(segment)
+	return nil
+}
+
+// Find returns segments which overlap [from; to]. Zero bound means no limit
+func (index *archiveIndex) Find(from, to time.Time) []ArchiveSegment {
+	index.RLock()
+	defer index.RUnlock()
+	found := []ArchiveSegment{}
+	for _, segment := range index.segments {
+		if !from.IsZero() && segment.End.Before(from) {
+			continue
+		}
+		if !to.IsZero() && segment.Start.After(to) {
+			break
+		}
+		found = append(found, segment)
+	}
+	return found
+}
+
+// Get returns segment by its name
+func (index *archiveIndex) Get(name string) (ArchiveSegment, bool) {
+	index.RLock()
+	defer index.RUnlock()
+	for _, segment := range index.segments {
+		if segment.Name == name {
+			return segment, true
+		}
+	}
+	return ArchiveSegment{}, false
+}
+
+// Remove deletes segments by their names and rewrites the index file
+func (index *archiveIndex) Remove(names ...string) error {
+	removed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		removed[name] = struct{}{}
+	}
+	index.Lock()
+	defer index.Unlock()
+	index.segments = slices.DeleteFunc(index.segments, func(segment ArchiveSegment) bool {
+		_, ok := removed[segment.Name]
+		return ok
+	})
+	// Write to temporary file first, so index is not lost if the server is killed in the middle of writing
+	tmpName := index.fileName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return errors.Wrap(err, "Can't create archive index")
+	}
+	writer := bufio.NewWriter(file)
+	for _, segment := range index.segments {
+		line, err := json.Marshal(segment)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "Can't write archive index")
+	}
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, "Can't close archive index")
+	}
+	return errors.Wrap(os.Rename(tmpName, index.fileName), "Can't replace archive index")
+}
@@ -0,0 +1,189 @@
+package videoserver
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LdDl/video-server/configuration"
+	"github.com/LdDl/video-server/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons of removing archive segments
+const (
+	RETENTION_REASON_MAX_AGE  = "max_age"
+	RETENTION_REASON_MAX_SIZE = "max_size"
+	RETENTION_REASON_MIN_FREE = "min_free"
+)
+
+// archiveRetentionMetrics are counters of removed segments per stream. They are exposed on '/debug/vars' of the API server
+var archiveRetentionMetrics = expvar.NewMap("archive_retention")
+
+// ArchiveRetentionPolicy limits the archive of the stream. Zero values mean no limit
+type ArchiveRetentionPolicy struct {
+	MaxAge         time.Duration `json:"max_age"`
+	MaxSize        int64         `json:"max_size"`
+	MinFreePercent float64       `json:"min_free_percent"`
+}
+
+// NewArchiveRetentionPolicyFrom creates policy from the configuration
+func NewArchiveRetentionPolicyFrom(cfg configuration.RetentionConfiguration) ArchiveRetentionPolicy {
+	return ArchiveRetentionPolicy{
+		MaxAge:         time.Duration(cfg.MaxAgeHours * float64(time.Hour)),
+		MaxSize:        cfg.MaxSizeMB * 1024 * 1024,
+		MinFreePercent: cfg.MinFreePercent,
+	}
+}
+
+// Enabled checks if there is any limit
+func (policy ArchiveRetentionPolicy) Enabled() bool {
+	return policy.MaxAge > 0 || policy.MaxSize > 0 || policy.MinFreePercent > 0
+}
+
+// StartArchiveRetention periodically removes the oldest archive segments which are out of retention policies of the streams. Blocks forever
+func (app *Application) StartArchiveRetention() {
+	log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Dur("interval", app.archiveRetentionInterval).Msg("Start archive retention")
+	ticker := time.NewTicker(app.archiveRetentionInterval)
+	defer ticker.Stop()
+	for {
+		for _, streamID := range app.Streams.GetAllStreamsIDS() {
+			archive := app.Streams.GetStreamArchiveStorage(streamID)
+			if archive == nil || archive.index == nil || !archive.retention.Enabled() {
+				continue
+			}
+			archive.enforceRetention(streamID, time.Now())
+		}
+		<-ticker.C
+	}
+}
+
+// retentionMetricsFor returns counters of the stream
+func retentionMetricsFor(streamID uuid.UUID) *expvar.Map {
+	key := streamID.String()
+	if metrics, ok := archiveRetentionMetrics.Get(key).(*expvar.Map); ok {
+		return metrics
+	}
+	metrics := new(expvar.Map).Init()
+	archiveRetentionMetrics.Set(key, metrics)
+	return metrics
+}
+
+// retentionReason returns why the segment should be removed. Empty string means that segment should be kept
+func (archive *StreamArchiveWrapper) retentionReason(segment ArchiveSegment, totalSize int64, now time.Time, checkDisk *bool) (string, error) {
+	policy := archive.retention
+	if policy.MaxAge > 0 && now.Sub(segment.End) > policy.MaxAge {
+		return RETENTION_REASON_MAX_AGE, nil
+	}
+	if policy.MaxSize > 0 && totalSize > policy.MaxSize {
+		return RETENTION_REASON_MAX_SIZE, nil
+	}
+	if policy.MinFreePercent > 0 && *checkDisk && !archive.diskUsageUnsupported {
+		usage, err := archive.store.DiskUsage(archive.bucket)
+		if err != nil {
+			*checkDisk = false
+			if errors.Cause(err) == storage.ErrNotImplementedYet {
+				// Storage can't tell its free space, so there is no point to ask it again
+				archive.diskUsageUnsupported = true
+			}
+			return "", err
+		}
+		if usage.Total > 0 && float64(usage.Free)*100/float64(usage.Total) < policy.MinFreePercent {
+			return RETENTION_REASON_MIN_FREE, nil
+		}
+	}
+	return "", nil
+}
+
+// enforceRetention removes the oldest segments until the archive fits the retention policy
+func (archive *StreamArchiveWrapper) enforceRetention(streamID uuid.UUID, now time.Time) {
+	metrics := retentionMetricsFor(streamID)
+	segments := archive.index.Find(time.Time{}, time.Time{})
+	if archive.store.Type() == storage.STORAGE_FILESYSTEM {
+		segments = append(segments, archive.unindexedSegments(streamID, now)...)
+		slices.SortStableFunc(segments, func(a, b ArchiveSegment) int {
+			return a.Start.Compare(b.Start)
+		})
+	}
+	totalSize := int64(0)
+	for _, segment := range segments {
+		totalSize += segment.Size
+	}
+	checkDisk := true
+	removed := []string{}
+	for _, segment := range segments {
+		reason, err := archive.retentionReason(segment, totalSize, now, &checkDisk)
+		if err != nil && errors.Cause(err) == storage.ErrNotImplementedYet {
+			log.Warn().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Str("bucket", archive.bucket).Str("storage", archive.store.Type().String()).Msg("Storage does not report disk usage. Policy 'min_free_percent' is ignored")
+		} else if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Str("bucket", archive.bucket).Msg("Can't get disk usage")
+		}
+		if reason == "" {
+			break
+		}
+		err = archive.store.RemoveFile(context.Background(), storage.ArchiveUnit{Bucket: segment.Bucket, SegmentName: segment.Name})
+		if err != nil {
+			// Try again on the next run. Newer segments are kept, so the oldest ones are always removed first
+			log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Str("segment_name", segment.Name).Str("reason", reason).Msg("Can't remove archive segment")
+			metrics.Add("errors", 1)
+			break
+		}
+		log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Str("segment_name", segment.Name).Str("reason", reason).Int64("size", segment.Size).Time("segment_end", segment.End).Msg("Archive segment has been removed")
+		metrics.Add("removed_segments", 1)
+		metrics.Add("removed_bytes", segment.Size)
+		metrics.Add("removed_by_"+reason, 1)
+		totalSize -= segment.Size
+		removed = append(removed, segment.Name)
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if err := archive.index.Remove(removed...); err != nil {
+		log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Msg("Can't update archive index")
+	}
+}
+
+// unindexedSegments returns segments of the stream which are stored on the disk but missing in the index: written before the index has been introduced or failed to be indexed.
+// Segment which is being recorded right now is skipped
+func (archive *StreamArchiveWrapper) unindexedSegments(streamID uuid.UUID, now time.Time) []ArchiveSegment {
+	prefix := streamID.String() + "_"
+	fileNames, err := filepath.Glob(filepath.Join(archive.filesystemDir, prefix+"*.mp4"))
+	if err != nil {
+		log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_RETENTION).Str("stream_id", streamID.String()).Str("directory", archive.filesystemDir).Msg("Can't list archive segments")
+		return nil
+	}
+	recording := 2 * time.Duration(archive.msPerSegment) * time.Millisecond
+	segments := []ArchiveSegment{}
+	for _, fileName := range fileNames {
+		name := filepath.Base(fileName)
+		if _, ok := archive.index.Get(name); ok {
+			continue
+		}
+		info, err := os.Stat(fileName)
+		if err != nil || info.IsDir() || now.Sub(info.ModTime()) < recording {
+			continue
+		}
+		// Name of the segment is '<stream ID>_<unix time of start>.mp4'
+		start := info.ModTime()
+		if unix, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".mp4"), 10, 64); err == nil {
+			start = time.Unix(unix, 0)
+		}
+		segments = append(segments, ArchiveSegment{
+			Name:    name,
+			Start:   start.UTC(),
+			End:     info.ModTime().UTC(),
+			Size:    info.Size(),
+			Storage: archive.store.Type().String(),
+			Bucket:  archive.bucket,
+			Object:  fileName,
+		})
+	}
+	return segments
+}
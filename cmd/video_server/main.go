@@ -67,9 +67,19 @@ func main() {
 	// Run streams
 	go app.StartStreams()
 
+	// Remove archive segments which are out of retention policies
+	if appCfg.ArchiveCfg.Enabled {
+		go app.StartArchiveRetention()
+	}
+
 	// Start "Video" server
 	go app.StartVideoServer()
 
+	// Start RTSP server for pushed streams
+	if appCfg.RTSPServerCfg.Enabled {
+		go app.StartRTSPServer()
+	}
+
 	// Start API server
 	if appCfg.APICfg.Enabled {
 		go app.StartAPIServer()
@@ -86,6 +96,8 @@ func main() {
 	log.Info().Str("event", EVENT_APP_START).Msg("Server has been started (awaiting signal to exit)")
 	<-exit
 	log.Info().Str("event", EVENT_APP_STOP).Msg("Stopping video server")
+	// Close archive segments, finalize HLS playlists and disconnect viewers
+	app.StopStreams("Server is shutting down")
 
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
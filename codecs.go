@@ -0,0 +1,156 @@
+package videoserver
+
+import (
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+// codecTypesSet is a set of codec types which could be handled by specific container
+type codecTypesSet map[av.CodecType]struct{}
+
+var (
+	// tsSupportedCodecs are codecs which can be muxed into MPEG-TS segments for HLS
+	tsSupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.AAC:  {},
+	}
+	// fmp4SupportedCodecs are codecs which can be muxed into fragmented MP4 segments for HLS
+	fmp4SupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.H265: {},
+		av.AAC:  {},
+	}
+	// mp4SupportedCodecs are codecs which can be muxed into MP4 archive segments
+	mp4SupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.H265: {},
+		av.AAC:  {},
+	}
+	// rtspSupportedCodecs are codecs which can be sent to RTSP players
+	rtspSupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.H265: {},
+		av.AAC:  {},
+	}
+	// webrtcSupportedCodecs are codecs which can be sent to WebRTC clients without transcoding
+	webrtcSupportedCodecs = codecTypesSet{
+		av.H264: {},
+	}
+	// flvSupportedCodecs are codecs which can be muxed into FLV (as they are supported by flv.js)
+	flvSupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.AAC:  {},
+	}
+	// mseSupportedCodecs are codecs which can be muxed into fragmented MP4 for MSE clients
+	mseSupportedCodecs = codecTypesSet{
+		av.H264: {},
+		av.H265: {},
+		av.AAC:  {},
+	}
+)
+
+// hasCodecType checks if there is codec of the given type in the codecs list
+func hasCodecType(codecData []av.CodecData, typ av.CodecType) bool {
+	for _, codec := range codecData {
+		if codec.Type() == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// sameCodecs checks if packets of both codecs lists could be put into the same container without re-initialization
+func sameCodecs(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+		switch codec := a[i].(type) {
+		case av.VideoCodecData:
+			other := b[i].(av.VideoCodecData)
+			if codec.Width() != other.Width() || codec.Height() != other.Height() {
+				return false
+			}
+		case av.AudioCodecData:
+			other := b[i].(av.AudioCodecData)
+			if codec.SampleRate() != other.SampleRate() || codec.ChannelLayout() != other.ChannelLayout() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// videoCodecName returns name of the first video codec in the codecs list (or empty string if there is no video)
+func videoCodecName(codecData []av.CodecData) string {
+	for _, codec := range codecData {
+		if codec.Type().IsVideo() {
+			return codec.Type().String()
+		}
+	}
+	return ""
+}
+
+// lengthPrefixedNALUs converts Annex-B video frame into the sequence of length-prefixed NAL units (as MP4 and FLV expect). Other frames are returned as is with false flag.
+// H264 parameter sets and delimiters are dropped since they are carried by codec data already. NAL unit header of H265 differs, so its units are kept
+func lengthPrefixedNALUs(frame []byte, typ av.CodecType) ([]byte, bool) {
+	nalus, naluType := h264parser.SplitNALUs(frame)
+	if naluType != h264parser.NALU_ANNEXB {
+		return frame, false
+	}
+	data := make([]byte, 0, len(frame)+4*len(nalus))
+	for _, nalu := range nalus {
+		if typ == av.H264 && !h264parser.IsDataNALU(nalu) {
+			continue
+		}
+		data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		data = append(data, nalu...)
+	}
+	return data, true
+}
+
+// codecsFilter keeps only codecs supported by the target container and remaps packets' indices accordingly
+type codecsFilter struct {
+	codecs  []av.CodecData
+	idxMap  map[int8]int8
+	dropped []av.CodecType
+}
+
+// newCodecsFilter prepares filter for the given codecs data and the set of supported codec types
+func newCodecsFilter(codecData []av.CodecData, supported codecTypesSet) codecsFilter {
+	filter := codecsFilter{
+		codecs: make([]av.CodecData, 0, len(codecData)),
+		idxMap: make(map[int8]int8, len(codecData)),
+	}
+	for idx, codec := range codecData {
+		if _, ok := supported[codec.Type()]; !ok {
+			filter.dropped = append(filter.dropped, codec.Type())
+			continue
+		}
+		filter.idxMap[int8(idx)] = int8(len(filter.codecs))
+		filter.codecs = append(filter.codecs, codec)
+	}
+	return filter
+}
+
+// remap changes index of the packet to the index in filtered codecs list. Returns false if packet belongs to dropped codec
+func (filter codecsFilter) remap(pck *av.Packet) bool {
+	idx, ok := filter.idxMap[pck.Idx]
+	if !ok {
+		return false
+	}
+	pck.Idx = idx
+	return true
+}
+
+// droppedNames returns names of dropped codecs
+func (filter codecsFilter) droppedNames() []string {
+	names := make([]string, len(filter.dropped))
+	for i, typ := range filter.dropped {
+		names[i] = typ.String()
+	}
+	return names
+}
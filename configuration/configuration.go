@@ -13,6 +13,9 @@ type Configuration struct {
 	HLSCfg         HLSConfiguration            `json:"hls" toml:"hls"`
 	ArchiveCfg     ArchiveConfiguration        `json:"archive" toml:"archive"`
 	CorsConfig     CORSConfiguration           `json:"cors" toml:"cors"`
+	RTSPServerCfg  RTSPServerConfiguration     `json:"rtsp_server" toml:"rtsp_server"`
+	WebRTCCfg      WebRTCConfiguration         `json:"webrtc" toml:"webrtc"`
+	ReconnectCfg   ReconnectConfiguration      `json:"reconnect" toml:"reconnect"`
 	RTSPStreams    []SingleStreamConfiguration `json:"rtsp_streams" toml:"rtsp_streams"`
 }
 
@@ -35,12 +38,60 @@ type VideoConfiguration struct {
 	Verbose string `json:"verbose" toml:"verbose"`
 }
 
+// RTSPServerConfiguration is needed for configuring RTSP server which accepts pushed streams (ANNOUNCE/RECORD)
+type RTSPServerConfiguration struct {
+	Enabled bool   `json:"enabled" toml:"enabled"`
+	Host    string `json:"host" toml:"host"`
+	Port    int32  `json:"port" toml:"port"`
+	Verbose string `json:"verbose" toml:"verbose"`
+}
+
+// WebRTCConfiguration is needed for configuring WebRTC (WHEP) playback of streams with provided "webrtc" type in 'output_types' field of 'rtsp_streams' objects
+type WebRTCConfiguration struct {
+	// Range of UDP ports for ICE candidates. Zero values mean that ports are picked by OS
+	PortMin uint16 `json:"port_min" toml:"port_min"`
+	PortMax uint16 `json:"port_max" toml:"port_max"`
+	// IPs which are announced in host candidates instead of the local ones (e.g. when server is behind 1:1 NAT)
+	HostIPs []string `json:"host_ips" toml:"host_ips"`
+	// Run ICE agent in lite mode. It is enough when clients could reach server's host candidates directly (e.g. in LAN)
+	ICELite bool `json:"ice_lite" toml:"ice_lite"`
+}
+
+// ReconnectConfiguration is a policy of reconnecting to the stream source. Fields are pointers, so omitted ones are told apart from explicit zeros:
+// omitted fields of the single stream policy are inherited from the global one, omitted fields of the global policy get defaults. Every field is set after post-processing
+type ReconnectConfiguration struct {
+	// Delay before the first reconnect attempt
+	InitialDelayMs *int64 `json:"initial_delay_ms" toml:"initial_delay_ms"`
+	// Maximum delay between attempts
+	MaxDelayMs *int64 `json:"max_delay_ms" toml:"max_delay_ms"`
+	// Delay is multiplied by this value after every failed attempt
+	Multiplier *float64 `json:"multiplier" toml:"multiplier"`
+	// Random deviation of delay as a fraction of it, e.g. 0.2 means ±20%
+	Jitter *float64 `json:"jitter" toml:"jitter"`
+	// Stream is stopped after this number of failed attempts in a row. Zero means infinite number of attempts
+	MaxAttempts *int `json:"max_attempts" toml:"max_attempts"`
+	// Connection is considered broken if there are no video keyframes during this time
+	NoVideoTimeoutMs *int64 `json:"no_video_timeout_ms" toml:"no_video_timeout_ms"`
+	DialTimeoutMs    *int64 `json:"dial_timeout_ms" toml:"dial_timeout_ms"`
+	ReadTimeoutMs    *int64 `json:"read_timeout_ms" toml:"read_timeout_ms"`
+	// Stream returns to the primary URL once the primary has been delivering video during this time
+	FailbackAfterMs *int64 `json:"failback_after_ms" toml:"failback_after_ms"`
+}
+
 // HLSConfiguration is a HLS configuration for every stream with provided "hls" type in 'output_types' field of 'rtsp_streams' objects
 type HLSConfiguration struct {
 	MsPerSegment int64  `json:"ms_per_segment" toml:"ms_per_segment"`
 	Directory    string `json:"directory" toml:"directory"`
 	WindowSize   uint   `json:"window_size" toml:"window_size"`
 	Capacity     uint   `json:"window_capacity" toml:"window_capacity"`
+	// Container of media segments: 'ts' (default) or 'fmp4'. HEVC streams always use 'fmp4'
+	SegmentFormat string `json:"segment_format" toml:"segment_format"`
+	// Low-Latency HLS: fMP4 partial segments and blocking playlist reload
+	LowLatency bool  `json:"low_latency" toml:"low_latency"`
+	MsPerPart  int64 `json:"ms_per_part" toml:"ms_per_part"`
+	// Playlists and segments are kept in memory instead of directory. Every stream takes no more than 'memory_limit_mb' megabytes
+	InMemory      bool  `json:"in_memory" toml:"in_memory"`
+	MemoryLimitMB int64 `json:"memory_limit_mb" toml:"memory_limit_mb"`
 }
 
 // ArchiveConfiguration is a archive configuration for every stream with enabled archive option
@@ -49,6 +100,23 @@ type ArchiveConfiguration struct {
 	MsPerSegment int64         `json:"ms_per_file" toml:"ms_per_file"`
 	Directory    string        `json:"directory" toml:"directory"`
 	Minio        MinioSettings `json:"minio_settings" toml:"minio_settings"`
+	// Exported files are kept in this directory for 'export_ttl_ms'
+	ExportDirectory string `json:"export_directory" toml:"export_directory"`
+	ExportTTLMs     int64  `json:"export_ttl_ms" toml:"export_ttl_ms"`
+	// Default retention policy for every stream
+	Retention RetentionConfiguration `json:"retention" toml:"retention"`
+	// Retention policies are checked with this interval
+	RetentionIntervalMs int64 `json:"retention_interval_ms" toml:"retention_interval_ms"`
+}
+
+// RetentionConfiguration limits the archive of the stream. Oldest segments are removed first. Zero values of the single stream policy are inherited from the global one; zero values of the global policy mean no limit
+type RetentionConfiguration struct {
+	// Segments which have been ended earlier are removed
+	MaxAgeHours float64 `json:"max_age_hours" toml:"max_age_hours"`
+	// Maximum total size of the stream archive
+	MaxSizeMB int64 `json:"max_size_mb" toml:"max_size_mb"`
+	// Segments are removed while free space of the disk is lower. Filesystem storage only
+	MinFreePercent float64 `json:"min_free_percent" toml:"min_free_percent"`
 }
 
 // MinioSettings
@@ -77,15 +145,40 @@ type CORSConfiguration struct {
 
 // SingleStreamConfiguration is needed for configuring certain RTSP stream
 type SingleStreamConfiguration struct {
-	GUID        string                     `json:"guid" toml:"guid"`
-	URL         string                     `json:"url" toml:"url"`
+	GUID string `json:"guid" toml:"guid"`
+	URL  string `json:"url" toml:"url"`
+	// Backup source URLs in order of priority. Stream fails over to them when the primary one ('url') is broken
+	URLs        []string                   `json:"urls" toml:"urls"`
 	Type        string                     `json:"type" toml:"type"`
 	OutputTypes []string                   `json:"output_types" toml:"output_types"`
 	Archive     StreamArchiveConfiguration `json:"archive" toml:"archive"`
+	// Overrides global HLS settings
+	HLS StreamHLSConfiguration `json:"hls" toml:"hls"`
+	// Credentials for publishing to the RTSP server. Required for streams with type 'rtsp_push'
+	Publish StreamPublishConfiguration `json:"publish" toml:"publish"`
+	// Overrides global reconnect policy
+	Reconnect ReconnectConfiguration `json:"reconnect" toml:"reconnect"`
+	// Connect to the source only while there are viewers. Ignored for streams with enabled archive
+	OnDemand bool `json:"on_demand" toml:"on_demand"`
+	// On-demand stream is disconnected after this period without viewers
+	IdleTimeoutMs int64 `json:"idle_timeout_ms" toml:"idle_timeout_ms"`
+	// Pass audio tracks through to the outputs. Codecs which are not supported by the certain output will be dropped
+	Audio bool `json:"audio" toml:"audio"`
 	// Level of verbose. Pick 'v' or 'vvv' (or leave it empty)
 	Verbose string `json:"verbose" toml:"verbose"`
 }
 
+// StreamHLSConfiguration is a HLS configuration for specific stream. Empty fields are inherited from the global HLS configuration
+type StreamHLSConfiguration struct {
+	SegmentFormat string `json:"segment_format" toml:"segment_format"`
+}
+
+// StreamPublishConfiguration is a set of credentials for publishers of the specific stream
+type StreamPublishConfiguration struct {
+	User     string `json:"user" toml:"user"`
+	Password string `json:"password" toml:"password"`
+}
+
 // StreamArchiveConfiguration is a archive configuration for cpecific stream. I can overwrite parent archive options in needed
 type StreamArchiveConfiguration struct {
 	Enabled      bool   `json:"enabled" toml:"enabled"`
@@ -94,4 +187,6 @@ type StreamArchiveConfiguration struct {
 	TypeArchive  string `json:"type" toml:"type"`
 	MinioBucket  string `json:"minio_bucket" toml:"minio_bucket"`
 	MinioPath    string `json:"minio_path" toml:"minio_path"`
+	// Overrides global retention policy
+	Retention RetentionConfiguration `json:"retention" toml:"retention"`
 }
@@ -1,13 +1,39 @@
 package configuration
 
+import (
+	"fmt"
+	"strings"
+)
+
 const (
 	defaultHlsDir          = "./hls"
 	defaultHlsMsPerSegment = 10000
 	defaultHlsCapacity     = 10
 	defaultHlsWindowSize   = 5
+	defaultHlsMsPerPart    = 500
+	defaultHlsFormat       = "ts"
+	defaultHlsMemoryLimit  = 64
+	defaultRTSPServerPort  = 8554
+
+	defaultArchiveExportDir   = "./export"
+	defaultArchiveExportTTLMs = 3600000
+	defaultRetentionInterval  = 60000
+	// MinIO buckets used to expire objects after 2 days
+	defaultMinioRetentionMaxAgeHours = 48
+
+	defaultReconnectInitialDelayMs = 5000
+	defaultReconnectMaxDelayMs     = 60000
+	defaultReconnectMultiplier     = 2.0
+	defaultReconnectJitter         = 0.2
+	defaultNoVideoTimeoutMs        = 15000
+	defaultDialTimeoutMs           = 33000
+	defaultReadTimeoutMs           = 33000
+	defaultFailbackAfterMs         = 60000
+
+	defaultIdleTimeoutMs = 30000
 )
 
-func postProcessDefaults(cfg *Configuration) {
+func postProcessDefaults(cfg *Configuration) error {
 	if cfg.HLSCfg.Directory == "" {
 		cfg.HLSCfg.Directory = defaultHlsDir
 	}
@@ -23,6 +49,41 @@ func postProcessDefaults(cfg *Configuration) {
 	if cfg.HLSCfg.WindowSize > cfg.HLSCfg.Capacity {
 		cfg.HLSCfg.WindowSize = cfg.HLSCfg.Capacity
 	}
+	if cfg.HLSCfg.SegmentFormat == "" {
+		cfg.HLSCfg.SegmentFormat = defaultHlsFormat
+	}
+	if cfg.HLSCfg.MsPerPart <= 0 {
+		cfg.HLSCfg.MsPerPart = defaultHlsMsPerPart
+	}
+	if cfg.HLSCfg.MsPerPart > cfg.HLSCfg.MsPerSegment {
+		cfg.HLSCfg.MsPerPart = cfg.HLSCfg.MsPerSegment
+	}
+	if cfg.HLSCfg.MemoryLimitMB <= 0 {
+		cfg.HLSCfg.MemoryLimitMB = defaultHlsMemoryLimit
+	}
+	if cfg.ArchiveCfg.ExportDirectory == "" {
+		cfg.ArchiveCfg.ExportDirectory = defaultArchiveExportDir
+	}
+	if cfg.ArchiveCfg.ExportTTLMs <= 0 {
+		cfg.ArchiveCfg.ExportTTLMs = defaultArchiveExportTTLMs
+	}
+	if cfg.ArchiveCfg.RetentionIntervalMs <= 0 {
+		cfg.ArchiveCfg.RetentionIntervalMs = defaultRetentionInterval
+	}
+	if cfg.RTSPServerCfg.Port == 0 {
+		cfg.RTSPServerCfg.Port = defaultRTSPServerPort
+	}
+	postProcessReconnect(&cfg.ReconnectCfg)
+	for i := range cfg.RTSPStreams {
+		inheritReconnect(&cfg.RTSPStreams[i].Reconnect, cfg.ReconnectCfg)
+		normalizeReconnect(&cfg.RTSPStreams[i].Reconnect)
+		if cfg.RTSPStreams[i].IdleTimeoutMs <= 0 {
+			cfg.RTSPStreams[i].IdleTimeoutMs = defaultIdleTimeoutMs
+		}
+		if cfg.RTSPStreams[i].HLS.SegmentFormat == "" {
+			cfg.RTSPStreams[i].HLS.SegmentFormat = cfg.HLSCfg.SegmentFormat
+		}
+	}
 	for i := range cfg.RTSPStreams {
 		stream := cfg.RTSPStreams[i]
 		archiveCfg := stream.Archive
@@ -55,5 +116,108 @@ func postProcessDefaults(cfg *Configuration) {
 		if archiveCfg.MinioPath == "" {
 			cfg.RTSPStreams[i].Archive.MinioPath = cfg.ArchiveCfg.Minio.DefaultPath
 		}
+
+		// Default retention settings
+		retentionCfg := &cfg.RTSPStreams[i].Archive.Retention
+		inheritRetention(retentionCfg, cfg.ArchiveCfg.Retention)
+		if strings.EqualFold(archiveCfg.TypeArchive, "minio") {
+			// MinIO can't report free space of its disks
+			if archiveCfg.Retention.MinFreePercent > 0 {
+				return fmt.Errorf("stream '%s': 'min_free_percent' retention is not supported by 'minio' archive", stream.GUID)
+			}
+			retentionCfg.MinFreePercent = 0
+			if retentionCfg.MaxAgeHours <= 0 && retentionCfg.MaxSizeMB <= 0 {
+				retentionCfg.MaxAgeHours = defaultMinioRetentionMaxAgeHours
+			}
+		}
+	}
+	return nil
+}
+
+// inheritRetention fills zero fields of the retention policy with parent's values
+func inheritRetention(retentionCfg *RetentionConfiguration, parent RetentionConfiguration) {
+	if retentionCfg.MaxAgeHours <= 0 {
+		retentionCfg.MaxAgeHours = parent.MaxAgeHours
 	}
+	if retentionCfg.MaxSizeMB <= 0 {
+		retentionCfg.MaxSizeMB = parent.MaxSizeMB
+	}
+	if retentionCfg.MinFreePercent <= 0 {
+		retentionCfg.MinFreePercent = parent.MinFreePercent
+	}
+}
+
+// postProcessReconnect sets defaults for the global reconnect policy
+func postProcessReconnect(reconnectCfg *ReconnectConfiguration) {
+	inheritReconnect(reconnectCfg, defaultReconnect())
+	normalizeReconnect(reconnectCfg)
+}
+
+// defaultReconnect returns reconnect policy with every field set to its default
+func defaultReconnect() ReconnectConfiguration {
+	return ReconnectConfiguration{
+		InitialDelayMs:   ptr(int64(defaultReconnectInitialDelayMs)),
+		MaxDelayMs:       ptr(int64(defaultReconnectMaxDelayMs)),
+		Multiplier:       ptr(defaultReconnectMultiplier),
+		Jitter:           ptr(defaultReconnectJitter),
+		MaxAttempts:      ptr(0),
+		NoVideoTimeoutMs: ptr(int64(defaultNoVideoTimeoutMs)),
+		DialTimeoutMs:    ptr(int64(defaultDialTimeoutMs)),
+		ReadTimeoutMs:    ptr(int64(defaultReadTimeoutMs)),
+		FailbackAfterMs:  ptr(int64(defaultFailbackAfterMs)),
+	}
+}
+
+// normalizeReconnect fixes values of the reconnect policy which are out of their valid ranges. Timeouts must be positive, otherwise stream would be reconnected at once
+func normalizeReconnect(reconnectCfg *ReconnectConfiguration) {
+	defaults := defaultReconnect()
+	if *reconnectCfg.InitialDelayMs < 0 {
+		*reconnectCfg.InitialDelayMs = 0
+	}
+	if *reconnectCfg.MaxDelayMs < *reconnectCfg.InitialDelayMs {
+		*reconnectCfg.MaxDelayMs = *reconnectCfg.InitialDelayMs
+	}
+	if *reconnectCfg.Multiplier < 1 {
+		*reconnectCfg.Multiplier = 1
+	}
+	if *reconnectCfg.Jitter < 0 || *reconnectCfg.Jitter > 1 {
+		*reconnectCfg.Jitter = *defaults.Jitter
+	}
+	if *reconnectCfg.MaxAttempts < 0 {
+		*reconnectCfg.MaxAttempts = 0
+	}
+	for _, timeout := range []struct{ value, fallback *int64 }{
+		{reconnectCfg.NoVideoTimeoutMs, defaults.NoVideoTimeoutMs},
+		{reconnectCfg.DialTimeoutMs, defaults.DialTimeoutMs},
+		{reconnectCfg.ReadTimeoutMs, defaults.ReadTimeoutMs},
+		{reconnectCfg.FailbackAfterMs, defaults.FailbackAfterMs},
+	} {
+		if *timeout.value <= 0 {
+			*timeout.value = *timeout.fallback
+		}
+	}
+}
+
+// inheritReconnect fills omitted fields of the reconnect policy with parent's values. Explicit values (including zeros) are kept
+func inheritReconnect(reconnectCfg *ReconnectConfiguration, parent ReconnectConfiguration) {
+	inherit(&reconnectCfg.InitialDelayMs, parent.InitialDelayMs)
+	inherit(&reconnectCfg.MaxDelayMs, parent.MaxDelayMs)
+	inherit(&reconnectCfg.Multiplier, parent.Multiplier)
+	inherit(&reconnectCfg.Jitter, parent.Jitter)
+	inherit(&reconnectCfg.MaxAttempts, parent.MaxAttempts)
+	inherit(&reconnectCfg.NoVideoTimeoutMs, parent.NoVideoTimeoutMs)
+	inherit(&reconnectCfg.DialTimeoutMs, parent.DialTimeoutMs)
+	inherit(&reconnectCfg.ReadTimeoutMs, parent.ReadTimeoutMs)
+	inherit(&reconnectCfg.FailbackAfterMs, parent.FailbackAfterMs)
+}
+
+// inherit sets copy of the parent's value if the field has been omitted
+func inherit[T any](field **T, parent *T) {
+	if *field == nil && parent != nil {
+		*field = ptr(*parent)
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
 }
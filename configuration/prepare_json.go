@@ -15,6 +15,9 @@ func PrepareConfigurationJSON(fname string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
-	postProcessDefaults(cfg)
+	err = postProcessDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
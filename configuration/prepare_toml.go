@@ -10,6 +10,9 @@ func PrepareConfigurationTOML(fname string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
-	postProcessDefaults(cfg)
+	err = postProcessDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
@@ -0,0 +1,586 @@
+package videoserver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4/timescale"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	dashProfileLive = "urn:mpeg:dash:profile:isoff-live:2011"
+	dashNamespace   = "urn:mpeg:dash:schema:mpd:2011"
+	// dashFilesMarker follows ID of the stream in names of DASH files, so they are told apart from HLS ones in the shared storage
+	dashFilesMarker = "_dash"
+)
+
+// dashSegment is a single entry of SegmentTimeline (in time scale of the representation)
+type dashSegment struct {
+	number uint64
+	t      uint64
+	d      uint64
+	size   int
+	// Index of the cut which has produced the segment. Window is measured in cuts, so every period is trimmed
+	cut uint64
+}
+
+// dashRepresentation is a single track of the stream. Every track is fragmented on its own, so players could pick audio and video separately
+type dashRepresentation struct {
+	id         string
+	codec      av.CodecData
+	fragmenter *fmp4Fragmenter
+	timeScale  uint32
+	initName   string
+	segments   []dashSegment
+	nextNumber uint64
+	// Time of the first queued packet
+	start      time.Duration
+	hasPending bool
+}
+
+// dashPeriod is a period of the presentation. New period is started when codecs of the stream have been changed or its timeline has been broken
+type dashPeriod struct {
+	id string
+	// Start of the period relative to availabilityStartTime
+	start time.Duration
+	// Media time of the stream which corresponds to the start of the period
+	mediaStart      time.Duration
+	representations []*dashRepresentation
+}
+
+// dashManifest is a state of the dynamic MPD of the single stream. It survives reconnects of the source, so players keep the same manifest
+type dashManifest struct {
+	prefix                string
+	segmentTarget         time.Duration
+	windowSize            int
+	availabilityStartTime time.Time
+	periods               []*dashPeriod
+	periodsCount          int
+	cuts                  uint64
+	end                   time.Duration
+	finished              bool
+}
+
+// mediaName returns file name of the media segment according to SegmentTemplate
+func (manifest *dashManifest) mediaName(representationID string, number uint64) string {
+	return fmt.Sprintf("%s_%s_%d%s", manifest.prefix, representationID, number, hlsFMP4Extension)
+}
+
+// nextPeriodStart returns start of the period which follows timeline break. Wall clock is used, so live edge of players stays in sync with the source after reconnect
+func (manifest *dashManifest) nextPeriodStart() time.Duration {
+	start := time.Since(manifest.availabilityStartTime)
+	if start < manifest.end {
+		start = manifest.end
+	}
+	return start
+}
+
+// newPeriod starts new period at the given time with a representation per codec
+func (manifest *dashManifest) newPeriod(start, mediaStart time.Duration, codecData []av.CodecData) (*dashPeriod, error) {
+	period := &dashPeriod{
+		id:         fmt.Sprintf("%d", manifest.periodsCount),
+		start:      start,
+		mediaStart: mediaStart,
+	}
+	manifest.periodsCount++
+	for idx, codec := range codecData {
+		fragmenter, err := newFMP4Fragmenter([]av.CodecData{codec})
+		if err != nil {
+			return nil, err
+		}
+		representation := &dashRepresentation{
+			id:         fmt.Sprintf("%s-%d", period.id, idx),
+			codec:      codec,
+			fragmenter: fragmenter,
+			timeScale:  fmp4VideoTimeScale,
+		}
+		if codec.Type().IsAudio() {
+			representation.timeScale = uint32(codec.(av.AudioCodecData).SampleRate())
+		}
+		representation.initName = fmt.Sprintf("%s_%s_init.mp4", manifest.prefix, representation.id)
+		period.representations = append(period.representations, representation)
+	}
+	manifest.periods = append(manifest.periods, period)
+	return period, nil
+}
+
+// cut closes segments of every representation of the period at the given time. Returns files which have left the window
+func (manifest *dashManifest) cut(period *dashPeriod, end time.Duration, write func(name string, data []byte) error) ([]string, error) {
+	removed := []string{}
+	for _, representation := range period.representations {
+		if !representation.hasPending {
+			continue
+		}
+		data := representation.fragmenter.Fragment()
+		representation.hasPending = false
+		if data == nil {
+			continue
+		}
+		t := timescale.ToScale(representation.start, representation.timeScale)
+		endScaled := timescale.ToScale(end, representation.timeScale)
+		if endScaled <= t {
+			endScaled = t + 1
+		}
+		segment := dashSegment{
+			number: representation.nextNumber,
+			t:      t,
+			d:      endScaled - t,
+			size:   len(data),
+			cut:    manifest.cuts,
+		}
+		if err := write(manifest.mediaName(representation.id, segment.number), data); err != nil {
+			return removed, err
+		}
+		representation.nextNumber++
+		representation.segments = append(representation.segments, segment)
+	}
+	manifest.end = period.start + end - period.mediaStart
+	manifest.cuts++
+	for _, p := range manifest.periods {
+		for _, representation := range p.representations {
+			for len(representation.segments) > 0 && representation.segments[0].cut+uint64(manifest.windowSize) < manifest.cuts {
+				removed = append(removed, manifest.mediaName(representation.id, representation.segments[0].number))
+				representation.segments = representation.segments[1:]
+			}
+		}
+	}
+	// Outdated periods have no segments anymore
+	for len(manifest.periods) > 1 && manifest.periods[0].empty() {
+		for _, representation := range manifest.periods[0].representations {
+			removed = append(removed, representation.initName)
+		}
+		manifest.periods = manifest.periods[1:]
+	}
+	return removed, nil
+}
+
+// dropEmptyPeriod removes the given period if no segment has been written to it. Returns files which are not needed anymore
+func (manifest *dashManifest) dropEmptyPeriod(period *dashPeriod) []string {
+	if period == nil || !period.empty() {
+		return nil
+	}
+	removed := []string{}
+	for i := range manifest.periods {
+		if manifest.periods[i] == period {
+			manifest.periods = append(manifest.periods[:i], manifest.periods[i+1:]...)
+			for _, representation := range period.representations {
+				removed = append(removed, representation.initName)
+			}
+			break
+		}
+	}
+	return removed
+}
+
+func (period *dashPeriod) empty() bool {
+	for _, representation := range period.representations {
+		if len(representation.segments) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// files returns names of every file which is referenced by manifest
+func (manifest *dashManifest) files() []string {
+	files := []string{}
+	for _, period := range manifest.periods {
+		for _, representation := range period.representations {
+			files = append(files, representation.initName)
+			for _, segment := range representation.segments {
+				files = append(files, manifest.mediaName(representation.id, segment.number))
+			}
+		}
+	}
+	return files
+}
+
+type dashMPDXML struct {
+	XMLName                    xml.Name        `xml:"MPD"`
+	XMLNS                      string          `xml:"xmlns,attr"`
+	Profiles                   string          `xml:"profiles,attr"`
+	Type                       string          `xml:"type,attr"`
+	AvailabilityStartTime      string          `xml:"availabilityStartTime,attr"`
+	PublishTime                string          `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string          `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MediaPresentationDuration  string          `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime              string          `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string          `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string          `xml:"suggestedPresentationDelay,attr,omitempty"`
+	Periods                    []dashPeriodXML `xml:"Period"`
+}
+
+type dashPeriodXML struct {
+	ID             string                 `xml:"id,attr"`
+	Start          string                 `xml:"start,attr"`
+	AdaptationSets []dashAdaptationSetXML `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSetXML struct {
+	ContentType      string                 `xml:"contentType,attr"`
+	MimeType         string                 `xml:"mimeType,attr"`
+	SegmentAlignment bool                   `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                    `xml:"startWithSAP,attr"`
+	AudioChannels    *dashAudioChannelsXML  `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate  dashSegmentTemplateXML `xml:"SegmentTemplate"`
+	Representation   dashRepresentationXML  `xml:"Representation"`
+}
+
+type dashRepresentationXML struct {
+	ID                string `xml:"id,attr"`
+	Codecs            string `xml:"codecs,attr"`
+	Bandwidth         int    `xml:"bandwidth,attr"`
+	Width             int    `xml:"width,attr,omitempty"`
+	Height            int    `xml:"height,attr,omitempty"`
+	AudioSamplingRate int    `xml:"audioSamplingRate,attr,omitempty"`
+}
+
+type dashAudioChannelsXML struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       int    `xml:"value,attr"`
+}
+
+type dashSegmentTemplateXML struct {
+	Timescale              uint32           `xml:"timescale,attr"`
+	Initialization         string           `xml:"initialization,attr"`
+	Media                  string           `xml:"media,attr"`
+	StartNumber            uint64           `xml:"startNumber,attr"`
+	PresentationTimeOffset uint64           `xml:"presentationTimeOffset,attr"`
+	Timeline               []dashSegmentXML `xml:"SegmentTimeline>S"`
+}
+
+type dashSegmentXML struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+}
+
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// encode returns text of MPD
+func (manifest *dashManifest) encode() ([]byte, error) {
+	window := time.Duration(manifest.windowSize) * manifest.segmentTarget
+	mpd := dashMPDXML{
+		XMLNS:                 dashNamespace,
+		Profiles:              dashProfileLive,
+		Type:                  "dynamic",
+		AvailabilityStartTime: manifest.availabilityStartTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:           time.Now().UTC().Format(time.RFC3339Nano),
+		MinBufferTime:         dashDuration(manifest.segmentTarget),
+		TimeShiftBufferDepth:  dashDuration(window),
+	}
+	if manifest.finished {
+		mpd.MediaPresentationDuration = dashDuration(manifest.end)
+	} else {
+		mpd.MinimumUpdatePeriod = dashDuration(manifest.segmentTarget)
+		mpd.SuggestedPresentationDelay = dashDuration(2 * manifest.segmentTarget)
+	}
+	for _, period := range manifest.periods {
+		periodXML := dashPeriodXML{
+			ID:    period.id,
+			Start: dashDuration(period.start),
+		}
+		for _, representation := range period.representations {
+			adaptationSet := dashAdaptationSetXML{
+				ContentType:      "video",
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+				StartWithSAP:     1,
+				Representation: dashRepresentationXML{
+					ID:        representation.id,
+					Codecs:    representation.fragmenter.CodecsString(),
+					Bandwidth: representation.bandwidth(),
+				},
+				SegmentTemplate: dashSegmentTemplateXML{
+					Timescale:              representation.timeScale,
+					Initialization:         representation.initName,
+					Media:                  fmt.Sprintf("%s_$RepresentationID$_$Number$%s", manifest.prefix, hlsFMP4Extension),
+					StartNumber:            representation.nextNumber,
+					PresentationTimeOffset: timescale.ToScale(period.mediaStart, representation.timeScale),
+				},
+			}
+			switch codec := representation.codec.(type) {
+			case av.VideoCodecData:
+				adaptationSet.Representation.Width = codec.Width()
+				adaptationSet.Representation.Height = codec.Height()
+			case av.AudioCodecData:
+				adaptationSet.ContentType = "audio"
+				adaptationSet.MimeType = "audio/mp4"
+				adaptationSet.Representation.AudioSamplingRate = codec.SampleRate()
+				adaptationSet.AudioChannels = &dashAudioChannelsXML{
+					SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+					Value:       codec.ChannelLayout().Count(),
+				}
+			}
+			if len(representation.segments) > 0 {
+				adaptationSet.SegmentTemplate.StartNumber = representation.segments[0].number
+			}
+			for _, segment := range representation.segments {
+				adaptationSet.SegmentTemplate.Timeline = append(adaptationSet.SegmentTemplate.Timeline, dashSegmentXML{T: segment.t, D: segment.d})
+			}
+			periodXML.AdaptationSets = append(periodXML.AdaptationSets, adaptationSet)
+		}
+		mpd.Periods = append(mpd.Periods, periodXML)
+	}
+	data, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// bandwidth returns average bitrate of the segments in the window
+func (representation *dashRepresentation) bandwidth() int {
+	size, duration := 0, uint64(0)
+	for _, segment := range representation.segments {
+		size += segment.size
+		duration += segment.d
+	}
+	if duration == 0 {
+		return 1
+	}
+	bandwidth := int(uint64(size) * 8 * uint64(representation.timeScale) / duration)
+	if bandwidth == 0 {
+		return 1
+	}
+	return bandwidth
+}
+
+// dashRegistry keeps live DASH manifests of the streams
+type dashRegistry struct {
+	sync.RWMutex
+	manifests map[uuid.UUID]*dashManifest
+}
+
+func newDASHRegistry() *dashRegistry {
+	return &dashRegistry{
+		manifests: make(map[uuid.UUID]*dashManifest),
+	}
+}
+
+func (registry *dashRegistry) get(streamID uuid.UUID) *dashManifest {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.manifests[streamID]
+}
+
+func (registry *dashRegistry) set(streamID uuid.UUID, manifest *dashManifest) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.manifests[streamID] = manifest
+}
+
+// remove deletes manifest of the stream if it has not been replaced yet
+func (registry *dashRegistry) remove(streamID uuid.UUID, manifest *dashManifest) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.manifests[streamID] == manifest {
+		delete(registry.manifests, streamID)
+	}
+}
+
+// startDash starts routine to create dynamic MPD with fMP4 segments. Manifest is continued after reconnects of the source with the new period
+func (app *Application) startDash(streamID uuid.UUID, ch chan streamPacket, stopCast chan StopSignal) error {
+	err := app.hlsStorage.Prepare()
+	if err != nil {
+		return errors.Wrap(err, "Can't create directory for DASH temporary files")
+	}
+	manifestFileName := fmt.Sprintf("%s.mpd", streamID)
+	log.Info().Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_MANIFEST_PREPARE).Str("stream_id", streamID.String()).Str("filename", manifestFileName).Msg("Need to start DASH for the given stream")
+
+	manifest := app.dashManifests.get(streamID)
+	if manifest == nil {
+		manifest = &dashManifest{
+			// Unique prefix lets files of the previous manifest be removed safely
+			prefix:                fmt.Sprintf("%s%s%x", streamID, dashFilesMarker, time.Now().UnixMilli()),
+			segmentTarget:         time.Duration(app.HLS.MsPerSegment) * time.Millisecond,
+			windowSize:            int(app.HLS.WindowSize),
+			availabilityStartTime: time.Now(),
+		}
+		app.dashManifests.set(streamID, manifest)
+	}
+	// Storage replaces files atomically, so players polling the manifest never get truncated one
+	writeFile := app.hlsStorage.WriteFile
+	writeManifest := func() {
+		data, err := manifest.encode()
+		if err == nil {
+			err = writeFile(manifestFileName, data)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_MANIFEST_CREATE).Str("stream_id", streamID.String()).Str("filename", manifestFileName).Msg("Can't write manifest")
+		}
+	}
+	removeFiles := func(files []string) {
+		for _, file := range files {
+			if err := app.hlsStorage.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Error().Err(err).Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_REMOVE_CHUNK).Str("stream_id", streamID.String()).Str("filename", manifestFileName).Str("chunk_name", file).Msg("Can't remove file")
+			}
+		}
+	}
+
+	var period *dashPeriod
+	var segmentCodecs codecsFilter
+	var periodInit []byte
+	mainIdx := int8(0)
+	hasVideo := false
+	// prepare starts new period if codecs of the stream have been changed or timeline has been broken
+	prepare := func(mediaTime time.Duration, discontinuity bool) error {
+		codecData, err := app.Streams.GetCodecsDataForStream(streamID)
+		if err != nil {
+			return errors.Wrap(err, streamID.String())
+		}
+		filter := newCodecsFilter(codecData, fmp4SupportedCodecs)
+		if len(filter.codecs) == 0 {
+			return errors.Wrapf(ErrFMP4NoInit, "No codecs for DASH for stream %s", streamID)
+		}
+		fragmenter, err := newFMP4Fragmenter(filter.codecs)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't prepare fMP4 fragmenter for stream %s", streamID))
+		}
+		segmentCodecs = filter
+		if period != nil && !discontinuity && bytes.Equal(periodInit, fragmenter.InitSegment()) {
+			return nil
+		}
+		if len(filter.dropped) > 0 {
+			log.Warn().Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_CODEC_SKIP).Str("stream_id", streamID.String()).Strs("codecs", filter.droppedNames()).Msg("Some codecs are not supported by segment muxer. Skipping them")
+		}
+		periodInit = fragmenter.InitSegment()
+		mainIdx, hasVideo = 0, false
+		for idx, codec := range filter.codecs {
+			if codec.Type().IsVideo() {
+				mainIdx, hasVideo = int8(idx), true
+				break
+			}
+		}
+		start := manifest.nextPeriodStart()
+		if period != nil && !discontinuity {
+			// Only codecs have been changed: timeline of the new period continues the previous one
+			start = period.start + mediaTime - period.mediaStart
+		}
+		period, err = manifest.newPeriod(start, mediaTime, filter.codecs)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't prepare DASH period for stream %s", streamID))
+		}
+		for _, representation := range period.representations {
+			err = writeFile(representation.initName, representation.fragmenter.InitSegment())
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't create fMP4 initialization segment for stream %s", streamID))
+			}
+		}
+		return nil
+	}
+	cut := func(end time.Duration) error {
+		removed, err := manifest.cut(period, end, writeFile)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't write segment for stream %s", streamID))
+		}
+		writeManifest()
+		removeFiles(removed)
+		return nil
+	}
+
+	segmentTarget := time.Duration(app.HLS.MsPerSegment) * time.Millisecond
+	started := false
+	discontinuity := false
+	finalize := false
+	segmentStart, lastMainTime, frameDuration := time.Duration(0), time.Duration(0), time.Duration(0)
+packetLoop:
+	for {
+		select {
+		case sig := <-stopCast:
+			// Stream is gone for good: players should not wait for new segments
+			finalize = sig == STOP_SIGNAL_TEARDOWN
+			break packetLoop
+		case pck := <-ch:
+			if !started {
+				if err = prepare(pck.Time, false); err != nil {
+					return err
+				}
+			}
+			if !segmentCodecs.remap(&pck.Packet) {
+				continue
+			}
+			if pck.discontinuity {
+				discontinuity = true
+			}
+			isMain := pck.Idx == mainIdx
+			isBoundary := isMain && (pck.IsKeyFrame || !hasVideo)
+			if !started {
+				if !isBoundary {
+					continue
+				}
+				started = true
+				discontinuity = false
+				segmentStart, lastMainTime = pck.Time, pck.Time
+				// Period of the new session starts with the first segment which matches wall clock time of its arrival
+				period.start, period.mediaStart = manifest.nextPeriodStart(), pck.Time
+			} else if isBoundary && (discontinuity || pck.Time-segmentStart >= segmentTarget) {
+				timelineBroken := discontinuity
+				discontinuity = false
+				if err = cut(pck.Time); err != nil {
+					return err
+				}
+				segmentStart = pck.Time
+				// Codecs could have been changed by the source
+				if err = prepare(pck.Time, timelineBroken); err != nil {
+					return err
+				}
+				if !segmentCodecs.remap(&pck.Packet) {
+					continue
+				}
+			}
+			if isMain {
+				if dur := pck.Time - lastMainTime; dur > 0 {
+					frameDuration = dur
+				}
+				lastMainTime = pck.Time
+			}
+			representation := period.representations[pck.Idx]
+			if !representation.hasPending {
+				representation.hasPending = true
+				representation.start = pck.Time
+			}
+			// Every representation holds the single track
+			pck.Idx = 0
+			if err = representation.fragmenter.WritePacket(pck.Packet); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't write packet for fMP4 fragmenter for stream %s", streamID))
+			}
+		}
+	}
+
+	if started {
+		if err = cut(lastMainTime + frameDuration); err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_WRITE_TRAIL).Str("stream_id", streamID.String()).Str("filename", manifestFileName).Msg("Can't write the last segment")
+		}
+	} else {
+		// Session has been stopped before the first keyframe
+		removeFiles(manifest.dropEmptyPeriod(period))
+	}
+	if !finalize {
+		// Manifest is continued when the source is back
+		return nil
+	}
+	manifest.finished = true
+	writeManifest()
+	app.dashManifests.remove(streamID, manifest)
+	filesToRemove := manifest.files()
+	// Deferred removal lets players fetch the tail of manifest
+	go func(delay time.Duration) {
+		time.Sleep(delay)
+		// Manifest file could have been created again by the new writer
+		if app.dashManifests.get(streamID) == nil {
+			filesToRemove = append(filesToRemove, manifestFileName)
+		}
+		removeFiles(filesToRemove)
+	}(time.Duration(app.HLS.MsPerSegment*int64(app.HLS.WindowSize)) * time.Millisecond)
+	return nil
+}
@@ -5,11 +5,38 @@ import (
 )
 
 var (
-	ErrStreamNotFound         = fmt.Errorf("stream not found for provided ID")
-	ErrStreamHasNoVideo       = fmt.Errorf("stream has no video")
-	ErrStreamDisconnected     = fmt.Errorf("disconnected")
-	ErrStreamTypeNotExists    = fmt.Errorf("stream type does not exists")
-	ErrStreamTypeNotSupported = fmt.Errorf("stream type is not supported")
-	ErrNotSupportedStorage    = fmt.Errorf("not supported storage")
-	ErrNullArchive            = fmt.Errorf("archive == nil")
+	ErrStreamNotFound            = fmt.Errorf("stream not found for provided ID")
+	ErrStreamHasNoVideo          = fmt.Errorf("stream has no video")
+	ErrStreamDisconnected        = fmt.Errorf("disconnected")
+	ErrStreamTypeNotExists       = fmt.Errorf("stream type does not exists")
+	ErrStreamTypeNotSupported    = fmt.Errorf("stream type is not supported")
+	ErrNotSupportedStorage       = fmt.Errorf("not supported storage")
+	ErrNullArchive               = fmt.Errorf("archive == nil")
+	ErrFMP4NoInit                = fmt.Errorf("can't prepare fMP4 initialization segment")
+	ErrFMP4UnknownTrack          = fmt.Errorf("packet does not belong to any fMP4 track")
+	ErrSourceTypeNotExists       = fmt.Errorf("source type does not exists")
+	ErrSourceTypeNotSupported    = fmt.Errorf("source type is not supported")
+	ErrSourceURLEmpty            = fmt.Errorf("source URL is empty")
+	ErrNoPublisher               = fmt.Errorf("no publisher for the stream")
+	ErrPublisherExists           = fmt.Errorf("stream already has a publisher")
+	ErrRTSPServerDisabled        = fmt.Errorf("RTSP server is disabled")
+	ErrReconnectAttemptsExceeded = fmt.Errorf("reconnect attempts exceeded")
+	ErrStreamDial                = fmt.Errorf("can't dial stream source")
+	ErrStreamFailback            = fmt.Errorf("primary source is healthy again")
+	ErrStreamIdle                = fmt.Errorf("stream has no viewers")
+	ErrStreamIsRunning           = fmt.Errorf("stream is already running")
+	ErrStreamRestart             = fmt.Errorf("stream is being restarted")
+	ErrOnDemandWithArchive       = fmt.Errorf("stream with enabled archive can't be on-demand")
+	ErrWebRTCNoCodecs            = fmt.Errorf("no codecs supported by WebRTC")
+	ErrWebRTCBadOffer            = fmt.Errorf("bad SDP offer")
+	ErrWHEPSessionNotFound       = fmt.Errorf("WHEP session not found")
+	ErrHLSSegmentFormatNotExists = fmt.Errorf("HLS segment format does not exist")
+	ErrHLSBlockingRequest        = fmt.Errorf("requested media sequence number is too far ahead of playlist")
+	ErrFLVNoCodecs               = fmt.Errorf("no codecs supported by FLV")
+	ErrFLVUnknownTrack           = fmt.Errorf("packet does not belong to any FLV track")
+	ErrArchiveExportEmpty        = fmt.Errorf("no archive records for the given time range")
+	ErrArchiveExportBadRange     = fmt.Errorf("bad time range for export")
+	ErrArchiveExportNotFound     = fmt.Errorf("export job not found")
+	ErrArchiveExportNotReady     = fmt.Errorf("export job is not finished")
+	ErrHLSVODNoCodecs            = fmt.Errorf("no codecs supported by HLS segment muxer")
 )
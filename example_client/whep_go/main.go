@@ -0,0 +1,112 @@
+// Minimal WHEP client: connects to the video server and reports how many frames of the stream have been received
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	endpoint = flag.String("url", "http://localhost:8090/whep/0742091c-19cd-4658-9b4f-5320da160f45", "WHEP endpoint of the stream")
+)
+
+func main() {
+	flag.Parse()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		log.Fatalln("Can't create peer connection:", err)
+	}
+	defer pc.Close()
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	if err != nil {
+		log.Fatalln("Can't add transceiver:", err)
+	}
+	frames := make(chan int, 100)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		log.Println("Track:", track.Codec().MimeType, track.Codec().SDPFmtpLine)
+		size := 0
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			size += len(pkt.Payload)
+			// Marker bit is set on the last packet of the frame
+			if pkt.Marker {
+				frames <- size
+				size = 0
+			}
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Println("Connection state:", state)
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		log.Fatalln("Can't create offer:", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(offer); err != nil {
+		log.Fatalln("Can't set local description:", err)
+	}
+	<-gathered
+
+	resp, err := http.Post(*endpoint, "application/sdp", bytes.NewBufferString(pc.LocalDescription().SDP))
+	if err != nil {
+		log.Fatalln("Can't send offer:", err)
+	}
+	answer, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalln("Can't read answer:", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		log.Fatalf("Unexpected status %d: %s\n", resp.StatusCode, answer)
+	}
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		log.Fatalln("Can't set remote description:", err)
+	}
+	session, err := url.Parse(*endpoint)
+	if err != nil {
+		log.Fatalln("Can't parse endpoint:", err)
+	}
+	session, err = session.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		log.Fatalln("Can't parse session location:", err)
+	}
+	log.Println("Session:", session)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	count, bytesCount := 0, 0
+	for {
+		select {
+		case size := <-frames:
+			count++
+			bytesCount += size
+		case <-ticker.C:
+			fmt.Printf("Frames: %d, bytes: %d\n", count, bytesCount)
+		case <-interrupt:
+			// Let server release the session immediately
+			req, _ := http.NewRequest(http.MethodDelete, session.String(), nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+			return
+		}
+	}
+}
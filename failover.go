@@ -0,0 +1,108 @@
+package videoserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// sourceURLs prepares ordered list of source URLs: primary one goes first, backups follow without duplicates
+func sourceURLs(primary string, backups []string) []string {
+	urls := make([]string, 0, len(backups)+1)
+	urls = append(urls, primary)
+	for _, url := range backups {
+		if url == "" || containsString(urls, url) {
+			continue
+		}
+		urls = append(urls, url)
+	}
+	if urls[0] == "" && len(urls) > 1 {
+		urls = urls[1:]
+	}
+	return urls
+}
+
+func containsString(list []string, str string) bool {
+	for i := range list {
+		if list[i] == str {
+			return true
+		}
+	}
+	return false
+}
+
+// probeSource checks the source in background while stream uses a backup one.
+// Returned channel is closed once the source has been delivering keyframes during policy.FailbackAfter. Probing stops when context is done
+func (app *Application) probeSource(ctx context.Context, streamID uuid.UUID, url string, sourceType SourceType, reconnectPolicy ReconnectPolicy, audioEnabled bool, streamVerboseLevel VerboseLevel) <-chan struct{} {
+	healthy := make(chan struct{})
+	go func() {
+		attempt := 0
+		for {
+			ok := app.probeSourceOnce(ctx, streamID, url, sourceType, reconnectPolicy, audioEnabled, streamVerboseLevel)
+			if ok {
+				close(healthy)
+				return
+			}
+			attempt++
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconnectPolicy.Delay(attempt)):
+			}
+		}
+	}()
+	return healthy
+}
+
+// probeSourceOnce dials the source and waits until it becomes healthy. Returns false if the source fails or context is done
+func (app *Application) probeSourceOnce(ctx context.Context, streamID uuid.UUID, url string, sourceType SourceType, reconnectPolicy ReconnectPolicy, audioEnabled bool, streamVerboseLevel VerboseLevel) bool {
+	if streamVerboseLevel > VERBOSE_SIMPLE {
+		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PROBE).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Probing primary source")
+	}
+	session, err := app.dialSource(streamID, sourceType, SourceOptions{
+		URL:              url,
+		DisableAudio:     !audioEnabled,
+		DialTimeout:      reconnectPolicy.DialTimeout,
+		ReadWriteTimeout: reconnectPolicy.ReadTimeout,
+	})
+	if err != nil {
+		if streamVerboseLevel > VERBOSE_SIMPLE {
+			log.Warn().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PROBE).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Primary source is still unavailable")
+		}
+		return false
+	}
+	defer session.Close()
+
+	pingStream := time.NewTimer(reconnectPolicy.NoVideoTimeout)
+	defer pingStream.Stop()
+	isAudioOnly := len(session.CodecData()) == 1 && session.CodecData()[0].Type().IsAudio()
+	var healthySince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-pingStream.C:
+			if streamVerboseLevel > VERBOSE_SIMPLE {
+				log.Warn().Err(ErrStreamHasNoVideo).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PROBE).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Primary source has no video")
+			}
+			return false
+		case signal := <-session.Signals():
+			if signal == SOURCE_SIGNAL_STOP {
+				return false
+			}
+		case packetAV := <-session.Packets():
+			if !isAudioOnly && !packetAV.IsKeyFrame {
+				continue
+			}
+			pingStream.Reset(reconnectPolicy.NoVideoTimeout)
+			if healthySince.IsZero() {
+				healthySince = time.Now()
+			}
+			if time.Since(healthySince) >= reconnectPolicy.FailbackAfter {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package videoserver
+
+import (
+	"io"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+	"github.com/deepch/vdk/format/flv/flvio"
+)
+
+// flvMuxer writes endless FLV stream. Unlike muxer of vdk it could announce new codecs in the middle of the stream
+type flvMuxer struct {
+	w      io.Writer
+	b      []byte
+	codecs []av.CodecData
+	// base is a time of the first packet, so FLV timestamps start from zero
+	base time.Duration
+	// last is the latest timestamp. New sequence headers are placed there
+	last    time.Duration
+	started bool
+}
+
+func newFLVMuxer(w io.Writer) *flvMuxer {
+	return &flvMuxer{
+		w: w,
+		b: make([]byte, 256),
+	}
+}
+
+// WriteHeader writes FLV header and sequence headers of the given codecs
+func (muxer *flvMuxer) WriteHeader(codecData []av.CodecData) error {
+	var flags uint8
+	for _, codec := range codecData {
+		if codec.Type().IsVideo() {
+			flags |= flvio.FILE_HAS_VIDEO
+		} else if codec.Type().IsAudio() {
+			flags |= flvio.FILE_HAS_AUDIO
+		}
+	}
+	n := flvio.FillFileHeader(muxer.b, flags)
+	if _, err := muxer.w.Write(muxer.b[:n]); err != nil {
+		return err
+	}
+	return muxer.SetCodecs(codecData)
+}
+
+// SetCodecs writes sequence headers of the given codecs. Packets which are written after that should refer to the new codecs
+func (muxer *flvMuxer) SetCodecs(codecData []av.CodecData) error {
+	for _, codec := range codecData {
+		tag, ok, err := flv.CodecDataToTag(codec)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = flvio.WriteTag(muxer.w, tag, flvio.TimeToTs(muxer.last), muxer.b); err != nil {
+			return err
+		}
+	}
+	muxer.codecs = codecData
+	return nil
+}
+
+// WritePacket writes packet as FLV tag
+func (muxer *flvMuxer) WritePacket(pkt av.Packet) error {
+	if pkt.Idx < 0 || int(pkt.Idx) >= len(muxer.codecs) {
+		return ErrFLVUnknownTrack
+	}
+	if !muxer.started {
+		muxer.started = true
+		muxer.base = pkt.Time
+	}
+	pkt.Time -= muxer.base
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+	if pkt.Time > muxer.last {
+		muxer.last = pkt.Time
+	}
+	codec := muxer.codecs[pkt.Idx]
+	if codec.Type().IsVideo() {
+		pkt.Data, _ = lengthPrefixedNALUs(pkt.Data, codec.Type())
+	}
+	tag, ts := flv.PacketToTag(pkt, codec)
+	return flvio.WriteTag(muxer.w, tag, ts, muxer.b)
+}
@@ -0,0 +1,181 @@
+package videoserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// FLVWrapper returns HTTP-FLV handler. Response is an endless FLV stream (e.g. for flv.js players)
+func FLVWrapper(streamsStorage *StreamsStorage, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Try to start FLV stream")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		if !streamsStorage.TypeExistsForStream(streamID, STREAM_TYPE_FLV) {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "No FLV output for the stream"})
+			return
+		}
+		clientID, client, err := streamsStorage.AddViewer(streamID, STREAM_TYPE_FLV)
+		if err != nil {
+			errReason := "Can't add client to the queue"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Msg(errReason)
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": errReason})
+			return
+		}
+		defer func() {
+			streamsStorage.DeleteViewer(streamID, clientID)
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("Client has been removed")
+			}
+		}()
+		// Codecs are unknown until the source is connected (e.g. on-demand stream has just been started by this viewer)
+		codecData, err := waitCodecs(streamsStorage, streamID, client.codecs, codecsTimeout)
+		if err != nil || len(codecData) == 0 {
+			errReason := "Can't extract codec for stream"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+			}
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"Error": errReason})
+			return
+		}
+		var flvCodecs codecsFilter
+		// filterCodecs keeps codecs which could be muxed into FLV. Returns false if there are none
+		filterCodecs := func(codecData []av.CodecData) bool {
+			flvCodecs = newCodecsFilter(codecData, flvSupportedCodecs)
+			if len(flvCodecs.dropped) > 0 && verboseLevel > VERBOSE_NONE {
+				log.Warn().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_CODEC_SKIP).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Strs("codecs", flvCodecs.droppedNames()).Msg("Some codecs are not supported by FLV. Skipping them")
+			}
+			return len(flvCodecs.codecs) > 0
+		}
+		if !filterCodecs(codecData) {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(ErrFLVNoCodecs.Error())
+			}
+			ctx.JSON(http.StatusNotAcceptable, gin.H{"Error": ErrFLVNoCodecs.Error()})
+			return
+		}
+
+		// Write timeout of the server is not applicable to the endless response: deadline is moved forward on every write instead
+		rc := http.NewResponseController(ctx.Writer)
+		muxer := newFLVMuxer(ctx.Writer)
+		// write calls the given muxer function and sends its output to the client immediately
+		write := func(fn func() error) bool {
+			err := rc.SetWriteDeadline(time.Now().Add(deadlineTimeout))
+			if err == nil {
+				err = fn()
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Warn().Err(err).Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("Can't write to the client")
+				}
+				return false
+			}
+			return true
+		}
+		ctx.Header("Content-Type", "video/x-flv")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Status(http.StatusOK)
+		if !write(func() error { return muxer.WriteHeader(flvCodecs.codecs) }) {
+			return
+		}
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", flvCodecs.codecs).Msg("Stream has been started")
+		}
+
+		var start bool
+		// updateCodecs sends sequence headers of the new codecs. Response is ended if there is nothing to send anymore
+		updateCodecs := func() bool {
+			codecData, err := streamsStorage.GetCodecsDataForStream(streamID)
+			if err != nil {
+				return false
+			}
+			if !filterCodecs(codecData) {
+				if verboseLevel > VERBOSE_NONE {
+					log.Warn().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg("Codecs have been changed. Client needs to reconnect")
+				}
+				return false
+			}
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", flvCodecs.codecs).Msg("Codecs have been changed. Sending new sequence headers")
+			}
+			start = false
+			return write(func() error { return muxer.SetCodecs(flvCodecs.codecs) })
+		}
+		noKeyFrames := time.NewTimer(keyFramesTimeout)
+		defer noKeyFrames.Stop()
+		for {
+			select {
+			case <-ctx.Request.Context().Done():
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("Client has gone")
+				}
+				return
+			case <-noKeyFrames.C:
+				if streamsStorage.IsReconnectingStream(streamID) {
+					// Source is going to be back: keep the client until then
+					noKeyFrames.Reset(keyFramesTimeout)
+					continue
+				}
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("No keyframes has been met")
+				}
+				return
+			case reason := <-client.disconnect:
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Info().Str("scope", SCOPE_FLV).Str("event", EVENT_FLV_STREAM).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Str("reason", reason).Msg("Client has been disconnected by server")
+				}
+				return
+			case <-client.codecs:
+				if !updateCodecs() {
+					return
+				}
+			case pck := <-client.c:
+				// Codecs signal is sent before the first packet of the new codecs, so it has to be handled first
+				select {
+				case <-client.codecs:
+					if !updateCodecs() {
+						return
+					}
+				default:
+				}
+				if !flvCodecs.remap(&pck.Packet) {
+					continue
+				}
+				if pck.IsKeyFrame {
+					noKeyFrames.Reset(keyFramesTimeout)
+					start = true
+				} else if pck.discontinuity && flvCodecs.codecs[pck.Idx].Type().IsVideo() {
+					// Timeline has been broken: decoder has to wait for the next keyframe
+					start = false
+				}
+				if !start {
+					continue
+				}
+				if !write(func() error { return muxer.WritePacket(pck.Packet) }) {
+					return
+				}
+			}
+		}
+	}
+}
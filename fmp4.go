@@ -0,0 +1,212 @@
+package videoserver
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4/fmp4io"
+	"github.com/deepch/vdk/format/fmp4/timescale"
+	"github.com/deepch/vdk/format/mp4f"
+	"github.com/deepch/vdk/utils/bits/pio"
+)
+
+const (
+	fmp4VideoTimeScale = 90000
+)
+
+// fmp4Fragmenter packs packets of every track into fragmented MP4 chunks (moof+mdat).
+// Initialization segment is prepared by mp4f muxer (since it supports H265 too), so track IDs and time scales follow its conventions
+type fmp4Fragmenter struct {
+	tracks       []*fmp4Track
+	seqNum       uint32
+	init         []byte
+	codecsString string
+}
+
+// fmp4Track is a pending queue of packets for single track of fMP4
+type fmp4Track struct {
+	codec        av.CodecData
+	trackID      uint32
+	timeScale    uint32
+	pending      []av.Packet
+	lastDuration time.Duration
+}
+
+// newFMP4Fragmenter prepares fragmenter for the given codecs. Codecs must be supported by mp4f muxer
+func newFMP4Fragmenter(codecData []av.CodecData) (*fmp4Fragmenter, error) {
+	if len(codecData) == 0 {
+		return nil, ErrFMP4NoInit
+	}
+	muxer := mp4f.NewMuxer(nil)
+	err := muxer.WriteHeader(codecData)
+	if err != nil {
+		return nil, err
+	}
+	meta, init := muxer.GetInit(codecData)
+	if len(init) == 0 {
+		return nil, ErrFMP4NoInit
+	}
+	fragmenter := &fmp4Fragmenter{
+		tracks:       make([]*fmp4Track, len(codecData)),
+		init:         init,
+		codecsString: meta,
+	}
+	for idx, codec := range codecData {
+		track := &fmp4Track{
+			codec:     codec,
+			trackID:   uint32(idx + 1),
+			timeScale: fmp4VideoTimeScale,
+		}
+		if codec.Type().IsAudio() {
+			track.timeScale = uint32(codec.(av.AudioCodecData).SampleRate())
+		}
+		fragmenter.tracks[idx] = track
+	}
+	return fragmenter, nil
+}
+
+// InitSegment returns initialization segment (ftyp+moov)
+func (fragmenter *fmp4Fragmenter) InitSegment() []byte {
+	return fragmenter.init
+}
+
+// CodecsString returns RFC 6381 codecs string, e.g. 'avc1.64001F,mp4a.40.2'
+func (fragmenter *fmp4Fragmenter) CodecsString() string {
+	return fragmenter.codecsString
+}
+
+// WritePacket queues packet for the next fragment
+func (fragmenter *fmp4Fragmenter) WritePacket(pkt av.Packet) error {
+	if pkt.Idx < 0 || int(pkt.Idx) >= len(fragmenter.tracks) {
+		return ErrFMP4UnknownTrack
+	}
+	track := fragmenter.tracks[pkt.Idx]
+	if track.codec.Type().IsVideo() {
+		// Samples must be length-prefixed
+		pkt.Data, _ = lengthPrefixedNALUs(pkt.Data, track.codec.Type())
+	}
+	track.pending = append(track.pending, pkt)
+	return nil
+}
+
+// PendingDuration returns duration of queued video packets (or of the first track if there is no video)
+func (fragmenter *fmp4Fragmenter) PendingDuration() time.Duration {
+	for _, track := range fragmenter.tracks {
+		if track.codec.Type().IsVideo() {
+			return track.pendingDuration()
+		}
+	}
+	if len(fragmenter.tracks) > 0 {
+		return fragmenter.tracks[0].pendingDuration()
+	}
+	return 0
+}
+
+// Fragment flushes every queued packet into the single fragment. Returns nil if there are no queued packets
+func (fragmenter *fmp4Fragmenter) Fragment() []byte {
+	moof := &fmp4io.MovieFrag{
+		Header: &fmp4io.MovieFragHeader{},
+	}
+	var samples [][]av.Packet
+	for _, track := range fragmenter.tracks {
+		if len(track.pending) == 0 {
+			continue
+		}
+		moof.Tracks = append(moof.Tracks, track.makeTrackFrag())
+		samples = append(samples, track.pending)
+		track.pending = nil
+	}
+	if len(moof.Tracks) == 0 {
+		return nil
+	}
+	fragmenter.seqNum++
+	moof.Header.Seqnum = fragmenter.seqNum
+
+	// Data offsets are relative to the start of moof (plus mdat header)
+	dataBase := moof.Len() + 8
+	dataOffset := dataBase
+	for i, packets := range samples {
+		moof.Tracks[i].Run.DataOffset = uint32(dataOffset)
+		for _, pkt := range packets {
+			dataOffset += len(pkt.Data)
+		}
+	}
+	buf := make([]byte, dataBase, dataOffset)
+	n := moof.Marshal(buf)
+	pio.PutU32BE(buf[n:], uint32(dataOffset-dataBase+8))
+	pio.PutU32BE(buf[n+4:], uint32(fmp4io.MDAT))
+	for _, packets := range samples {
+		for _, pkt := range packets {
+			buf = append(buf, pkt.Data...)
+		}
+	}
+	return buf
+}
+
+func (track *fmp4Track) pendingDuration() time.Duration {
+	if len(track.pending) == 0 {
+		return 0
+	}
+	last := track.pending[len(track.pending)-1]
+	return last.Time - track.pending[0].Time + track.sampleDuration(len(track.pending)-1)
+}
+
+// sampleDuration returns duration of the queued sample. The last one is estimated since next packet is unknown yet
+func (track *fmp4Track) sampleDuration(i int) time.Duration {
+	if i+1 < len(track.pending) {
+		if dur := track.pending[i+1].Time - track.pending[i].Time; dur > 0 {
+			return dur
+		}
+	}
+	if track.pending[i].Duration > 0 {
+		return track.pending[i].Duration
+	}
+	return track.lastDuration
+}
+
+func (track *fmp4Track) makeTrackFrag() *fmp4io.TrackFrag {
+	isVideo := track.codec.Type().IsVideo()
+	trackFrag := &fmp4io.TrackFrag{
+		Header: &fmp4io.TrackFragHeader{
+			Flags:   fmp4io.TrackFragDefaultBaseIsMOOF,
+			TrackID: track.trackID,
+		},
+		DecodeTime: &fmp4io.TrackFragDecodeTime{
+			Version: 1,
+			Time:    timescale.ToScale(track.pending[0].Time, track.timeScale),
+		},
+		Run: &fmp4io.TrackFragRun{
+			Flags:   fmp4io.TrackRunDataOffset | fmp4io.TrackRunSampleDuration | fmp4io.TrackRunSampleSize | fmp4io.TrackRunSampleFlags,
+			Entries: make([]fmp4io.TrackFragRunEntry, len(track.pending)),
+		},
+	}
+	dts := trackFrag.DecodeTime.Time
+	for i, pkt := range track.pending {
+		duration := track.sampleDuration(i)
+		if duration > 0 {
+			track.lastDuration = duration
+		}
+		nextDTS := timescale.ToScale(pkt.Time+duration, track.timeScale)
+		if nextDTS < dts {
+			nextDTS = dts
+		}
+		entry := fmp4io.TrackFragRunEntry{
+			Duration: uint32(nextDTS - dts),
+			Size:     uint32(len(pkt.Data)),
+			Flags:    fmp4io.SampleNoDependencies,
+		}
+		if isVideo && !pkt.IsKeyFrame {
+			entry.Flags = fmp4io.SampleNonKeyframe
+		}
+		if pkt.CompositionTime != 0 {
+			trackFrag.Run.Flags |= fmp4io.TrackRunSampleCTS
+			entry.CTS = timescale.Relative(pkt.CompositionTime, track.timeScale)
+			if entry.CTS < 0 {
+				trackFrag.Run.Version = 1
+			}
+		}
+		trackFrag.Run.Entries[i] = entry
+		dts = nextDTS
+	}
+	return trackFrag
+}
@@ -1,9 +1,12 @@
 package videoserver
 
 import (
+	"bytes"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"math"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -15,71 +18,189 @@ import (
 	"github.com/pkg/errors"
 )
 
-// startHls starts routine to create m3u8 playlists
-func (app *Application) startHls(streamID uuid.UUID, ch chan av.Packet, stopCast chan StopSignal) error {
-	err := ensureDir(app.HLS.Directory)
+const (
+	hlsTSExtension   = ".ts"
+	hlsFMP4Extension = ".m4s"
+	// hlsWallClockMaxDrift is the largest allowed difference between EXT-X-PROGRAM-DATE-TIME and wall clock
+	hlsWallClockMaxDrift = time.Second
+)
+
+// hlsLivePlaylist is a state of the live HLS playlist. It survives reconnects of the source, so players keep the same playlist
+type hlsLivePlaylist struct {
+	// prefix of every segment name. Unique for every playlist, so files of the previous one could be removed safely
+	prefix        string
+	playlist      *m3u8.MediaPlaylist
+	segmentNumber int
+	fragmenter    *fmp4Fragmenter
+	initName      string
+	useFMP4       bool
+}
+
+// hlsRegistry keeps live HLS playlists of the streams
+type hlsRegistry struct {
+	sync.RWMutex
+	playlists map[uuid.UUID]*hlsLivePlaylist
+}
+
+func newHLSRegistry() *hlsRegistry {
+	return &hlsRegistry{
+		playlists: make(map[uuid.UUID]*hlsLivePlaylist),
+	}
+}
+
+func (registry *hlsRegistry) get(streamID uuid.UUID) *hlsLivePlaylist {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.playlists[streamID]
+}
+
+func (registry *hlsRegistry) set(streamID uuid.UUID, live *hlsLivePlaylist) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.playlists[streamID] = live
+}
+
+// remove deletes playlist of the stream if it has not been replaced yet
+func (registry *hlsRegistry) remove(streamID uuid.UUID, live *hlsLivePlaylist) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.playlists[streamID] == live {
+		delete(registry.playlists, streamID)
+	}
+}
+
+// slideHLSPlaylist appends segment to the sliding window. EXT-X-DISCONTINUITY-SEQUENCE counts discontinuities which have left the window
+func slideHLSPlaylist(playlist *m3u8.MediaPlaylist, uri string, duration float64) {
+	if !playlist.Closed && playlist.Count() >= playlist.WinSize() {
+		for _, segment := range playlist.Segments {
+			if segment != nil && segment.SeqId == playlist.SeqNo && segment.Discontinuity {
+				playlist.DiscontinuitySeq++
+			}
+		}
+	}
+	playlist.Slide(uri, duration, "")
+}
+
+// startHls starts routine to create m3u8 playlists. Playlist is continued after reconnects of the source
+func (app *Application) startHls(streamID uuid.UUID, ch chan streamPacket, stopCast chan StopSignal) error {
+	err := app.hlsStorage.Prepare()
 	if err != nil {
 		return errors.Wrap(err, "Can't create directory for HLS temporary files")
 	}
 
 	// Create playlist for HLS streams
-	playlistFileName := filepath.Join(app.HLS.Directory, fmt.Sprintf("%s.m3u8", streamID))
+	playlistFileName := fmt.Sprintf("%s.m3u8", streamID)
 	log.Info().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_PREPARE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Msg("Need to start HLS for the given stream")
-	playlist, err := m3u8.NewMediaPlaylist(app.HLS.WindowSize, app.HLS.Capacity)
+
+	segmentFormat, err := app.Streams.GetHLSSegmentFormatForStream(streamID)
 	if err != nil {
-		return errors.Wrap(err, "Can't create new mediaplayer list")
+		return errors.Wrap(err, streamID.String())
 	}
 
+	// Timeline has been broken, so the next segment should be marked with discontinuity
+	segmentDiscontinuity := false
+	live := app.hlsPlaylists.get(streamID)
+	if live == nil {
+		playlist, err := m3u8.NewMediaPlaylist(app.HLS.WindowSize, app.HLS.Capacity)
+		if err != nil {
+			return errors.Wrap(err, "Can't create new mediaplayer list")
+		}
+		// Segments are cut on keyframes, so they are not shorter than configured duration. Target duration grows only if GOP of the source is longer
+		playlist.TargetDuration = math.Ceil(float64(app.HLS.MsPerSegment) / 1000)
+		live = &hlsLivePlaylist{
+			prefix:   fmt.Sprintf("%s_%x", streamID, time.Now().Unix()),
+			playlist: playlist,
+		}
+		app.hlsPlaylists.set(streamID, live)
+	} else {
+		// Source has been reconnected
+		segmentDiscontinuity = live.playlist.Count() > 0
+	}
+	playlist := live.playlist
+
 	isConnected := true
-	segmentNumber := 0
-	lastPacketTime := time.Duration(0)
 	lastKeyFrame := av.Packet{}
+	finalize := false
+	discontinuity := false
+	// Wall clock of the timeline is evaluated from the first packet and re-evaluated after the timeline breaks
+	var wallClockBase time.Time
+	var wallClockPTS time.Duration
 
-	// time.Sleep(5 * time.Second) // Artificial delay to wait for first key frame
 	for isConnected {
-		// Create new segment file
-		segmentName := fmt.Sprintf("%s%04d.ts", streamID, segmentNumber)
-		segmentPath := filepath.Join(app.HLS.Directory, segmentName)
-		outFile, err := os.Create(segmentPath)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("Can't create TS-segment for stream %s", streamID))
-		}
-		tsMuxer := ts.NewMuxer(outFile)
-
-		// Write header
+		// Prepare header
 		codecData, err := app.Streams.GetCodecsDataForStream(streamID)
 		if err != nil {
 			return errors.Wrap(err, streamID.String())
 		}
-		err = tsMuxer.WriteHeader(codecData)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("Can't write header for TS muxer for stream %s", streamID))
+		// HEVC can't be carried by MPEG-TS segments for the most of players, so fMP4 segments are used regardless of configured format
+		useFMP4 := segmentFormat == HLS_SEGMENT_FORMAT_FMP4 || hasCodecType(codecData, av.H265)
+		supportedCodecs := tsSupportedCodecs
+		segmentExt := hlsTSExtension
+		if useFMP4 {
+			supportedCodecs = fmp4SupportedCodecs
+			segmentExt = hlsFMP4Extension
+		}
+		segmentCodecs := newCodecsFilter(codecData, supportedCodecs)
+		if len(segmentCodecs.dropped) > 0 && live.segmentNumber == 0 {
+			log.Warn().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_CODEC_SKIP).Str("stream_id", streamID.String()).Strs("codecs", segmentCodecs.droppedNames()).Msg("Some codecs are not supported by segment muxer. Skipping them")
+		}
+		initChanged := live.segmentNumber > 0 && useFMP4 != live.useFMP4
+		live.useFMP4 = useFMP4
+		if useFMP4 {
+			segmentFragmenter, err := newFMP4Fragmenter(segmentCodecs.codecs)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't prepare fMP4 fragmenter for stream %s", streamID))
+			}
+			// Keep sequence numbers and initialization segment while codecs are the same
+			if live.fragmenter == nil || !bytes.Equal(live.fragmenter.InitSegment(), segmentFragmenter.InitSegment()) {
+				initChanged = initChanged || live.fragmenter != nil
+				live.fragmenter = segmentFragmenter
+				live.initName = fmt.Sprintf("%s_init%04d.mp4", live.prefix, live.segmentNumber)
+				err = app.hlsStorage.WriteFile(live.initName, live.fragmenter.InitSegment())
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("Can't create fMP4 initialization segment for stream %s", streamID))
+				}
+			}
+		}
+
+		// Segment is prepared in memory and is stored when it is completed
+		segmentName := fmt.Sprintf("%s_%04d%s", live.prefix, live.segmentNumber, segmentExt)
+		var segmentBuf bytes.Buffer
+		var segmentMuxer hlsSegmentMuxer
+		if useFMP4 {
+			segmentMuxer = &fmp4SegmentMuxer{w: &segmentBuf, fragmenter: live.fragmenter}
+		} else {
+			tsMuxer := ts.NewMuxer(&segmentBuf)
+			err = tsMuxer.WriteHeader(segmentCodecs.codecs)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't write header for TS muxer for stream %s", streamID))
+			}
+			segmentMuxer = tsMuxer
 		}
 
 		// Write packets
 		videoStreamIdx := int8(0)
-		for idx, codec := range codecData {
+		for idx, codec := range segmentCodecs.codecs {
 			if codec.Type().IsVideo() {
 				videoStreamIdx = int8(idx)
 				break
 			}
 		}
 
-		segmentLength := time.Duration(0)
-		packetLength := time.Duration(0)
+		// Duration of the segment is evaluated from timestamps of the main track
+		segmentStart, segmentEnd := time.Duration(0), time.Duration(0)
+		lastVideoTime, frameDuration := time.Duration(0), time.Duration(0)
 		segmentCount := 0
 		start := false
+		nextSegmentDiscontinuity := false
 
 		// Write lastKeyFrame if exist
 		if lastKeyFrame.IsKeyFrame {
 			start = true
-			if err = tsMuxer.WritePacket(lastKeyFrame); err != nil {
-				return errors.Wrap(err, fmt.Sprintf("Can't write packet for TS muxer for stream %s (1)", streamID))
+			if err = segmentMuxer.WritePacket(lastKeyFrame); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't write packet for segment muxer for stream %s (1)", streamID))
 			}
-			// Evaluate segment's length
-			packetLength = lastKeyFrame.Time - lastPacketTime
-			lastPacketTime = lastKeyFrame.Time
-			segmentLength += packetLength
+			segmentStart, lastVideoTime = lastKeyFrame.Time, lastKeyFrame.Time
 			segmentCount++
 		}
 
@@ -87,85 +208,156 @@ func (app *Application) startHls(streamID uuid.UUID, ch chan av.Packet, stopCast
 	segmentLoop:
 		for {
 			select {
-			case <-stopCast:
+			case sig := <-stopCast:
 				isConnected = false
+				// Stream is gone for good: players should not wait for new segments
+				finalize = sig == STOP_SIGNAL_TEARDOWN
+				segmentEnd = lastVideoTime + frameDuration
 				break segmentLoop
 			case pck := <-ch:
+				if !segmentCodecs.remap(&pck.Packet) {
+					continue
+				}
+				// Every track reports the break, but segments are cut by the main one
+				if pck.discontinuity && pck.Idx == videoStreamIdx {
+					discontinuity = true
+				}
 				if pck.Idx == videoStreamIdx && pck.IsKeyFrame {
-					start = true
-					if segmentLength.Milliseconds() >= app.HLS.MsPerSegment {
-						lastKeyFrame = pck
+					if discontinuity {
+						discontinuity = false
+						// Nothing to cut if the segment is empty yet (e.g. the very first one)
+						if segmentCount == 0 {
+							segmentDiscontinuity = segmentDiscontinuity || live.segmentNumber > 0
+						} else {
+							lastKeyFrame = pck.Packet
+							nextSegmentDiscontinuity = true
+							segmentEnd = lastVideoTime + frameDuration
+							break segmentLoop
+						}
+					}
+					if start && pck.Time-segmentStart >= time.Duration(app.HLS.MsPerSegment)*time.Millisecond {
+						lastKeyFrame = pck.Packet
+						segmentEnd = pck.Time
 						break segmentLoop
 					}
+					if !start {
+						start = true
+						segmentStart, lastVideoTime = pck.Time, pck.Time
+					}
 				}
 				if !start {
 					continue
 				}
-				if (pck.Idx == videoStreamIdx && pck.Time > lastPacketTime) || pck.Idx != videoStreamIdx {
-					if err = tsMuxer.WritePacket(pck); err != nil {
-						return errors.Wrap(err, fmt.Sprintf("Can't write packet for TS muxer for stream %s (2)", streamID))
-					}
-					if pck.Idx == videoStreamIdx {
-						// Evaluate segment length
-						packetLength = pck.Time - lastPacketTime
-						lastPacketTime = pck.Time
-						segmentLength += packetLength
+				// Timestamps are monotonic after normalization, so every packet could be written
+				if err = segmentMuxer.WritePacket(pck.Packet); err != nil {
+					return errors.Wrap(err, fmt.Sprintf("Can't write packet for segment muxer for stream %s (2)", streamID))
+				}
+				if pck.Idx == videoStreamIdx {
+					if dur := pck.Time - lastVideoTime; dur > 0 {
+						frameDuration = dur
 					}
-					segmentCount++
-				} else {
-					// fmt.Println("Current packet time < previous ")
+					lastVideoTime = pck.Time
 				}
+				segmentCount++
 			}
 		}
+		if segmentCount == 0 {
+			// Source has gone before the first keyframe
+			break
+		}
 
-		err = tsMuxer.WriteTrailer()
+		err = segmentMuxer.WriteTrailer()
 		if err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_WRITE_TRAIL).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", outFile.Name()).Msg("Can't write trailing data for TS muxer")
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_WRITE_TRAIL).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", segmentName).Msg("Can't write trailing data for segment muxer")
 			// @todo: handle?
 		}
 
-		err = outFile.Close()
+		err = app.hlsStorage.WriteFile(segmentName, segmentBuf.Bytes())
 		if err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_CLOSE_FILE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", outFile.Name()).Msg("Can't close file")
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_CLOSE_FILE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", segmentName).Msg("Can't write segment")
 			// @todo: handle?
 		}
 
+		// Wall clock drifts from timestamps of the source (e.g. camera clock is not precise), so it is re-evaluated when the difference becomes noticeable
+		now := time.Now()
+		if drift := now.Sub(wallClockBase.Add(segmentEnd - wallClockPTS)); wallClockBase.IsZero() || drift > hlsWallClockMaxDrift || drift < -hlsWallClockMaxDrift {
+			wallClockBase, wallClockPTS = now, segmentEnd
+		}
+		programDateTime := wallClockBase.Add(segmentStart - wallClockPTS)
+		if nextSegmentDiscontinuity {
+			// Timeline after the break is mapped to wall clock from scratch
+			wallClockBase = time.Time{}
+		}
+
 		// Update playlist
-		playlist.Slide(segmentName, segmentLength.Seconds(), "")
-		playlistFile, err := os.Create(playlistFileName)
+		slideHLSPlaylist(playlist, segmentName, (segmentEnd - segmentStart).Seconds())
+		playlist.SetProgramDateTime(programDateTime.UTC())
+		if useFMP4 {
+			playlist.SetVersion(7)
+			playlist.SetMap(live.initName, 0, 0)
+		}
+		if initChanged || segmentDiscontinuity {
+			playlist.SetDiscontinuity()
+		}
+		segmentDiscontinuity = nextSegmentDiscontinuity
+		if finalize {
+			playlist.Close()
+		}
+		err = app.hlsStorage.WriteFile(playlistFileName, playlist.Encode().Bytes())
 		if err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_CREATE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", outFile.Name()).Msg("Can't create playlist")
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_CREATE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", segmentName).Msg("Can't create playlist")
 			// @todo: handle?
 		}
-		playlistFile.Write(playlist.Encode().Bytes())
-		playlistFile.Close()
-		log.Info().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_RESTART).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", outFile.Name()).Msg("Playlist restart")
+		log.Info().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_RESTART).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", segmentName).Msg("Playlist restart")
 		// Cleanup segments
 		if err := app.removeOutdatedSegments(streamID, playlist); err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_REMOVE_OUTDATED).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", outFile.Name()).Msg("Can't remove outdated segments")
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_REMOVE_OUTDATED).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("out_filename", segmentName).Msg("Can't remove outdated segments")
 			// @todo: handle?
 		}
 
-		segmentNumber++
+		live.segmentNumber++
 	}
 
+	if !finalize {
+		// Playlist is continued when the source is back
+		return nil
+	}
+	if !playlist.Closed {
+		// The last segment has not been written
+		playlist.Close()
+		err = app.hlsStorage.WriteFile(playlistFileName, playlist.Encode().Bytes())
+		if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_CREATE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Msg("Can't create playlist")
+		}
+	}
+	app.hlsPlaylists.remove(streamID, live)
+
 	filesToRemove := make([]string, len(playlist.Segments)+1)
 
 	// Collect obsolete files
+	initFiles := make(map[string]struct{})
 	for _, segment := range playlist.Segments {
 		if segment != nil {
 			filesToRemove = append(filesToRemove, segment.URI)
+			if segment.Map != nil {
+				initFiles[segment.Map.URI] = struct{}{}
+			}
 		}
 	}
-	_, fileName := filepath.Split(playlistFileName)
-	filesToRemove = append(filesToRemove, fileName)
+	for initFile := range initFiles {
+		filesToRemove = append(filesToRemove, initFile)
+	}
 
 	// Defered removement
 	go func(delay time.Duration, filesToRemove []string) {
 		time.Sleep(delay)
+		// Playlist file could have been created again by the new writer
+		if app.hlsPlaylists.get(streamID) == nil {
+			filesToRemove = append(filesToRemove, playlistFileName)
+		}
 		for _, file := range filesToRemove {
 			if file != "" {
-				if err := os.Remove(filepath.Join(app.HLS.Directory, file)); err != nil {
+				if err := app.hlsStorage.Remove(file); err != nil {
 					log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_REMOVE_CHUNK).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("chunk_name", file).Msg("Can't remove file (defered)")
 					// @todo: handle?
 				}
@@ -176,25 +368,35 @@ func (app *Application) startHls(streamID uuid.UUID, ch chan av.Packet, stopCast
 	return nil
 }
 
-// removeOutdatedSegments removes outdated *.ts
+// removeOutdatedSegments removes outdated *.ts / *.m4s segments and fMP4 initialization segments
 func (app *Application) removeOutdatedSegments(streamID uuid.UUID, playlist *m3u8.MediaPlaylist) error {
 	// Write all playlist segment URIs into map
 	currentSegments := make(map[string]struct{}, len(playlist.Segments))
 	for _, segment := range playlist.Segments {
 		if segment != nil {
 			currentSegments[segment.URI] = struct{}{}
+			if segment.Map != nil {
+				currentSegments[segment.Map.URI] = struct{}{}
+			}
 		}
 	}
-	// Find possible segment files in current directory
-	segmentFiles, err := filepath.Glob(filepath.Join(app.HLS.Directory, fmt.Sprintf("%s*.ts", streamID)))
-	if err != nil {
-		return err
+	// Find possible segment files of the stream
+	segmentFiles := []string{}
+	for _, pattern := range []string{"%s*" + hlsTSExtension, "%s*" + hlsFMP4Extension, "%s*_init*.mp4"} {
+		matches, err := app.hlsStorage.Glob(fmt.Sprintf(pattern, streamID))
+		if err != nil {
+			return err
+		}
+		segmentFiles = append(segmentFiles, matches...)
 	}
 	for _, segmentFile := range segmentFiles {
-		_, fileName := filepath.Split(segmentFile)
+		// DASH writer keeps its files in the same storage
+		if strings.HasPrefix(segmentFile, streamID.String()+dashFilesMarker) {
+			continue
+		}
 		// Check if file belongs to a playlist's segment
-		if _, ok := currentSegments[fileName]; !ok {
-			if err := os.Remove(segmentFile); err != nil {
+		if _, ok := currentSegments[segmentFile]; !ok {
+			if err := app.hlsStorage.Remove(segmentFile); err != nil {
 				log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_REMOVE_OUTDATED_SEGMENT).Str("stream_id", streamID.String()).Str("filename", playlist.String()).Str("segment", segmentFile).Msg("Can't remove outdated segment")
 				// @todo: handle?
 			}
@@ -202,3 +404,26 @@ func (app *Application) removeOutdatedSegments(streamID uuid.UUID, playlist *m3u
 	}
 	return nil
 }
+
+// hlsSegmentMuxer writes packets into single HLS segment
+type hlsSegmentMuxer interface {
+	WritePacket(pkt av.Packet) error
+	WriteTrailer() error
+}
+
+// fmp4SegmentMuxer writes packets into single fMP4 (.m4s) segment. Initialization segment is stored separately
+type fmp4SegmentMuxer struct {
+	w          io.Writer
+	fragmenter *fmp4Fragmenter
+}
+
+// WritePacket queues packet for the segment's fragment
+func (muxer *fmp4SegmentMuxer) WritePacket(pkt av.Packet) error {
+	return muxer.fragmenter.WritePacket(pkt)
+}
+
+// WriteTrailer flushes queued packets as the single moof+mdat
+func (muxer *fmp4SegmentMuxer) WriteTrailer() error {
+	_, err := muxer.w.Write(muxer.fragmenter.Fragment())
+	return err
+}
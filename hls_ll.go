@@ -0,0 +1,591 @@
+package videoserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// llhlsPartHoldBack is a number of part target durations which client should stay behind the live edge
+	llhlsPartHoldBack = 3
+	// llhlsPartsWindow is a number of target durations from the end of playlist where parts are listed
+	llhlsPartsWindow = 3
+	// llhlsMaxBlockingTimeout keeps blocking requests shorter than write timeout of the video server
+	llhlsMaxBlockingTimeout = 20 * time.Second
+)
+
+// llhlsPart is a partial segment (EXT-X-PART)
+type llhlsPart struct {
+	uri         string
+	duration    time.Duration
+	independent bool
+}
+
+// llhlsSegment is a media segment which consists of partial segments
+type llhlsSegment struct {
+	msn           uint64
+	uri           string
+	duration      time.Duration
+	parts         []llhlsPart
+	mapURI        string
+	discontinuity bool
+	// Wall clock time of the first sample (EXT-X-PROGRAM-DATE-TIME)
+	programDateTime time.Time
+}
+
+// llhlsPlaylist is a live LL-HLS media playlist of the single stream. It is kept in memory so blocking playlist reloads could be served
+type llhlsPlaylist struct {
+	sync.Mutex
+	// prefix of every file name of the playlist. Unique for every playlist, so files of the previous one could be removed safely
+	prefix           string
+	partTarget       time.Duration
+	segmentTarget    time.Duration
+	windowSize       int
+	segments         []*llhlsSegment
+	current          *llhlsSegment
+	discontinuitySeq uint64
+	finished         bool
+	// updated is closed (and replaced) on every change of the playlist
+	updated chan struct{}
+}
+
+func newLLHLSPlaylist(streamID uuid.UUID, partTarget, segmentTarget time.Duration, windowSize uint) *llhlsPlaylist {
+	playlist := &llhlsPlaylist{
+		prefix:        fmt.Sprintf("%s_ll%x", streamID, time.Now().Unix()),
+		partTarget:    partTarget,
+		segmentTarget: segmentTarget,
+		windowSize:    int(windowSize),
+		updated:       make(chan struct{}),
+	}
+	playlist.current = &llhlsSegment{uri: playlist.segmentName(0)}
+	return playlist
+}
+
+func (playlist *llhlsPlaylist) segmentName(msn uint64) string {
+	return fmt.Sprintf("%s_%d%s", playlist.prefix, msn, hlsFMP4Extension)
+}
+
+func (playlist *llhlsPlaylist) partName(msn uint64, part int) string {
+	return fmt.Sprintf("%s_%d.%d%s", playlist.prefix, msn, part, hlsFMP4Extension)
+}
+
+func (playlist *llhlsPlaylist) initName(msn uint64) string {
+	return fmt.Sprintf("%s_init%d.mp4", playlist.prefix, msn)
+}
+
+// parsePartName extracts position of the partial segment from its file name
+func (playlist *llhlsPlaylist) parsePartName(name string) (uint64, int, bool) {
+	rest, ok := strings.CutPrefix(name, playlist.prefix+"_")
+	if !ok {
+		return 0, 0, false
+	}
+	var msn uint64
+	var part int
+	n, err := fmt.Sscanf(rest, "%d.%d"+hlsFMP4Extension, &msn, &part)
+	return msn, part, err == nil && n == 2
+}
+
+// notify wakes up blocked requests. Lock must be held
+func (playlist *llhlsPlaylist) notify() {
+	close(playlist.updated)
+	playlist.updated = make(chan struct{})
+}
+
+// setMap sets initialization segment for the current segment
+func (playlist *llhlsPlaylist) setMap(uri string) {
+	playlist.Lock()
+	defer playlist.Unlock()
+	playlist.current.mapURI = uri
+}
+
+// markDiscontinuity marks the current segment as the first one after the timeline break
+func (playlist *llhlsPlaylist) markDiscontinuity() {
+	playlist.Lock()
+	defer playlist.Unlock()
+	if len(playlist.segments) > 0 {
+		playlist.current.discontinuity = true
+	}
+}
+
+// nextPart returns file name of the next partial segment
+func (playlist *llhlsPlaylist) nextPart() string {
+	playlist.Lock()
+	defer playlist.Unlock()
+	return playlist.partName(playlist.current.msn, len(playlist.current.parts))
+}
+
+// addPart appends partial segment to the current segment. Program date time is assigned to the segment by its first part
+func (playlist *llhlsPlaylist) addPart(part llhlsPart, programDateTime time.Time) {
+	playlist.Lock()
+	defer playlist.Unlock()
+	if len(playlist.current.parts) == 0 {
+		playlist.current.programDateTime = programDateTime
+	}
+	playlist.current.parts = append(playlist.current.parts, part)
+	playlist.current.duration += part.duration
+	playlist.notify()
+}
+
+// completeSegment closes the current segment and starts the next one. Returns segments which have left the window
+func (playlist *llhlsPlaylist) completeSegment() []*llhlsSegment {
+	playlist.Lock()
+	defer playlist.Unlock()
+	completed := playlist.current
+	playlist.segments = append(playlist.segments, completed)
+	playlist.current = &llhlsSegment{
+		msn:    completed.msn + 1,
+		uri:    playlist.segmentName(completed.msn + 1),
+		mapURI: completed.mapURI,
+	}
+	var removed []*llhlsSegment
+	if len(playlist.segments) > playlist.windowSize {
+		removed = append(removed, playlist.segments[:len(playlist.segments)-playlist.windowSize]...)
+		playlist.segments = playlist.segments[len(playlist.segments)-playlist.windowSize:]
+		for _, segment := range removed {
+			if segment.discontinuity {
+				playlist.discontinuitySeq++
+			}
+		}
+	}
+	playlist.notify()
+	return removed
+}
+
+// finish marks playlist as ended (EXT-X-ENDLIST)
+func (playlist *llhlsPlaylist) finish() {
+	playlist.Lock()
+	defer playlist.Unlock()
+	playlist.finished = true
+	playlist.notify()
+}
+
+// isFinished checks if playlist has been ended
+func (playlist *llhlsPlaylist) isFinished() bool {
+	playlist.Lock()
+	defer playlist.Unlock()
+	return playlist.finished
+}
+
+// files returns names of every file which is referenced by playlist
+func (playlist *llhlsPlaylist) files() []string {
+	playlist.Lock()
+	defer playlist.Unlock()
+	maps := make(map[string]struct{})
+	files := []string{}
+	for _, segment := range append(playlist.segments, playlist.current) {
+		files = append(files, segment.uri)
+		for _, part := range segment.parts {
+			files = append(files, part.uri)
+		}
+		if _, ok := maps[segment.mapURI]; !ok && segment.mapURI != "" {
+			maps[segment.mapURI] = struct{}{}
+			files = append(files, segment.mapURI)
+		}
+	}
+	return files
+}
+
+// usesMap checks if any segment of the playlist refers to the given initialization segment
+func (playlist *llhlsPlaylist) usesMap(uri string) bool {
+	playlist.Lock()
+	defer playlist.Unlock()
+	if playlist.current.mapURI == uri {
+		return true
+	}
+	for _, segment := range playlist.segments {
+		if segment.mapURI == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// targetDuration returns EXT-X-TARGETDURATION value. Lock must be held
+func (playlist *llhlsPlaylist) targetDuration() int {
+	target := playlist.segmentTarget
+	for _, segment := range playlist.segments {
+		if segment.duration > target {
+			target = segment.duration
+		}
+	}
+	return int(math.Ceil(target.Seconds()))
+}
+
+// hasPart checks if playlist contains the given partial segment (or the whole segment if part is negative) or later one. Lock must be held
+func (playlist *llhlsPlaylist) hasPart(msn uint64, part int) bool {
+	if msn < playlist.current.msn {
+		return true
+	}
+	return msn == playlist.current.msn && part >= 0 && part < len(playlist.current.parts)
+}
+
+// wait blocks until playlist contains the given partial segment (or the whole segment if part is negative). Returns false on timeout
+func (playlist *llhlsPlaylist) wait(ctx context.Context, msn uint64, part int) (bool, error) {
+	playlist.Lock()
+	if msn > playlist.current.msn+2 {
+		playlist.Unlock()
+		return false, ErrHLSBlockingRequest
+	}
+	timeout := time.Duration(llhlsPartHoldBack*playlist.targetDuration()) * time.Second
+	if timeout > llhlsMaxBlockingTimeout {
+		timeout = llhlsMaxBlockingTimeout
+	}
+	playlist.Unlock()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		playlist.Lock()
+		if playlist.finished || playlist.hasPart(msn, part) {
+			playlist.Unlock()
+			return true, nil
+		}
+		updated := playlist.updated
+		playlist.Unlock()
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return false, nil
+		case <-deadline.C:
+			return false, nil
+		}
+	}
+}
+
+// encode returns text of the media playlist
+func (playlist *llhlsPlaylist) encode() []byte {
+	playlist.Lock()
+	defer playlist.Unlock()
+	var buf bytes.Buffer
+	targetDuration := playlist.targetDuration()
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&buf, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (llhlsPartHoldBack * playlist.partTarget).Seconds())
+	fmt.Fprintf(&buf, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", playlist.partTarget.Seconds())
+	fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", playlist.current.msn-uint64(len(playlist.segments)))
+	if playlist.discontinuitySeq > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", playlist.discontinuitySeq)
+	}
+	// Parts are listed only for the segments close to the live edge
+	partsFrom := len(playlist.segments)
+	for tail := time.Duration(0); partsFrom > 0; partsFrom-- {
+		tail += playlist.segments[partsFrom-1].duration
+		if tail > time.Duration(llhlsPartsWindow*targetDuration)*time.Second {
+			break
+		}
+	}
+	mapURI := ""
+	writeSegmentHeader := func(segment *llhlsSegment) {
+		if segment.discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if segment.mapURI != mapURI {
+			mapURI = segment.mapURI
+			fmt.Fprintf(&buf, "#EXT-X-MAP:URI=\"%s\"\n", mapURI)
+		}
+		if !segment.programDateTime.IsZero() {
+			fmt.Fprintf(&buf, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.programDateTime.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	writeParts := func(segment *llhlsSegment) {
+		for _, part := range segment.parts {
+			fmt.Fprintf(&buf, "#EXT-X-PART:DURATION=%.5f,URI=\"%s\"", part.duration.Seconds(), part.uri)
+			if part.independent {
+				buf.WriteString(",INDEPENDENT=YES")
+			}
+			buf.WriteString("\n")
+		}
+	}
+	for i, segment := range playlist.segments {
+		writeSegmentHeader(segment)
+		if i >= partsFrom {
+			writeParts(segment)
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%.5f,\n%s\n", segment.duration.Seconds(), segment.uri)
+	}
+	if playlist.finished {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+		return buf.Bytes()
+	}
+	if len(playlist.current.parts) > 0 {
+		writeSegmentHeader(playlist.current)
+		writeParts(playlist.current)
+	}
+	fmt.Fprintf(&buf, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", playlist.partName(playlist.current.msn, len(playlist.current.parts)))
+	return buf.Bytes()
+}
+
+// llhlsRegistry keeps live LL-HLS playlists of the streams
+type llhlsRegistry struct {
+	sync.RWMutex
+	playlists map[uuid.UUID]*llhlsPlaylist
+}
+
+func newLLHLSRegistry() *llhlsRegistry {
+	return &llhlsRegistry{
+		playlists: make(map[uuid.UUID]*llhlsPlaylist),
+	}
+}
+
+func (registry *llhlsRegistry) get(streamID uuid.UUID) *llhlsPlaylist {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.playlists[streamID]
+}
+
+func (registry *llhlsRegistry) set(streamID uuid.UUID, playlist *llhlsPlaylist) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.playlists[streamID] = playlist
+}
+
+// remove deletes playlist of the stream if it has not been replaced yet
+func (registry *llhlsRegistry) remove(streamID uuid.UUID, playlist *llhlsPlaylist) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.playlists[streamID] == playlist {
+		delete(registry.playlists, streamID)
+	}
+}
+
+// startLLHls starts routine to create LL-HLS playlist with fMP4 partial segments. Playlist is continued after reconnects of the source
+func (app *Application) startLLHls(streamID uuid.UUID, ch chan streamPacket, stopCast chan StopSignal) error {
+	err := app.hlsStorage.Prepare()
+	if err != nil {
+		return errors.Wrap(err, "Can't create directory for HLS temporary files")
+	}
+	playlistFileName := fmt.Sprintf("%s.m3u8", streamID)
+	log.Info().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_PREPARE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Msg("Need to start LL-HLS for the given stream")
+
+	playlist := app.llhls.get(streamID)
+	if playlist == nil || playlist.isFinished() {
+		playlist = newLLHLSPlaylist(streamID, time.Duration(app.HLS.MsPerPart)*time.Millisecond, time.Duration(app.HLS.MsPerSegment)*time.Millisecond, app.HLS.WindowSize)
+		app.llhls.set(streamID, playlist)
+	} else {
+		// Source has been reconnected
+		playlist.markDiscontinuity()
+	}
+	writePlaylist := func() {
+		err := app.hlsStorage.WriteFile(playlistFileName, playlist.encode())
+		if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_PLAYLIST_CREATE).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Msg("Can't write playlist")
+		}
+	}
+	removeFiles := func(files []string) {
+		for _, file := range files {
+			if err := app.hlsStorage.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_REMOVE_CHUNK).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Str("chunk_name", file).Msg("Can't remove file")
+			}
+		}
+	}
+
+	var fragmenter *fmp4Fragmenter
+	var segmentCodecs codecsFilter
+	mainIdx := int8(0)
+	hasVideo := false
+	// prepare (re)creates fragmenter for the current codecs of the stream
+	prepare := func() error {
+		codecData, err := app.Streams.GetCodecsDataForStream(streamID)
+		if err != nil {
+			return errors.Wrap(err, streamID.String())
+		}
+		segmentCodecs = newCodecsFilter(codecData, fmp4SupportedCodecs)
+		if len(segmentCodecs.dropped) > 0 && fragmenter == nil {
+			log.Warn().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_CODEC_SKIP).Str("stream_id", streamID.String()).Strs("codecs", segmentCodecs.droppedNames()).Msg("Some codecs are not supported by segment muxer. Skipping them")
+		}
+		mainIdx, hasVideo = 0, false
+		for idx, codec := range segmentCodecs.codecs {
+			if codec.Type().IsVideo() {
+				mainIdx, hasVideo = int8(idx), true
+				break
+			}
+		}
+		segmentFragmenter, err := newFMP4Fragmenter(segmentCodecs.codecs)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't prepare fMP4 fragmenter for stream %s", streamID))
+		}
+		// Keep sequence numbers and initialization segment while codecs are the same
+		if fragmenter != nil && bytes.Equal(fragmenter.InitSegment(), segmentFragmenter.InitSegment()) {
+			return nil
+		}
+		if fragmenter != nil {
+			playlist.markDiscontinuity()
+		}
+		fragmenter = segmentFragmenter
+		playlist.Lock()
+		initName := playlist.initName(playlist.current.msn)
+		playlist.Unlock()
+		err = app.hlsStorage.WriteFile(initName, fragmenter.InitSegment())
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't create fMP4 initialization segment for stream %s", streamID))
+		}
+		playlist.setMap(initName)
+		return nil
+	}
+	if err = prepare(); err != nil {
+		return err
+	}
+
+	partTarget := time.Duration(app.HLS.MsPerPart) * time.Millisecond
+	segmentTarget := time.Duration(app.HLS.MsPerSegment) * time.Millisecond
+	var segmentBuf bytes.Buffer
+	started := false
+	segmentStart, partStart, lastMainTime, frameDuration := time.Duration(0), time.Duration(0), time.Duration(0), time.Duration(0)
+	partHasMain, partIndependent := false, false
+	// Wall clock of the timeline is evaluated from the first part and re-evaluated after the timeline breaks
+	var wallClockBase time.Time
+	var wallClockPTS time.Duration
+
+	// flushPart writes queued packets as the next partial segment which lasts until the given time
+	flushPart := func(end time.Duration) error {
+		data := fragmenter.Fragment()
+		if data == nil {
+			return nil
+		}
+		partName := playlist.nextPart()
+		err := app.hlsStorage.WriteFile(partName, data)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't write partial segment for stream %s", streamID))
+		}
+		segmentBuf.Write(data)
+		// Wall clock drifts from timestamps of the source (e.g. camera clock is not precise), so it is re-evaluated when the difference becomes noticeable
+		now := time.Now()
+		if drift := now.Sub(wallClockBase.Add(end - wallClockPTS)); wallClockBase.IsZero() || drift > hlsWallClockMaxDrift || drift < -hlsWallClockMaxDrift {
+			wallClockBase, wallClockPTS = now, end
+		}
+		playlist.addPart(llhlsPart{uri: partName, duration: end - partStart, independent: partIndependent}, wallClockBase.Add(segmentStart-wallClockPTS))
+		partStart = end
+		partHasMain, partIndependent = false, false
+		writePlaylist()
+		return nil
+	}
+	// cutSegment completes the current segment at the given time. Segment file is the concatenation of its parts
+	cutSegment := func(end time.Duration) error {
+		if err := flushPart(end); err != nil {
+			return err
+		}
+		if segmentBuf.Len() == 0 {
+			return nil
+		}
+		playlist.Lock()
+		segmentName := playlist.current.uri
+		playlist.Unlock()
+		err := app.hlsStorage.WriteFile(segmentName, segmentBuf.Bytes())
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Can't write segment for stream %s", streamID))
+		}
+		segmentBuf.Reset()
+		segmentStart = end
+		removed := playlist.completeSegment()
+		writePlaylist()
+		for _, segment := range removed {
+			files := []string{segment.uri}
+			for _, part := range segment.parts {
+				files = append(files, part.uri)
+			}
+			if !playlist.usesMap(segment.mapURI) {
+				files = append(files, segment.mapURI)
+			}
+			removeFiles(files)
+		}
+		return nil
+	}
+
+	finalize := false
+	discontinuity := false
+packetLoop:
+	for {
+		select {
+		case sig := <-stopCast:
+			// Stream is gone for good: players should not wait for new segments
+			finalize = sig == STOP_SIGNAL_TEARDOWN
+			break packetLoop
+		case pck := <-ch:
+			if !segmentCodecs.remap(&pck.Packet) {
+				continue
+			}
+			isMain := pck.Idx == mainIdx
+			// Every track reports the break, but segments are cut by the main one
+			if pck.discontinuity && isMain {
+				discontinuity = true
+			}
+			isBoundary := isMain && (pck.IsKeyFrame || !hasVideo)
+			if !started {
+				if !isBoundary {
+					continue
+				}
+				started = true
+				discontinuity = false
+				segmentStart, partStart, lastMainTime = pck.Time, pck.Time, pck.Time
+			} else if isMain {
+				if isBoundary && (discontinuity || pck.Time-segmentStart >= segmentTarget) {
+					if err = cutSegment(pck.Time); err != nil {
+						return err
+					}
+					if discontinuity {
+						discontinuity = false
+						playlist.markDiscontinuity()
+						// Timeline after the break is mapped to wall clock from scratch
+						wallClockBase = time.Time{}
+					}
+					// Codecs could have been changed by the source
+					if err = prepare(); err != nil {
+						return err
+					}
+					if !segmentCodecs.remap(&pck.Packet) {
+						continue
+					}
+				} else if pck.Time+frameDuration-partStart > partTarget {
+					if err = flushPart(pck.Time); err != nil {
+						return err
+					}
+				}
+				if dur := pck.Time - lastMainTime; dur > 0 {
+					frameDuration = dur
+				}
+				lastMainTime = pck.Time
+			}
+			if isMain && !partHasMain {
+				partHasMain = true
+				partIndependent = isBoundary
+			}
+			if err = fragmenter.WritePacket(pck.Packet); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Can't write packet for fMP4 fragmenter for stream %s", streamID))
+			}
+		}
+	}
+
+	if started {
+		if err = cutSegment(lastMainTime + frameDuration); err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_WRITE_TRAIL).Str("stream_id", streamID.String()).Str("filename", playlistFileName).Msg("Can't write the last segment")
+		}
+	}
+	if !finalize {
+		// Playlist is continued when the source is back
+		return nil
+	}
+	playlist.finish()
+	writePlaylist()
+	app.llhls.remove(streamID, playlist)
+	filesToRemove := playlist.files()
+	// Deferred removal lets players fetch the tail of playlist
+	go func(delay time.Duration) {
+		time.Sleep(delay)
+		removeFiles(filesToRemove)
+		// Playlist file could have been created again by the new writer
+		if app.llhls.get(streamID) == nil {
+			removeFiles([]string{playlistFileName})
+		}
+	}(time.Duration(app.HLS.MsPerSegment*int64(app.HLS.WindowSize)) * time.Millisecond)
+	return nil
+}
@@ -0,0 +1,42 @@
+package videoserver
+
+import (
+	"strings"
+)
+
+// HLSSegmentFormat is a container of HLS media segments
+type HLSSegmentFormat uint16
+
+const (
+	HLS_SEGMENT_FORMAT_TS = HLSSegmentFormat(iota)
+	HLS_SEGMENT_FORMAT_FMP4
+)
+
+func (iotaIdx HLSSegmentFormat) String() string {
+	return [...]string{"ts", "fmp4"}[iotaIdx]
+}
+
+// MarshalJSON returns name of the segment format
+func (iotaIdx HLSSegmentFormat) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + iotaIdx.String() + `"`), nil
+}
+
+var (
+	supportedHLSSegmentFormats = map[string]HLSSegmentFormat{
+		"ts":   HLS_SEGMENT_FORMAT_TS,
+		"fmp4": HLS_SEGMENT_FORMAT_FMP4,
+	}
+)
+
+func hlsSegmentFormatExists(formatName string) (HLSSegmentFormat, bool) {
+	v, ok := supportedHLSSegmentFormats[strings.ToLower(formatName)]
+	return v, ok
+}
+
+// hlsSegmentFormatFor returns segment format by its name. Empty name means the default format
+func hlsSegmentFormatFor(formatName string, defaultFormat HLSSegmentFormat) (HLSSegmentFormat, bool) {
+	if formatName == "" {
+		return defaultFormat, true
+	}
+	return hlsSegmentFormatExists(formatName)
+}
@@ -0,0 +1,243 @@
+package videoserver
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hlsStorage keeps HLS playlists and segments. File names are flat and start with ID of the stream
+type hlsStorage interface {
+	// Open is used to serve files via HTTP
+	http.FileSystem
+	// Prepare is called before writer of the stream is started
+	Prepare() error
+	WriteFile(name string, data []byte) error
+	Remove(name string) error
+	// Glob returns names of files matching the pattern (see path.Match)
+	Glob(pattern string) ([]string, error)
+}
+
+// newHLSStorage returns in-memory storage if it is enabled and directory-based storage otherwise
+func newHLSStorage(hlsInfo HLSInfo) hlsStorage {
+	if hlsInfo.InMemory {
+		return newHLSMemoryStorage(hlsInfo.MemoryLimit)
+	}
+	return &hlsDiskStorage{directory: hlsInfo.Directory}
+}
+
+// hlsDiskStorage keeps files in the directory
+type hlsDiskStorage struct {
+	directory string
+}
+
+func (storage *hlsDiskStorage) Open(name string) (http.File, error) {
+	return http.Dir(storage.directory).Open(name)
+}
+
+func (storage *hlsDiskStorage) Prepare() error {
+	return ensureDir(storage.directory)
+}
+
+// WriteFile replaces file atomically (via temporary file and rename), so players never get truncated playlist
+func (storage *hlsDiskStorage) WriteFile(name string, data []byte) error {
+	tmpFile, err := os.CreateTemp(storage.directory, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(storage.directory, name))
+}
+
+func (storage *hlsDiskStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(storage.directory, name))
+}
+
+func (storage *hlsDiskStorage) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(storage.directory, pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i := range matches {
+		matches[i] = filepath.Base(matches[i])
+	}
+	return matches, nil
+}
+
+// hlsMemoryFile is a single file of in-memory storage. Data is never changed after the file has been written
+type hlsMemoryFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+// hlsMemoryStream is a ring of files of the single stream
+type hlsMemoryStream struct {
+	files map[string]*hlsMemoryFile
+	// order of writing, the oldest file goes first
+	order []string
+	size  int
+}
+
+// hlsMemoryStorage keeps files in memory. Files of every stream take no more than the given number of bytes: the oldest segments are evicted when the limit is exceeded
+type hlsMemoryStorage struct {
+	sync.RWMutex
+	limit   int
+	streams map[string]*hlsMemoryStream
+}
+
+func newHLSMemoryStorage(limit int64) *hlsMemoryStorage {
+	return &hlsMemoryStorage{
+		limit:   int(limit),
+		streams: make(map[string]*hlsMemoryStream),
+	}
+}
+
+// streamKey extracts ID of the stream from the file name
+func (storage *hlsMemoryStorage) streamKey(name string) string {
+	return uuidRegExp.FindString(name)
+}
+
+func (storage *hlsMemoryStorage) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	storage.RLock()
+	defer storage.RUnlock()
+	if stream, ok := storage.streams[storage.streamKey(name)]; ok {
+		if file, ok := stream.files[name]; ok {
+			return &hlsMemoryReader{Reader: bytes.NewReader(file.data), file: file}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (storage *hlsMemoryStorage) Prepare() error {
+	return nil
+}
+
+func (storage *hlsMemoryStorage) WriteFile(name string, data []byte) error {
+	key := storage.streamKey(name)
+	storage.Lock()
+	defer storage.Unlock()
+	stream, ok := storage.streams[key]
+	if !ok {
+		stream = &hlsMemoryStream{files: make(map[string]*hlsMemoryFile)}
+		storage.streams[key] = stream
+	}
+	if old, ok := stream.files[name]; ok {
+		stream.size -= len(old.data)
+		stream.order = slices.DeleteFunc(stream.order, func(s string) bool { return s == name })
+	}
+	// Caller could reuse the buffer
+	stream.files[name] = &hlsMemoryFile{name: name, data: bytes.Clone(data), modTime: time.Now()}
+	stream.order = append(stream.order, name)
+	stream.size += len(data)
+	for i := 0; stream.size > storage.limit && i < len(stream.order); {
+		evicted := stream.order[i]
+		// Playlists, DASH manifests and initialization segments are small, but players can't do anything without them
+		if evicted == name || path.Ext(evicted) == ".m3u8" || path.Ext(evicted) == ".mpd" || strings.Contains(evicted, "_init") {
+			i++
+			continue
+		}
+		stream.size -= len(stream.files[evicted].data)
+		delete(stream.files, evicted)
+		stream.order = slices.Delete(stream.order, i, i+1)
+		log.Warn().Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_EVICT_SEGMENT).Str("stream_id", key).Str("segment", evicted).Int("limit", storage.limit).Msg("Memory limit of the stream has been exceeded. Segment has been evicted")
+	}
+	return nil
+}
+
+func (storage *hlsMemoryStorage) Remove(name string) error {
+	key := storage.streamKey(name)
+	storage.Lock()
+	defer storage.Unlock()
+	stream, ok := storage.streams[key]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	file, ok := stream.files[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	stream.size -= len(file.data)
+	delete(stream.files, name)
+	stream.order = slices.DeleteFunc(stream.order, func(s string) bool { return s == name })
+	if len(stream.files) == 0 {
+		delete(storage.streams, key)
+	}
+	return nil
+}
+
+func (storage *hlsMemoryStorage) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	storage.RLock()
+	defer storage.RUnlock()
+	matches := []string{}
+	for _, stream := range storage.streams {
+		for _, name := range stream.order {
+			if ok, _ := path.Match(pattern, name); ok {
+				matches = append(matches, name)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// hlsMemoryReader implements http.File for the file of in-memory storage
+type hlsMemoryReader struct {
+	*bytes.Reader
+	file *hlsMemoryFile
+}
+
+func (reader *hlsMemoryReader) Close() error {
+	return nil
+}
+
+func (reader *hlsMemoryReader) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, fs.ErrInvalid
+}
+
+func (reader *hlsMemoryReader) Stat() (fs.FileInfo, error) {
+	return reader, nil
+}
+
+func (reader *hlsMemoryReader) Name() string {
+	return reader.file.name
+}
+
+func (reader *hlsMemoryReader) Mode() fs.FileMode {
+	return 0444
+}
+
+func (reader *hlsMemoryReader) ModTime() time.Time {
+	return reader.file.modTime
+}
+
+func (reader *hlsMemoryReader) IsDir() bool {
+	return false
+}
+
+func (reader *hlsMemoryReader) Sys() any {
+	return nil
+}
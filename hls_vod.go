@@ -0,0 +1,137 @@
+package videoserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LdDl/video-server/storage"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/grafov/m3u8"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Segments of the archive which are further from each other are separated by EXT-X-DISCONTINUITY
+	hlsVODMaxGap = time.Second
+	// hlsVODInitSuffix is appended to the base name of the archive segment to get name of fMP4 initialization segment
+	hlsVODInitSuffix = "_init.mp4"
+)
+
+// hlsVODUseFMP4 checks if segments should be remuxed into fMP4. HEVC can't be carried by MPEG-TS segments for the most of players
+func hlsVODUseFMP4(segmentFormat HLSSegmentFormat, segments []ArchiveSegment) bool {
+	if segmentFormat == HLS_SEGMENT_FORMAT_FMP4 {
+		return true
+	}
+	for _, segment := range segments {
+		if slices.Contains(segment.Codecs, av.H265.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// hlsVODPlaylist builds VOD playlist over the archive segments. Every media segment carries its offset on the playlist timeline ('t' in milliseconds), so timestamps of remuxed segments are continuous
+func hlsVODPlaylist(segments []ArchiveSegment, useFMP4 bool) ([]byte, error) {
+	playlist, err := m3u8.NewMediaPlaylist(0, uint(len(segments)))
+	if err != nil {
+		return nil, err
+	}
+	playlist.MediaType = m3u8.VOD
+	segmentExt := hlsTSExtension
+	if useFMP4 {
+		segmentExt = hlsFMP4Extension
+		playlist.SetVersion(7)
+	}
+	offset := int64(0)
+	for i, segment := range segments {
+		base := strings.TrimSuffix(segment.Name, path.Ext(segment.Name))
+		if err = playlist.Append(fmt.Sprintf("%s%s?t=%d", base, segmentExt, offset), float64(segment.DurationMs)/1000, ""); err != nil {
+			return nil, err
+		}
+		playlist.SetProgramDateTime(segment.Start.UTC())
+		// Recording has been interrupted or codecs have been changed
+		restart := i == 0
+		if i > 0 {
+			prev := segments[i-1]
+			if segment.Start.Sub(prev.End) > hlsVODMaxGap || !slices.Equal(segment.Codecs, prev.Codecs) {
+				playlist.SetDiscontinuity()
+				restart = true
+			}
+		}
+		if useFMP4 && restart {
+			playlist.SetMap(base+hlsVODInitSuffix, 0, 0)
+		}
+		offset += segment.DurationMs
+	}
+	playlist.Close()
+	return playlist.Encode().Bytes(), nil
+}
+
+// hlsVODSegment remuxes archive segment into HLS media segment. Packet times are shifted by the given offset.
+// If 'init' is true then fMP4 initialization segment is returned instead
+func hlsVODSegment(store storage.ArchiveStorage, segment ArchiveSegment, useFMP4, init bool, offset time.Duration) ([]byte, error) {
+	file, err := store.OpenFile(context.Background(), storage.ArchiveUnit{Bucket: segment.Bucket, SegmentName: segment.Name})
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't open segment")
+	}
+	defer file.Close()
+	demuxer := mp4.NewDemuxer(file)
+	codecData, err := demuxer.Streams()
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read segment header")
+	}
+	supportedCodecs := tsSupportedCodecs
+	if useFMP4 {
+		supportedCodecs = fmp4SupportedCodecs
+	}
+	segmentCodecs := newCodecsFilter(codecData, supportedCodecs)
+	if len(segmentCodecs.codecs) == 0 {
+		return nil, ErrHLSVODNoCodecs
+	}
+	var segmentBuf bytes.Buffer
+	var segmentMuxer hlsSegmentMuxer
+	if useFMP4 {
+		fragmenter, err := newFMP4Fragmenter(segmentCodecs.codecs)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can't prepare fMP4 fragmenter")
+		}
+		if init {
+			return fragmenter.InitSegment(), nil
+		}
+		segmentMuxer = &fmp4SegmentMuxer{w: &segmentBuf, fragmenter: fragmenter}
+	} else {
+		tsMuxer := ts.NewMuxer(&segmentBuf)
+		if err = tsMuxer.WriteHeader(segmentCodecs.codecs); err != nil {
+			return nil, errors.Wrap(err, "Can't write header for TS muxer")
+		}
+		segmentMuxer = tsMuxer
+	}
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Can't read packet")
+		}
+		if !segmentCodecs.remap(&pkt) {
+			continue
+		}
+		pkt.Time += offset
+		if err = segmentMuxer.WritePacket(pkt); err != nil {
+			return nil, errors.Wrap(err, "Can't write packet for segment muxer")
+		}
+	}
+	if err = segmentMuxer.WriteTrailer(); err != nil {
+		return nil, errors.Wrap(err, "Can't write trailer for segment muxer")
+	}
+	return segmentBuf.Bytes(), nil
+}
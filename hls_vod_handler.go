@@ -0,0 +1,127 @@
+package videoserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// HLSVODWrapper returns handler of VOD playlists over the MP4 archive and of their segments.
+// Playlist is '/vod/{stream_id}/index.m3u8?from=&to=' (bounds are optional, the same as for the archive index). Segments are remuxed on request
+func HLSVODWrapper(streamsStorage *StreamsStorage, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call VOD file")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		archive := streamsStorage.GetStreamArchiveStorage(streamID)
+		if archive == nil || archive.index == nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "No archive for the stream"})
+			return
+		}
+		fileName := ctx.Param("file")
+		ext := path.Ext(fileName)
+		if ext == ".m3u8" {
+			bounds := [2]time.Time{}
+			for i, param := range []string{"from", "to"} {
+				bounds[i], err = parseArchiveTime(ctx.Query(param))
+				if err != nil {
+					errReason := fmt.Sprintf("Not valid '%s' time: '%s'", param, ctx.Query(param))
+					if verboseLevel > VERBOSE_NONE {
+						log.Error().Err(err).Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+					}
+					ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+					return
+				}
+			}
+			streamFormat, err := streamsStorage.GetHLSSegmentFormatForStream(streamID)
+			if err != nil {
+				ctx.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+				return
+			}
+			segmentFormat, ok := hlsSegmentFormatFor(ctx.Query("format"), streamFormat)
+			if !ok {
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("%s. Format: '%s'", ErrHLSSegmentFormatNotExists, ctx.Query("format"))})
+				return
+			}
+			segments := archive.index.Find(bounds[0], bounds[1])
+			if len(segments) == 0 {
+				ctx.JSON(http.StatusNotFound, gin.H{"Error": ErrArchiveExportEmpty.Error()})
+				return
+			}
+			data, err := hlsVODPlaylist(segments, hlsVODUseFMP4(segmentFormat, segments))
+			if err != nil {
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_PLAYLIST).Str("stream_id", streamIDSTR).Msg("Can't create VOD playlist")
+				}
+				ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+				return
+			}
+			ctx.Header("Cache-Control", "no-cache")
+			ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+			return
+		}
+
+		// Segments are named after the archive segments they are remuxed from
+		init := strings.HasSuffix(fileName, hlsVODInitSuffix)
+		var base string
+		switch {
+		case init:
+			base = strings.TrimSuffix(fileName, hlsVODInitSuffix)
+		case ext == hlsTSExtension, ext == hlsFMP4Extension:
+			base = strings.TrimSuffix(fileName, ext)
+		default:
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "Unknown file"})
+			return
+		}
+		segment, ok := archive.index.Get(base + ".mp4")
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "No such segment in the archive"})
+			return
+		}
+		offset := int64(0)
+		if t := ctx.Query("t"); t != "" {
+			offset, err = strconv.ParseInt(t, 10, 64)
+			if err != nil || offset < 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Not valid offset: '%s'", t)})
+				return
+			}
+		}
+		useFMP4 := init || ext == hlsFMP4Extension
+		st := time.Now()
+		data, err := hlsVODSegment(archive.store, segment, useFMP4, init, time.Duration(offset)*time.Millisecond)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_SEGMENT).Str("stream_id", streamIDSTR).Str("segment_name", segment.Name).Msg("Can't remux archive segment")
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+			return
+		}
+		if verboseLevel > VERBOSE_ADD {
+			log.Info().Str("scope", SCOPE_HLS_VOD).Str("event", EVENT_HLS_VOD_SEGMENT).Str("stream_id", streamIDSTR).Str("segment_name", segment.Name).Str("file", fileName).Int("size", len(data)).Dur("elapsed", time.Since(st)).Msg("Archive segment has been remuxed")
+		}
+		contentType := "video/mp4"
+		if ext == hlsTSExtension {
+			contentType = "video/mp2t"
+		}
+		ctx.Header("Content-Type", contentType)
+		http.ServeContent(ctx.Writer, ctx.Request, fileName, segment.End, bytes.NewReader(data))
+	}
+}
@@ -1,8 +1,10 @@
 package videoserver
 
 import (
+	"expvar"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -19,6 +21,8 @@ func (app *Application) StartAPIServer() error {
 	router := gin.New()
 
 	pprof.Register(router)
+	// Metrics (e.g. archive retention counters)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 
 	if app.CorsConfig != nil {
 		log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_CORS_ENABLE).
@@ -41,8 +45,15 @@ func (app *Application) StartAPIServer() error {
 	}
 	router.GET("/list", ListWrapper(app, app.APICfg.Verbose))
 	router.GET("/status", StatusWrapper(app, app.APICfg.Verbose))
+	router.GET("/streams/:stream_id", StreamLifecycleWrapper(app, app.APICfg.Verbose))
+	router.PUT("/streams/:stream_id", UpdateStreamWrapper(app, app.APICfg.Verbose))
 	router.POST("/enable_camera", EnableCamera(app, app.APICfg.Verbose))
 	router.POST("/disable_camera", DisableCamera(app, app.APICfg.Verbose))
+	router.GET("/archive/:stream_id", ArchiveWrapper(app, app.APICfg.Verbose))
+	router.GET("/archive/:stream_id/export", ArchiveExportWrapper(app, app.APICfg.Verbose))
+	router.POST("/archive/:stream_id/export", ArchiveExportJobWrapper(app, app.APICfg.Verbose))
+	router.GET("/exports/:job_id", ExportJobWrapper(app, app.APICfg.Verbose))
+	router.GET("/exports/:job_id/file", ExportFileWrapper(app, app.APICfg.Verbose))
 
 	url := fmt.Sprintf("%s:%d", app.APICfg.Host, app.APICfg.Port)
 	s := &http.Server{
@@ -101,11 +112,108 @@ func StatusWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Co
 	}
 }
 
+// StreamLifecycleWrapper returns state of the single stream with history of transitions and last errors
+func StreamLifecycleWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call stream's state")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		lifecycle, err := app.Streams.GetLifecycleForStream(streamID)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Can't get stream's state")
+			}
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+			return
+		}
+		ctx.JSON(200, lifecycle)
+	}
+}
+
+// ArchiveSegmentsList is a list of archive segments of the single stream
+type ArchiveSegmentsList struct {
+	StreamID string           `json:"stream_id"`
+	Data     []ArchiveSegment `json:"data"`
+}
+
+// ArchiveWrapper returns archive segments of the stream which overlap the time range. Bounds are optional: RFC3339 or UNIX timestamp in seconds
+func ArchiveWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Call stream's archive")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		bounds := [2]time.Time{}
+		for i, param := range []string{"from", "to"} {
+			bounds[i], err = parseArchiveTime(ctx.Query(param))
+			if err != nil {
+				errReason := fmt.Sprintf("Not valid '%s' time: '%s'", param, ctx.Query(param))
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+				}
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+				return
+			}
+		}
+		archive := app.Streams.GetStreamArchiveStorage(streamID)
+		if archive == nil || archive.index == nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "No archive for the stream"})
+			return
+		}
+		ctx.JSON(200, ArchiveSegmentsList{
+			StreamID: streamID.String(),
+			Data:     archive.index.Find(bounds[0], bounds[1]),
+		})
+	}
+}
+
+// parseArchiveTime parses RFC3339 time or UNIX timestamp in seconds. Empty string gives zero time
+func parseArchiveTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
 // EnablePostData is a POST-body for API which enables to turn on/off specific streams
 type EnablePostData struct {
 	GUID        uuid.UUID `json:"guid"`
 	URL         string    `json:"url"`
+	URLs        []string  `json:"urls"`
+	Type        string    `json:"type"`
 	OutputTypes []string  `json:"output_types"`
+	Audio       bool      `json:"audio"`
+	OnDemand    bool      `json:"on_demand"`
+	IdleTimeout int64     `json:"idle_timeout_ms"`
+	HLS         struct {
+		SegmentFormat string `json:"segment_format"`
+	} `json:"hls"`
+	Publish struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	} `json:"publish"`
 }
 
 // EnableCamera adds new stream if does not exist
@@ -145,8 +253,48 @@ func EnableCamera(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Con
 				}
 				outputTypes = append(outputTypes, typ)
 			}
+			urls := sourceURLs(postData.URL, postData.URLs)
+			sourceType, ok := sourceTypeFor(postData.Type, urls[0])
+			if !ok {
+				errReason := fmt.Sprintf("%s. Type: '%s'", ErrSourceTypeNotExists, postData.Type)
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(fmt.Errorf(errReason)).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+				}
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+				return
+			}
+			// Only pushed streams have nothing to dial
+			if urls[0] == "" && sourceType != SOURCE_TYPE_RTSP_PUSH {
+				errReason := ErrSourceURLEmpty.Error()
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(ErrSourceURLEmpty).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+				}
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+				return
+			}
+			hlsSegmentFormat, ok := hlsSegmentFormatFor(postData.HLS.SegmentFormat, app.HLS.SegmentFormat)
+			if !ok {
+				errReason := fmt.Sprintf("%s. Format: '%s'", ErrHLSSegmentFormatNotExists, postData.HLS.SegmentFormat)
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(fmt.Errorf(errReason)).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+				}
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+				return
+			}
 			app.Streams.Lock()
-			app.Streams.store[postData.GUID] = NewStreamConfiguration(postData.URL, outputTypes)
+			app.Streams.store[postData.GUID] = NewStreamConfiguration(urls[0], outputTypes)
+			app.Streams.store[postData.GUID].URLs = urls
+			app.Streams.store[postData.GUID].SourceType = sourceType
+			app.Streams.store[postData.GUID].publishUser = postData.Publish.User
+			app.Streams.store[postData.GUID].publishPassword = postData.Publish.Password
+			app.Streams.store[postData.GUID].reconnectPolicy = app.reconnectPolicy
+			app.Streams.store[postData.GUID].audioEnabled = postData.Audio
+			app.Streams.store[postData.GUID].HLSSegmentFormat = hlsSegmentFormat
+			app.Streams.store[postData.GUID].OnDemand = postData.OnDemand
+			app.Streams.store[postData.GUID].idleTimeout = defaultOnDemandIdleTimeout
+			if postData.IdleTimeout > 0 {
+				app.Streams.store[postData.GUID].idleTimeout = time.Duration(postData.IdleTimeout) * time.Millisecond
+			}
 			app.Streams.Unlock()
 			app.StartStream(postData.GUID)
 		}
@@ -154,6 +302,99 @@ func EnableCamera(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Con
 	}
 }
 
+// UpdateStreamWrapper applies new configuration to the existing stream. Body is the same as for enabling camera (GUID is taken from path)
+func UpdateStreamWrapper(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Try to update stream")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		var postData EnablePostData
+		if err := ctx.ShouldBindJSON(&postData); err != nil {
+			errReason := "Bad JSON binding"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		update, err := postData.streamUpdate(app.HLS.SegmentFormat)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Bad stream configuration")
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		result, err := app.UpdateStream(streamID, update)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Can't update stream")
+			}
+			status := http.StatusInternalServerError
+			switch errors.Cause(err) {
+			case ErrStreamNotFound:
+				status = http.StatusNotFound
+			case ErrOnDemandWithArchive:
+				status = http.StatusBadRequest
+			}
+			ctx.JSON(status, gin.H{"Error": err.Error()})
+			return
+		}
+		ctx.JSON(200, result)
+	}
+}
+
+// streamUpdate validates POST-body and converts it into the stream update. Empty HLS segment format is replaced with the default one
+func (postData EnablePostData) streamUpdate(defaultHLSSegmentFormat HLSSegmentFormat) (StreamUpdate, error) {
+	update := StreamUpdate{
+		URLs:            sourceURLs(postData.URL, postData.URLs),
+		OutputTypes:     make([]StreamType, 0, len(postData.OutputTypes)),
+		Audio:           postData.Audio,
+		OnDemand:        postData.OnDemand,
+		IdleTimeout:     defaultOnDemandIdleTimeout,
+		PublishUser:     postData.Publish.User,
+		PublishPassword: postData.Publish.Password,
+	}
+	for _, v := range postData.OutputTypes {
+		typ, ok := streamTypeExists(v)
+		if !ok {
+			return update, errors.Wrapf(ErrStreamTypeNotExists, "Type: '%s'", v)
+		}
+		if _, ok := supportedOutputStreamTypes[typ]; !ok {
+			return update, errors.Wrapf(ErrStreamTypeNotSupported, "Type: '%s'", v)
+		}
+		update.OutputTypes = append(update.OutputTypes, typ)
+	}
+	sourceType, ok := sourceTypeFor(postData.Type, update.URLs[0])
+	if !ok {
+		return update, errors.Wrapf(ErrSourceTypeNotExists, "Type: '%s'", postData.Type)
+	}
+	update.SourceType = sourceType
+	// Body replaces the whole configuration, so missing URL is not treated as "keep current". Only pushed streams have nothing to dial
+	if update.URLs[0] == "" && sourceType != SOURCE_TYPE_RTSP_PUSH {
+		return update, ErrSourceURLEmpty
+	}
+	hlsSegmentFormat, ok := hlsSegmentFormatFor(postData.HLS.SegmentFormat, defaultHLSSegmentFormat)
+	if !ok {
+		return update, errors.Wrapf(ErrHLSSegmentFormatNotExists, "Format: '%s'", postData.HLS.SegmentFormat)
+	}
+	update.HLSSegmentFormat = hlsSegmentFormat
+	if postData.IdleTimeout > 0 {
+		update.IdleTimeout = time.Duration(postData.IdleTimeout) * time.Millisecond
+	}
+	return update, nil
+}
+
 // DisableCamera turns off stream for specific stream ID
 func DisableCamera(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
@@ -170,9 +411,15 @@ func DisableCamera(app *Application, verboseLevel VerboseLevel) func(ctx *gin.Co
 			return
 		}
 		if exist := app.Streams.StreamExists(postData.GUID); exist {
-			app.Streams.Lock()
-			delete(app.Streams.store, postData.GUID)
-			app.Streams.Unlock()
+			err := app.DeleteStream(postData.GUID, "Stream has been disabled")
+			if err != nil {
+				errReason := "Can't disable stream"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_API_SERVER).Str("event", EVENT_API_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+				}
+				ctx.JSON(http.StatusInternalServerError, gin.H{"Error": errReason})
+				return
+			}
 		}
 		ctx.JSON(200, app)
 	}
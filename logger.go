@@ -11,13 +11,20 @@ const (
 	SCOPE_ARCHIVE       = "archive"
 	SCOPE_MP4           = "mp4"
 	SCOPE_HLS           = "hls"
+	SCOPE_RTSP_SERVER   = "rtsp_server"
+	SCOPE_WHEP          = "whep"
+	SCOPE_DASH          = "dash"
+	SCOPE_FLV           = "flv"
+	SCOPE_HLS_VOD       = "hls_vod"
 
 	EVENT_APP_CORS_CONFIG = "app_cors_config"
 
 	EVENT_STREAM_CODEC_ADD     = "stream_codec_add"
 	EVENT_STREAM_STATUS_UPDATE = "stream_status_update"
+	EVENT_STREAM_STATE_UPDATE  = "stream_state_update"
 	EVENT_STREAM_CLIENT_ADD    = "stream_client_add"
 	EVENT_STREAM_CLIENT_DELETE = "stream_client_delete"
+	EVENT_STREAM_CLIENT_KICK   = "stream_client_kick"
 	EVENT_STREAM_CAST_PACKET   = "stream_cast"
 
 	EVENT_STREAMING_RUN                 = "streaming_run"
@@ -35,6 +42,15 @@ const (
 	EVENT_STREAMING_AUDIO_MET           = "streaming_audio_met"
 	EVENT_STREAMING_HLS_CAST            = "streaming_hls_cast"
 	EVENT_STREAMING_MP4_CAST            = "streaming_mp4_cast"
+	EVENT_STREAMING_DASH_CAST           = "streaming_dash_cast"
+	EVENT_STREAMING_FAILOVER            = "streaming_failover"
+	EVENT_STREAMING_FAILBACK            = "streaming_failback"
+	EVENT_STREAMING_PROBE               = "streaming_probe"
+	EVENT_STREAMING_DEMAND              = "streaming_demand"
+	EVENT_STREAMING_IDLE                = "streaming_idle"
+	EVENT_STREAMING_STOP                = "streaming_stop"
+	EVENT_STREAMING_UPDATE              = "streaming_update"
+	EVENT_STREAMING_DISCONTINUITY       = "streaming_discontinuity"
 
 	EVENT_API_PREPARE     = "api_server_prepare"
 	EVENT_API_START       = "api_server_start"
@@ -47,6 +63,33 @@ const (
 	EVENT_WS_REQUEST     = "ws_request"
 	EVENT_WS_UPGRADER    = "ws_upgrader"
 	EVENT_WS_PING        = "ws_ping"
+	EVENT_WS_CODEC_SKIP  = "ws_codec_skip"
+	EVENT_WS_REINIT      = "ws_reinit"
+
+	EVENT_RTSP_PREPARE      = "rtsp_server_prepare"
+	EVENT_RTSP_START        = "rtsp_server_start"
+	EVENT_RTSP_PUBLISH      = "rtsp_server_publish"
+	EVENT_RTSP_PLAY         = "rtsp_server_play"
+	EVENT_RTSP_CLIENT_ERROR = "rtsp_server_client_error"
+
+	EVENT_WHEP_REQUEST    = "whep_request"
+	EVENT_WHEP_SESSION    = "whep_session"
+	EVENT_WHEP_CODEC_SKIP = "whep_codec_skip"
+
+	EVENT_FLV_REQUEST    = "flv_request"
+	EVENT_FLV_STREAM     = "flv_stream"
+	EVENT_FLV_CODEC_SKIP = "flv_codec_skip"
+
+	EVENT_HLS_VOD_REQUEST  = "hls_vod_request"
+	EVENT_HLS_VOD_PLAYLIST = "hls_vod_playlist"
+	EVENT_HLS_VOD_SEGMENT  = "hls_vod_segment"
+
+	EVENT_DASH_START_CAST       = "dash_start_cast"
+	EVENT_DASH_MANIFEST_PREPARE = "dash_manifest_prepare"
+	EVENT_DASH_MANIFEST_CREATE  = "dash_manifest_create"
+	EVENT_DASH_WRITE_TRAIL      = "dash_write_trail"
+	EVENT_DASH_REMOVE_CHUNK     = "dash_remove_chunk"
+	EVENT_DASH_CODEC_SKIP       = "dash_codec_skip"
 
 	EVENT_HLS_START_CAST              = "hls_start_cast"
 	EVENT_HLS_PLAYLIST_PREPARE        = "hls_playlist_prepare"
@@ -57,10 +100,15 @@ const (
 	EVENT_HLS_REMOVE_OUTDATED         = "hls_remove_outdated"
 	EVENT_HLS_REMOVE_OUTDATED_SEGMENT = "hls_remove_outdated_segment"
 	EVENT_HLS_REMOVE_CHUNK            = "hls_remove_chunk"
+	EVENT_HLS_CODEC_SKIP              = "hls_codec_skip"
+	EVENT_HLS_EVICT_SEGMENT           = "hls_evict_segment"
 
 	EVENT_ARCHIVE_START_CAST  = "archive_start_cast"
 	EVENT_ARCHIVE_CREATE_FILE = "archive_create_file"
 	EVENT_ARCHIVE_CLOSE_FILE  = "archive_close_file"
+	EVENT_ARCHIVE_INDEX       = "archive_index"
+	EVENT_ARCHIVE_EXPORT      = "archive_export"
+	EVENT_ARCHIVE_RETENTION   = "archive_retention"
 	EVENT_CHAN_PACKET         = "mp4_chan_pck"
 	EVENT_CHAN_STOP           = "mp4_chan_stop"
 	EVENT_CHAN_KEYFRAME       = "mp4_chan_keyframe"
@@ -70,4 +118,5 @@ const (
 	EVENT_MP4_WRITE_TRAIL     = "mp4_write_trail"
 	EVENT_MP4_SAVE_MINIO      = "mp4_save_minio"
 	EVENT_MP4_CLOSE           = "mp4_close"
+	EVENT_MP4_CODEC_SKIP      = "mp4_codec_skip"
 )
@@ -15,15 +15,7 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	maxFailureDuration = 3 * time.Second
-)
-
-var (
-	ErrTimeFailure = fmt.Errorf("bad packet times")
-)
-
-func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UUID, ch chan av.Packet, stopCast chan StopSignal, streamVerboseLevel VerboseLevel) error {
+func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UUID, ch chan streamPacket, stopCast chan StopSignal, streamVerboseLevel VerboseLevel) error {
 	if archive == nil {
 		return ErrNullArchive
 	}
@@ -41,6 +33,7 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 	lastSegmentTime := time.Now()
 	lastPacketTime := time.Duration(0)
 	lastKeyFrame := av.Packet{}
+	codecsSkipReported := false
 
 	// time.Sleep(5 * time.Second) // Artificial delay to wait for first key frame
 	for isConnected {
@@ -74,14 +67,19 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 		}
 		log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_CREATE_FILE).Str("stream_id", streamID.String()).Str("segment_path", segmentPath).Msg("Write header")
 
-		err = tsMuxer.WriteHeader(codecData)
+		mp4Codecs := newCodecsFilter(codecData, mp4SupportedCodecs)
+		if len(mp4Codecs.dropped) > 0 && !codecsSkipReported {
+			codecsSkipReported = true
+			log.Warn().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_MP4_CODEC_SKIP).Str("stream_id", streamID.String()).Str("segment_path", segmentPath).Strs("codecs", mp4Codecs.droppedNames()).Msg("Some codecs are not supported by MP4 muxer. Skipping them")
+		}
+		err = tsMuxer.WriteHeader(mp4Codecs.codecs)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("Can't write header for mp4 muxer for stream %s", streamID))
 		}
 
 		// Write packets
 		videoStreamIdx := int8(0)
-		for idx, codec := range codecData {
+		for idx, codec := range mp4Codecs.codecs {
 			if codec.Type().IsVideo() {
 				videoStreamIdx = int8(idx)
 				break
@@ -91,7 +89,7 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 		packetLength := time.Duration(0)
 		segmentCount := 0
 		start := false
-		failureDuration := time.Duration(0)
+		span := mp4SegmentSpan{}
 
 		// Write lastKeyFrame if exist
 		if lastKeyFrame.IsKeyFrame {
@@ -99,6 +97,7 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 			if err = tsMuxer.WritePacket(lastKeyFrame); err != nil {
 				return errors.Wrap(err, fmt.Sprintf("Can't write packet for TS muxer for stream %s (1)", streamID))
 			}
+			span.add(lastKeyFrame.Time)
 			// Evaluate segment's length
 			packetLength = lastKeyFrame.Time - lastPacketTime
 			lastPacketTime = lastKeyFrame.Time
@@ -108,9 +107,9 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 		log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_CREATE_FILE).Str("stream_id", streamID.String()).Str("segment_path", segmentPath).Msg("Start segment loop")
 
 		var errProccessing error
-		lastKeyFrame, lastPacketTime, isConnected, failureDuration, errProccessing = processingMP4(streamID, segmentName, isConnected, start, videoStreamIdx, segmentCount, segmentLength, lastKeyFrame, lastPacketTime, packetLength, archive.msPerSegment, tsMuxer, ch, stopCast, failureDuration, streamVerboseLevel)
+		lastKeyFrame, lastPacketTime, isConnected, errProccessing = processingMP4(streamID, segmentName, isConnected, start, mp4Codecs, videoStreamIdx, segmentCount, segmentLength, lastKeyFrame, lastPacketTime, packetLength, archive.msPerSegment, tsMuxer, &span, ch, stopCast, streamVerboseLevel)
 		if errProccessing != nil {
-			log.Error().Err(errProccessing).Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("out_filename", outFile.Name()).Dur("failure_dur", failureDuration).Msg("Can't process mp4 channel")
+			log.Error().Err(errProccessing).Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("out_filename", outFile.Name()).Msg("Can't process mp4 channel")
 		}
 
 		if err := tsMuxer.WriteTrailer(); err != nil {
@@ -125,11 +124,27 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 			// @todo: handle?
 		}
 
+		indexSegment := func(location storage.ArchiveUnit, size int64) {
+			if archive.index == nil || !span.started {
+				return
+			}
+			segment := span.segment(segmentName, size, archive.store.Type(), mp4Codecs)
+			segment.Bucket = location.Bucket
+			segment.Object = archive.store.ObjectName(location)
+			if err := archive.index.Add(segment); err != nil {
+				log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_INDEX).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Msg("Can't add segment to archive index")
+			}
+		}
+		segmentSize := int64(0)
+		if info, err := os.Stat(segmentPath); err == nil {
+			segmentSize = info.Size()
+		}
+
 		if archive.store.Type() == storage.STORAGE_MINIO {
 			if streamVerboseLevel > VERBOSE_ADD {
 				log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Msg("Drop segment to minio")
 			}
-			go func() {
+			upload := func() {
 				st := time.Now()
 				outSegmentName, err := UploadToMinio(archive.store, segmentName, archive.bucket, segmentPath)
 				if streamVerboseLevel > VERBOSE_ADD {
@@ -145,14 +160,22 @@ func (app *Application) startMP4(archive *StreamArchiveWrapper, streamID uuid.UU
 				if streamVerboseLevel > VERBOSE_ADD {
 					log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_SAVE_MINIO).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("elapsed", elapsed).Msg("Saved to MinIO")
 				}
-			}()
+				if err == nil {
+					indexSegment(storage.ArchiveUnit{Bucket: archive.bucket, SegmentName: segmentName}, segmentSize)
+				}
+			}
+			if isConnected {
+				go upload()
+			} else {
+				// The last segment must be uploaded before the stream is considered stopped
+				upload()
+			}
+		} else {
+			indexSegment(storage.ArchiveUnit{Bucket: archive.filesystemDir, SegmentName: segmentName}, segmentSize)
 		}
 
 		lastSegmentTime = lastSegmentTime.Add(time.Since(st))
 		log.Info().Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_CLOSE_FILE).Str("stream_id", streamID.String()).Str("segment_path", segmentPath).Int64("ms", archive.msPerSegment).Msg("Closed segment")
-		if failureDuration > maxFailureDuration && errProccessing != nil {
-			return errors.Wrap(errProccessing, "Max duration failure exceed")
-		}
 	}
 	return nil
 }
@@ -162,6 +185,7 @@ func processingMP4(
 	segmentName string,
 	isConnected,
 	start bool,
+	mp4Codecs codecsFilter,
 	videoStreamIdx int8,
 	segmentCount int,
 	segmentLength time.Duration,
@@ -170,11 +194,13 @@ func processingMP4(
 	packetLength time.Duration,
 	msPerSegment int64,
 	tsMuxer *mp4.Muxer,
-	ch chan av.Packet,
+	span *mp4SegmentSpan,
+	ch chan streamPacket,
 	stopCast chan StopSignal,
-	failureDuration time.Duration,
 	streamVerboseLevel VerboseLevel,
-) (av.Packet, time.Duration, bool, time.Duration, error) {
+) (av.Packet, time.Duration, bool, error) {
+	// Timeline has been broken, so segment should be cut on the next keyframe
+	discontinuity := false
 	for {
 		select {
 		case sig := <-stopCast:
@@ -182,8 +208,14 @@ func processingMP4(
 			if streamVerboseLevel > VERBOSE_NONE {
 				log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_CHAN_STOP).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Any("stop_signal", sig).Dur("prev_pck_time", lastPacketTime).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Stop cast signal")
 			}
-			return lastKeyFrame, lastPacketTime, isConnected, failureDuration, nil
+			return lastKeyFrame, lastPacketTime, isConnected, nil
 		case pck := <-ch:
+			if !mp4Codecs.remap(&pck.Packet) {
+				continue
+			}
+			if pck.discontinuity {
+				discontinuity = true
+			}
 			if streamVerboseLevel > VERBOSE_ADD {
 				log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_CHAN_PACKET).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Recieved something in archive channel")
 			}
@@ -192,12 +224,20 @@ func processingMP4(
 					log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_CHAN_KEYFRAME).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Packet is a keyframe")
 				}
 				start = true
+				if discontinuity && segmentCount > 0 {
+					if streamVerboseLevel > VERBOSE_NONE {
+						log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_SEGMENT_CUT).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Timeline has been broken. Need to cut segment")
+					}
+					lastKeyFrame = pck.Packet
+					return lastKeyFrame, lastPacketTime, isConnected, nil
+				}
+				discontinuity = false
 				if segmentLength.Milliseconds() >= msPerSegment {
 					if streamVerboseLevel > VERBOSE_NONE {
 						log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_SEGMENT_CUT).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Need to cut segment")
 					}
-					lastKeyFrame = pck
-					return lastKeyFrame, lastPacketTime, isConnected, failureDuration, nil
+					lastKeyFrame = pck.Packet
+					return lastKeyFrame, lastPacketTime, isConnected, nil
 				}
 			}
 			if !start {
@@ -206,43 +246,79 @@ func processingMP4(
 				}
 				continue
 			}
-			if (pck.Idx == videoStreamIdx && pck.Time > lastPacketTime) || pck.Idx != videoStreamIdx {
-				failureDuration = time.Duration(0)
-				if streamVerboseLevel > VERBOSE_ADD {
-					log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Writing to archive segment")
-				}
-				err := tsMuxer.WritePacket(pck)
-				if err != nil {
-					return lastKeyFrame, lastPacketTime, isConnected, failureDuration, errors.Wrap(err, fmt.Sprintf("Can't write packet for TS muxer for stream %s (2)", streamID))
-				}
-				if pck.Idx == videoStreamIdx {
-					// Evaluate segment length
-					packetLength = pck.Time - lastPacketTime
-					lastPacketTime = pck.Time
-					if packetLength.Milliseconds() > msPerSegment { // If comment this you get [0; keyframe time] interval for the very first video file
-						if streamVerboseLevel > VERBOSE_NONE {
-							log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Very first interval")
-						}
-						continue
+			// Timestamps are monotonic after normalization, so every packet could be written
+			if streamVerboseLevel > VERBOSE_ADD {
+				log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Writing to archive segment")
+			}
+			err := tsMuxer.WritePacket(pck.Packet)
+			if err != nil {
+				return lastKeyFrame, lastPacketTime, isConnected, errors.Wrap(err, fmt.Sprintf("Can't write packet for TS muxer for stream %s (2)", streamID))
+			}
+			if pck.Idx == videoStreamIdx {
+				span.add(pck.Time)
+				// Evaluate segment length
+				packetLength = pck.Time - lastPacketTime
+				lastPacketTime = pck.Time
+				if packetLength.Milliseconds() > msPerSegment { // If comment this you get [0; keyframe time] interval for the very first video file
+					if streamVerboseLevel > VERBOSE_NONE {
+						log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Very first interval")
 					}
-					segmentLength += packetLength
-				}
-				segmentCount++
-			} else {
-				if streamVerboseLevel > VERBOSE_NONE {
-					log.Warn().Str("scope", SCOPE_MP4).Str("event", EVENT_MP4_WRITE).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Dur("failure_dur", failureDuration).Msg("Current packet time < previous")
-				}
-				failureDuration += pck.Duration
-				if failureDuration > maxFailureDuration {
-					return lastKeyFrame, lastPacketTime, isConnected, failureDuration, ErrTimeFailure
+					continue
 				}
+				segmentLength += packetLength
 			}
+			segmentCount++
 			if streamVerboseLevel > VERBOSE_ADD {
 				log.Info().Str("scope", SCOPE_MP4).Str("event", EVENT_CHAN_PACKET).Str("stream_id", streamID.String()).Str("segment_name", segmentName).Dur("pck_time", pck.Time).Dur("prev_pck_time", lastPacketTime).Dur("pck_dur", pck.Duration).Int8("pck_idx", pck.Idx).Int8("stream_idx", videoStreamIdx).Int("segment_count", segmentCount).Dur("segment_len", segmentLength).Msg("Wait other in archive channel")
 			}
 		}
 	}
-	return lastKeyFrame, lastPacketTime, isConnected, failureDuration, nil
+}
+
+// mp4SegmentSpan is an interval of the main track which has been written to the archive segment
+type mp4SegmentSpan struct {
+	started bool
+	start   time.Duration
+	last    time.Duration
+	frame   time.Duration
+	// Wall clock time of the first packet
+	wallStart time.Time
+}
+
+func (span *mp4SegmentSpan) add(t time.Duration) {
+	if !span.started {
+		span.started = true
+		span.start, span.last = t, t
+		span.wallStart = time.Now()
+		return
+	}
+	if dur := t - span.last; dur > 0 {
+		span.frame = dur
+	}
+	span.last = t
+}
+
+// duration includes the last frame
+func (span *mp4SegmentSpan) duration() time.Duration {
+	return span.last - span.start + span.frame
+}
+
+// segment prepares entry of the archive index. Location of the segment is up to caller
+func (span *mp4SegmentSpan) segment(name string, size int64, storageType storage.StorageType, codecs codecsFilter) ArchiveSegment {
+	duration := span.duration()
+	names := make([]string, len(codecs.codecs))
+	for i, codec := range codecs.codecs {
+		names[i] = codec.Type().String()
+	}
+	return ArchiveSegment{
+		Name:       name,
+		Start:      span.wallStart.UTC(),
+		End:        span.wallStart.Add(duration).UTC(),
+		DurationMs: duration.Milliseconds(),
+		Size:       size,
+		Storage:    storageType.String(),
+		Codecs:     names,
+	}
 }
 
 func UploadToMinio(minioStorage storage.ArchiveStorage, segmentName, bucket, sourceFileName string) (string, error) {
@@ -0,0 +1,64 @@
+package videoserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultOnDemandIdleTimeout is used for on-demand streams which are added via API without idle timeout
+	defaultOnDemandIdleTimeout = 30 * time.Second
+	// onDemandIdleCheckInterval is how often on-demand stream checks if there are viewers
+	onDemandIdleCheckInterval = time.Second
+	// onDemandPlaylistTimeout is how long HLS playlist request waits for the on-demand stream to produce playlist
+	onDemandPlaylistTimeout = 20 * time.Second
+)
+
+// waitDemand blocks until the given on-demand stream gets viewers. Returns false if context is done
+func (app *Application) waitDemand(ctx context.Context, streamID uuid.UUID, demand <-chan struct{}, streamVerboseLevel VerboseLevel) bool {
+	// Drop signals from viewers who have already gone
+	select {
+	case <-demand:
+	default:
+	}
+	if app.Streams.HasDemandForStream(streamID) {
+		return true
+	}
+	app.Streams.UpdateStateForStream(streamID, STREAM_STATE_IDLE, "")
+	if streamVerboseLevel > VERBOSE_NONE {
+		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DEMAND).Str("stream_id", streamID.String()).Msg("Waiting for viewers")
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-demand:
+		if streamVerboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DEMAND).Str("stream_id", streamID.String()).Msg("Stream has been requested")
+		}
+		return true
+	}
+}
+
+// watchIdle checks in background if the on-demand stream has viewers. Returned channel is closed once the stream becomes idle. Watching stops when context is done
+func (app *Application) watchIdle(ctx context.Context, streamID uuid.UUID) <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(onDemandIdleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !app.Streams.HasDemandForStream(streamID) {
+					close(idle)
+					return
+				}
+			}
+		}
+	}()
+	return idle
+}
@@ -0,0 +1,60 @@
+package videoserver
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/LdDl/video-server/configuration"
+)
+
+// ReconnectPolicy describes how to reconnect to the stream source after failures
+type ReconnectPolicy struct {
+	InitialDelay   time.Duration `json:"initial_delay"`
+	MaxDelay       time.Duration `json:"max_delay"`
+	Multiplier     float64       `json:"multiplier"`
+	Jitter         float64       `json:"jitter"`
+	MaxAttempts    int           `json:"max_attempts"`
+	NoVideoTimeout time.Duration `json:"no_video_timeout"`
+	DialTimeout    time.Duration `json:"dial_timeout"`
+	ReadTimeout    time.Duration `json:"read_timeout"`
+	FailbackAfter  time.Duration `json:"failback_after"`
+}
+
+// NewReconnectPolicyFrom creates policy from the post-processed configuration (every field is set)
+func NewReconnectPolicyFrom(cfg configuration.ReconnectConfiguration) ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialDelay:   time.Duration(*cfg.InitialDelayMs) * time.Millisecond,
+		MaxDelay:       time.Duration(*cfg.MaxDelayMs) * time.Millisecond,
+		Multiplier:     *cfg.Multiplier,
+		Jitter:         *cfg.Jitter,
+		MaxAttempts:    *cfg.MaxAttempts,
+		NoVideoTimeout: time.Duration(*cfg.NoVideoTimeoutMs) * time.Millisecond,
+		DialTimeout:    time.Duration(*cfg.DialTimeoutMs) * time.Millisecond,
+		ReadTimeout:    time.Duration(*cfg.ReadTimeoutMs) * time.Millisecond,
+		FailbackAfter:  time.Duration(*cfg.FailbackAfterMs) * time.Millisecond,
+	}
+}
+
+// Delay returns delay before the given attempt (starting from 1). Jitter is applied after capping by max delay, so streams which failed at once do not reconnect in lockstep
+func (policy ReconnectPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(policy.InitialDelay) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// AttemptsExceeded checks if there is no more attempts left
+func (policy ReconnectPolicy) AttemptsExceeded(attempt int) bool {
+	return policy.MaxAttempts > 0 && attempt > policy.MaxAttempts
+}
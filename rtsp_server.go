@@ -0,0 +1,191 @@
+package videoserver
+
+import (
+	"fmt"
+
+	"github.com/LdDl/video-server/rtspserver"
+	"github.com/deepch/vdk/av"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// StartRTSPServer starts RTSP server which accepts pushed streams and serves streams with 'rtsp' output type. Path of the URL must be stream ID
+func (app *Application) StartRTSPServer() {
+	log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PREPARE).Msg("Preparing to start RTSP Server")
+	url := fmt.Sprintf("%s:%d", app.RTSPServerCfg.Host, app.RTSPServerCfg.Port)
+	verboseLevel := app.RTSPServerCfg.Verbose
+	server := &rtspserver.Server{
+		Addr: url,
+		PublishCredentials: func(path string) (string, string, error) {
+			streamID, err := uuid.Parse(path)
+			if err != nil {
+				return "", "", rtspserver.ErrPathNotFound
+			}
+			user, password, sourceType, err := app.Streams.GetPublishCredentialsForStream(streamID)
+			if err != nil {
+				return "", "", rtspserver.ErrPathNotFound
+			}
+			if sourceType != SOURCE_TYPE_RTSP_PUSH {
+				return "", "", rtspserver.ErrPublishForbidden
+			}
+			return user, password, nil
+		},
+		HandlePublish: func(session *rtspserver.Session) error {
+			streamID, err := uuid.Parse(session.Path)
+			if err != nil {
+				return err
+			}
+			err = app.publishers.add(streamID, session)
+			if err != nil {
+				if verboseLevel > VERBOSE_NONE {
+					log.Warn().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PUBLISH).Str("stream_id", session.Path).Str("remote_addr", session.RemoteAddr).Msg("Publisher has been rejected")
+				}
+				return err
+			}
+			if verboseLevel > VERBOSE_NONE {
+				log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PUBLISH).Str("stream_id", session.Path).Str("remote_addr", session.RemoteAddr).Any("codec_data", session.CodecData()).Msg("Publisher has been accepted")
+			}
+			return nil
+		},
+		DescribeStream: func(path string) ([]av.CodecData, error) {
+			streamID, err := uuid.Parse(path)
+			if err != nil {
+				return nil, rtspserver.ErrPathNotFound
+			}
+			if !app.Streams.TypeExistsForStream(streamID, STREAM_TYPE_RTSP) {
+				return nil, rtspserver.ErrPathNotFound
+			}
+			// Temporary viewer wakes up on-demand stream and lets to wait for its codecs
+			clientID, client, err := app.Streams.AddViewer(streamID, STREAM_TYPE_RTSP)
+			if err != nil {
+				return nil, rtspserver.ErrPathNotFound
+			}
+			defer app.Streams.DeleteViewer(streamID, clientID)
+			codecData, err := waitCodecs(&app.Streams, streamID, client.codecs, codecsTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return newCodecsFilter(codecData, rtspSupportedCodecs).codecs, nil
+		},
+		HandlePlay: func(player *rtspserver.Player) error {
+			streamID, err := uuid.Parse(player.Path)
+			if err != nil {
+				return err
+			}
+			clientID, client, err := app.Streams.AddViewer(streamID, STREAM_TYPE_RTSP)
+			if err != nil {
+				return err
+			}
+			if verboseLevel > VERBOSE_NONE {
+				log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PLAY).Str("stream_id", player.Path).Str("client_id", clientID.String()).Str("remote_addr", player.RemoteAddr).Msg("Player has been connected")
+			}
+			go app.playRTSP(streamID, clientID, client, player, verboseLevel)
+			return nil
+		},
+		HandleError: func(remoteAddr string, err error) {
+			if errors.Is(err, rtspserver.ErrUnsupportedTransport) && verboseLevel > VERBOSE_NONE {
+				// Publishers which push over UDP by default (e.g. ffmpeg) fail on SETUP, so operators should see why
+				log.Warn().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_CLIENT_ERROR).Str("remote_addr", remoteAddr).Msg("RTSP client has requested unsupported transport. Only interleaved (TCP) transport is supported")
+				return
+			}
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Warn().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_CLIENT_ERROR).Str("remote_addr", remoteAddr).Msg("RTSP client error")
+			}
+		},
+	}
+	if verboseLevel > VERBOSE_NONE {
+		log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_START).Str("url", url).Msg("Start microservice for RTSP server")
+	}
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Error().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_START).Str("url", url).Msg("Can't start RTSP server")
+		return
+	}
+}
+
+// playRTSP feeds RTSP player with packets of the stream until either player or stream has gone
+func (app *Application) playRTSP(streamID, clientID uuid.UUID, client viewer, player *rtspserver.Player, verboseLevel VerboseLevel) {
+	defer func() {
+		app.Streams.DeleteViewer(streamID, clientID)
+		player.Close()
+		if verboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PLAY).Str("stream_id", player.Path).Str("client_id", clientID.String()).Str("remote_addr", player.RemoteAddr).Msg("Player has been disconnected")
+		}
+	}()
+	codecData, err := app.Streams.GetCodecsDataForStream(streamID)
+	if err != nil {
+		return
+	}
+	rtspCodecs := newCodecsFilter(codecData, rtspSupportedCodecs)
+	hasVideo := false
+	for _, codec := range rtspCodecs.codecs {
+		if codec.Type().IsVideo() {
+			hasVideo = true
+		}
+	}
+	// updateCodecs applies new codecs of the stream. Player can't be renegotiated, so it is disconnected if codecs' types have been changed
+	updateCodecs := func() bool {
+		codecData, err := app.Streams.GetCodecsDataForStream(streamID)
+		if err != nil {
+			return false
+		}
+		rtspCodecs = newCodecsFilter(codecData, rtspSupportedCodecs)
+		err = player.SetCodecData(rtspCodecs.codecs)
+		if err != nil {
+			if verboseLevel > VERBOSE_NONE {
+				log.Warn().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PLAY).Str("stream_id", player.Path).Str("client_id", clientID.String()).Str("remote_addr", player.RemoteAddr).Any("codecs", codecData).Msg("Codecs have been changed. Player needs to reconnect")
+			}
+			return false
+		}
+		return true
+	}
+	if !updateCodecs() {
+		return
+	}
+	start := !hasVideo
+	for {
+		select {
+		case <-player.Done():
+			return
+		case reason := <-client.disconnect:
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PLAY).Str("stream_id", player.Path).Str("client_id", clientID.String()).Str("remote_addr", player.RemoteAddr).Str("reason", reason).Msg("Player has been disconnected by server")
+			}
+			return
+		case <-client.codecs:
+			if !updateCodecs() {
+				return
+			}
+			start = !hasVideo
+		case pck := <-client.c:
+			// Codecs signal is sent before the first packet of the new codecs, so it has to be handled first
+			select {
+			case <-client.codecs:
+				if !updateCodecs() {
+					return
+				}
+				start = !hasVideo
+			default:
+			}
+			if !rtspCodecs.remap(&pck.Packet) {
+				continue
+			}
+			if pck.IsKeyFrame {
+				start = true
+			} else if pck.discontinuity && rtspCodecs.codecs[pck.Idx].Type().IsVideo() {
+				start = false
+			}
+			if !start {
+				continue
+			}
+			err := player.WritePacket(pck.Packet)
+			if err != nil {
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Warn().Err(err).Str("scope", SCOPE_RTSP_SERVER).Str("event", EVENT_RTSP_PLAY).Str("stream_id", player.Path).Str("client_id", clientID.String()).Str("remote_addr", player.RemoteAddr).Msg("Can't write packet to player")
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package rtspserver
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// authenticator validates credentials of RTSP client with either Digest or Basic scheme
+type authenticator struct {
+	realm string
+	nonce string
+}
+
+func newAuthenticator(realm string) *authenticator {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return &authenticator{
+		realm: realm,
+		nonce: hex.EncodeToString(nonce),
+	}
+}
+
+// challenges returns values for 'WWW-Authenticate' headers
+func (auth *authenticator) challenges() []string {
+	return []string{
+		fmt.Sprintf(`Digest realm="%s", nonce="%s"`, auth.realm, auth.nonce),
+		fmt.Sprintf(`Basic realm="%s"`, auth.realm),
+	}
+}
+
+// validate checks 'Authorization' header value against expected credentials
+func (auth *authenticator) validate(method, header, user, password string) bool {
+	switch {
+	case strings.HasPrefix(header, "Basic "):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err != nil {
+			return false
+		}
+		expected := user + ":" + password
+		return subtle.ConstantTimeCompare(decoded, []byte(expected)) == 1
+	case strings.HasPrefix(header, "Digest "):
+		params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+		if params["username"] != user || params["realm"] != auth.realm || params["nonce"] != auth.nonce {
+			return false
+		}
+		ha1 := md5Hex(user + ":" + auth.realm + ":" + password)
+		ha2 := md5Hex(method + ":" + params["uri"])
+		expected := md5Hex(ha1 + ":" + auth.nonce + ":" + ha2)
+		return subtle.ConstantTimeCompare([]byte(params["response"]), []byte(expected)) == 1
+	}
+	return false
+}
+
+// parseAuthParams parses comma separated key="value" pairs
+func parseAuthParams(value string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		keyval := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(keyval) != 2 {
+			continue
+		}
+		params[strings.ToLower(keyval[0])] = strings.Trim(keyval[1], `"`)
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
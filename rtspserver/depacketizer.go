@@ -0,0 +1,362 @@
+package rtspserver
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+const (
+	aacSamplesPerFrame = 1024
+	naluTypeIDR        = 5
+	// maxAccessUnitSize protects from broken streams which never mark the end of access unit
+	maxAccessUnitSize = 8 * 1024 * 1024
+)
+
+// depacketizer turns RTP packets of the single track into AV packets
+type depacketizer interface {
+	// codecData returns codec data of the track (nil if it is not known yet)
+	codecData() av.CodecData
+	// push handles RTP packet. Returns ready AV packets and flag whether codec data has been changed
+	push(pkt rtpPacket) ([]av.Packet, bool)
+}
+
+// videoDepacketizer collects NAL units of the single access unit for H264 (RFC 6184) and H265 (RFC 7798)
+type videoDepacketizer struct {
+	isHEVC   bool
+	codec    av.CodecData
+	vps      []byte
+	sps      []byte
+	pps      []byte
+	timeline rtpTimeline
+
+	nalus        [][]byte
+	auSize       int
+	auTimestamp  uint32
+	fragment     []byte
+	fragmentOK   bool
+	lastTime     time.Duration
+	lastTimeSeen bool
+}
+
+func newVideoDepacketizer(isHEVC bool, vps, sps, pps []byte, clockRate int) *videoDepacketizer {
+	if clockRate <= 0 {
+		clockRate = 90000
+	}
+	d := &videoDepacketizer{
+		isHEVC:   isHEVC,
+		vps:      vps,
+		sps:      sps,
+		pps:      pps,
+		timeline: rtpTimeline{clockRate: int64(clockRate)},
+	}
+	d.updateCodec()
+	return d
+}
+
+func (d *videoDepacketizer) codecData() av.CodecData {
+	return d.codec
+}
+
+// updateCodec rebuilds codec data from parameter sets. Returns true if codec data has been changed
+func (d *videoDepacketizer) updateCodec() bool {
+	var codec av.CodecData
+	var err error
+	if d.isHEVC {
+		if len(d.vps) == 0 || len(d.sps) == 0 || len(d.pps) == 0 {
+			return false
+		}
+		codec, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(d.vps, d.sps, d.pps)
+	} else {
+		if len(d.sps) == 0 || len(d.pps) == 0 {
+			return false
+		}
+		codec, err = h264parser.NewCodecDataFromSPSAndPPS(d.sps, d.pps)
+	}
+	if err != nil {
+		return false
+	}
+	d.codec = codec
+	return true
+}
+
+func (d *videoDepacketizer) push(pkt rtpPacket) ([]av.Packet, bool) {
+	var out []av.Packet
+	codecChanged := false
+	if len(d.nalus) > 0 && pkt.timestamp != d.auTimestamp {
+		// Previous access unit has not been marked as finished
+		if ready, ok := d.flush(); ok {
+			out = append(out, ready)
+		}
+	}
+	d.auTimestamp = pkt.timestamp
+	for _, nalu := range d.unpack(pkt.payload) {
+		if d.handleParameterSet(nalu) {
+			codecChanged = true
+			continue
+		}
+		if d.auSize+len(nalu) > maxAccessUnitSize {
+			d.reset()
+		}
+		d.nalus = append(d.nalus, nalu)
+		d.auSize += len(nalu)
+	}
+	if pkt.marker {
+		if ready, ok := d.flush(); ok {
+			out = append(out, ready)
+		}
+	}
+	return out, codecChanged
+}
+
+// unpack extracts complete NAL units from RTP payload (single NAL unit, aggregation and fragmentation packets)
+func (d *videoDepacketizer) unpack(payload []byte) [][]byte {
+	if d.isHEVC {
+		return d.unpackHEVC(payload)
+	}
+	return d.unpackAVC(payload)
+}
+
+func (d *videoDepacketizer) unpackAVC(payload []byte) [][]byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	switch typ := payload[0] & 0x1f; {
+	case typ >= 1 && typ <= 23:
+		return [][]byte{copyBytes(payload)}
+	case typ == 24: // STAP-A
+		return unpackAggregated(payload[1:])
+	case typ == 28: // FU-A
+		if len(payload) < 2 {
+			return nil
+		}
+		header := payload[1]
+		if header&0x80 != 0 {
+			d.fragment = append(d.fragment[:0], payload[0]&0xe0|header&0x1f)
+			d.fragmentOK = true
+		}
+		if !d.fragmentOK {
+			return nil
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+		if header&0x40 != 0 {
+			d.fragmentOK = false
+			return [][]byte{copyBytes(d.fragment)}
+		}
+	}
+	return nil
+}
+
+func (d *videoDepacketizer) unpackHEVC(payload []byte) [][]byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	switch typ := (payload[0] >> 1) & 0x3f; {
+	case typ < 48:
+		return [][]byte{copyBytes(payload)}
+	case typ == 48: // AP
+		return unpackAggregated(payload[2:])
+	case typ == 49: // FU
+		if len(payload) < 3 {
+			return nil
+		}
+		header := payload[2]
+		if header&0x80 != 0 {
+			d.fragment = append(d.fragment[:0], payload[0]&0x81|(header&0x3f)<<1, payload[1])
+			d.fragmentOK = true
+		}
+		if !d.fragmentOK {
+			return nil
+		}
+		d.fragment = append(d.fragment, payload[3:]...)
+		if header&0x40 != 0 {
+			d.fragmentOK = false
+			return [][]byte{copyBytes(d.fragment)}
+		}
+	}
+	return nil
+}
+
+// handleParameterSet remembers VPS/SPS/PPS. Returns true if NAL unit is a parameter set (it is not a part of access unit then)
+func (d *videoDepacketizer) handleParameterSet(nalu []byte) bool {
+	var target *[]byte
+	if d.isHEVC {
+		switch (nalu[0] >> 1) & 0x3f {
+		case h265parser.NAL_UNIT_VPS:
+			target = &d.vps
+		case h265parser.NAL_UNIT_SPS:
+			target = &d.sps
+		case h265parser.NAL_UNIT_PPS:
+			target = &d.pps
+		default:
+			return false
+		}
+	} else {
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			target = &d.sps
+		case h264parser.NALU_PPS:
+			target = &d.pps
+		default:
+			return false
+		}
+	}
+	if string(*target) == string(nalu) {
+		return true
+	}
+	*target = nalu
+	// Codec data is considered changed only when it could be built
+	return d.updateCodec()
+}
+
+// flush makes AV packet from collected NAL units. Access units without slices are dropped
+func (d *videoDepacketizer) flush() (av.Packet, bool) {
+	defer d.reset()
+	if d.codec == nil {
+		return av.Packet{}, false
+	}
+	pkt := av.Packet{}
+	size := 0
+	for _, nalu := range d.nalus {
+		if d.isVCL(nalu) {
+			size += 4 + len(nalu)
+		}
+	}
+	if size == 0 {
+		return av.Packet{}, false
+	}
+	pkt.Data = make([]byte, 0, size)
+	for _, nalu := range d.nalus {
+		if !d.isVCL(nalu) {
+			continue
+		}
+		if d.isKeyFrame(nalu) {
+			pkt.IsKeyFrame = true
+		}
+		pkt.Data = append(pkt.Data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		pkt.Data = append(pkt.Data, nalu...)
+	}
+	pkt.Time = d.timeline.toTime(d.auTimestamp)
+	if d.lastTimeSeen && pkt.Time > d.lastTime {
+		pkt.Duration = pkt.Time - d.lastTime
+	}
+	d.lastTime = pkt.Time
+	d.lastTimeSeen = true
+	return pkt, true
+}
+
+func (d *videoDepacketizer) reset() {
+	d.nalus = d.nalus[:0]
+	d.auSize = 0
+}
+
+func (d *videoDepacketizer) isVCL(nalu []byte) bool {
+	if d.isHEVC {
+		return (nalu[0]>>1)&0x3f < 32
+	}
+	return h264parser.IsDataNALU(nalu)
+}
+
+func (d *videoDepacketizer) isKeyFrame(nalu []byte) bool {
+	if d.isHEVC {
+		typ := (nalu[0] >> 1) & 0x3f
+		return typ >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && typ <= h265parser.NAL_UNIT_CODED_SLICE_CRA
+	}
+	return nalu[0]&0x1f == naluTypeIDR
+}
+
+// aacDepacketizer extracts AAC frames from MPEG4-GENERIC payload (RFC 3640, AAC-hbr mode)
+type aacDepacketizer struct {
+	codec       aacparser.CodecData
+	sizeLength  int
+	indexLength int
+	timeline    rtpTimeline
+}
+
+func newAACDepacketizer(codec aacparser.CodecData, sizeLength, indexLength int) *aacDepacketizer {
+	if sizeLength <= 0 {
+		sizeLength = 13
+	}
+	if indexLength <= 0 {
+		indexLength = 3
+	}
+	return &aacDepacketizer{
+		codec:       codec,
+		sizeLength:  sizeLength,
+		indexLength: indexLength,
+		timeline:    rtpTimeline{clockRate: int64(codec.SampleRate())},
+	}
+}
+
+func (d *aacDepacketizer) codecData() av.CodecData {
+	return d.codec
+}
+
+func (d *aacDepacketizer) push(pkt rtpPacket) ([]av.Packet, bool) {
+	payload := pkt.payload
+	if len(payload) < 2 {
+		return nil, false
+	}
+	headersBits := int(payload[0])<<8 | int(payload[1])
+	headersBytes := (headersBits + 7) / 8
+	if len(payload) < 2+headersBytes {
+		return nil, false
+	}
+	headers := payload[2 : 2+headersBytes]
+	data := payload[2+headersBytes:]
+	headerBits := d.sizeLength + d.indexLength
+	frameDuration := time.Duration(aacSamplesPerFrame) * time.Second / time.Duration(d.codec.SampleRate())
+	startTime := d.timeline.toTime(pkt.timestamp)
+
+	var out []av.Packet
+	for bit := 0; bit+headerBits <= headersBits; bit += headerBits {
+		size := readBits(headers, bit, d.sizeLength)
+		if size > len(data) {
+			break
+		}
+		out = append(out, av.Packet{
+			Idx:      0,
+			Data:     copyBytes(data[:size]),
+			Time:     startTime + time.Duration(len(out))*frameDuration,
+			Duration: frameDuration,
+		})
+		data = data[size:]
+	}
+	return out, false
+}
+
+// unpackAggregated splits aggregation packet payload (16-bit size prefixed NAL units)
+func unpackAggregated(payload []byte) [][]byte {
+	var nalus [][]byte
+	for len(payload) >= 2 {
+		size := int(payload[0])<<8 | int(payload[1])
+		payload = payload[2:]
+		if size == 0 || size > len(payload) {
+			break
+		}
+		nalus = append(nalus, copyBytes(payload[:size]))
+		payload = payload[size:]
+	}
+	return nalus
+}
+
+// readBits reads big-endian number of the given length starting from the given bit
+func readBits(buf []byte, start, length int) int {
+	value := 0
+	for i := start; i < start+length; i++ {
+		value <<= 1
+		if buf[i/8]&(0x80>>(i%8)) != 0 {
+			value |= 1
+		}
+	}
+	return value
+}
+
+func copyBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
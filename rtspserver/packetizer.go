@@ -0,0 +1,187 @@
+package rtspserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+const (
+	// maxRTPPayloadSize keeps RTP packets within common MTU
+	maxRTPPayloadSize = 1400
+	videoClockRate    = 90000
+	payloadTypeVideo  = 96
+	payloadTypeAudio  = 97
+	fuaNALUType       = 28
+	hevcFUNALUType    = 49
+)
+
+// packetizer turns AV packets of the single track into RTP packets
+type packetizer interface {
+	// packetize returns RTP packets (with headers) for the given AV packet
+	packetize(pkt av.Packet) [][]byte
+	// setCodecData replaces codec data of the track (e.g. parameter sets have been changed)
+	setCodecData(codec av.CodecData)
+}
+
+// rtpWriter writes RTP headers for the single track
+type rtpWriter struct {
+	payloadType    uint8
+	clockRate      int64
+	sequenceNumber uint16
+	timestampBase  uint32
+	ssrc           uint32
+}
+
+func newRTPWriter(payloadType uint8, clockRate int) rtpWriter {
+	random := make([]byte, 10)
+	rand.Read(random)
+	return rtpWriter{
+		payloadType:    payloadType,
+		clockRate:      int64(clockRate),
+		sequenceNumber: binary.BigEndian.Uint16(random[0:2]),
+		timestampBase:  binary.BigEndian.Uint32(random[2:6]),
+		ssrc:           binary.BigEndian.Uint32(random[6:10]),
+	}
+}
+
+// timestamp converts packet time to RTP timestamp
+func (w *rtpWriter) timestamp(t time.Duration) uint32 {
+	return w.timestampBase + uint32(int64(t)*w.clockRate/int64(time.Second))
+}
+
+// packet prepends RTP header to the payload
+func (w *rtpWriter) packet(marker bool, timestamp uint32, payload ...[]byte) []byte {
+	size := rtpHeaderSize
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := make([]byte, rtpHeaderSize, size)
+	buf[0] = rtpVersion << 6
+	buf[1] = w.payloadType
+	if marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], w.sequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:8], timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], w.ssrc)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	w.sequenceNumber++
+	return buf
+}
+
+// videoPacketizer splits access units of H264 (RFC 6184) and H265 (RFC 7798) into RTP packets. Parameter sets are sent before every keyframe
+type videoPacketizer struct {
+	rtpWriter
+	isHEVC        bool
+	parameterSets [][]byte
+}
+
+func newVideoPacketizer(codec av.CodecData) *videoPacketizer {
+	p := &videoPacketizer{
+		rtpWriter: newRTPWriter(payloadTypeVideo, videoClockRate),
+		isHEVC:    codec.Type() == av.H265,
+	}
+	p.setCodecData(codec)
+	return p
+}
+
+func (p *videoPacketizer) setCodecData(codec av.CodecData) {
+	switch c := codec.(type) {
+	case h264parser.CodecData:
+		p.parameterSets = [][]byte{c.SPS(), c.PPS()}
+	case h265parser.CodecData:
+		p.parameterSets = [][]byte{c.VPS(), c.SPS(), c.PPS()}
+	}
+}
+
+func (p *videoPacketizer) packetize(pkt av.Packet) [][]byte {
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	if pkt.IsKeyFrame {
+		nalus = append(append([][]byte{}, p.parameterSets...), nalus...)
+	}
+	timestamp := p.timestamp(pkt.Time + pkt.CompositionTime)
+	var out [][]byte
+	for i, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nalu) <= maxRTPPayloadSize {
+			out = append(out, p.packet(last, timestamp, nalu))
+			continue
+		}
+		out = append(out, p.fragment(nalu, last, timestamp)...)
+	}
+	return out
+}
+
+// fragment splits single NAL unit into fragmentation units (FU-A for H264, FU for H265)
+func (p *videoPacketizer) fragment(nalu []byte, lastNALU bool, timestamp uint32) [][]byte {
+	var header []byte
+	var naluType byte
+	var payload []byte
+	if p.isHEVC {
+		naluType = (nalu[0] >> 1) & 0x3f
+		header = []byte{(nalu[0] & 0x81) | hevcFUNALUType<<1, nalu[1]}
+		payload = nalu[2:]
+	} else {
+		naluType = nalu[0] & 0x1f
+		header = []byte{(nalu[0] & 0xe0) | fuaNALUType}
+		payload = nalu[1:]
+	}
+	chunkSize := maxRTPPayloadSize - len(header) - 1
+	var out [][]byte
+	for start := 0; start < len(payload); start += chunkSize {
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		fuHeader := naluType
+		if start == 0 {
+			fuHeader |= 0x80
+		}
+		if end == len(payload) {
+			fuHeader |= 0x40
+		}
+		out = append(out, p.packet(lastNALU && end == len(payload), timestamp, header, []byte{fuHeader}, payload[start:end]))
+	}
+	return out
+}
+
+// aacPacketizer puts every AAC frame into single MPEG4-GENERIC packet (RFC 3640, AAC-hbr mode)
+type aacPacketizer struct {
+	rtpWriter
+}
+
+func newAACPacketizer(codec aacparser.CodecData) *aacPacketizer {
+	return &aacPacketizer{
+		rtpWriter: newRTPWriter(payloadTypeAudio, codec.SampleRate()),
+	}
+}
+
+func (p *aacPacketizer) setCodecData(codec av.CodecData) {}
+
+func (p *aacPacketizer) packetize(pkt av.Packet) [][]byte {
+	// AU-headers-length (in bits) followed by single AU-header: 13 bits of size and 3 bits of index
+	auHeader := []byte{0x00, 0x10, byte(len(pkt.Data) >> 5), byte(len(pkt.Data)<<3) & 0xf8}
+	return [][]byte{p.packet(true, p.timestamp(pkt.Time), auHeader, pkt.Data)}
+}
+
+// newPacketizer returns packetizer for the given codec. Returns nil if codec is not supported
+func newPacketizer(codec av.CodecData) packetizer {
+	switch c := codec.(type) {
+	case h264parser.CodecData, h265parser.CodecData:
+		return newVideoPacketizer(c)
+	case aacparser.CodecData:
+		return newAACPacketizer(c)
+	}
+	return nil
+}
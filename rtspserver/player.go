@@ -0,0 +1,154 @@
+package rtspserver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/deepch/vdk/av"
+)
+
+var (
+	// ErrCodecsMismatch is returned by Player.SetCodecData when codecs can't be changed without new DESCRIBE
+	ErrCodecsMismatch = fmt.Errorf("rtsp: codecs mismatch")
+)
+
+// Player is a playing session (DESCRIBE/SETUP/PLAY) of RTSP client
+type Player struct {
+	ID         string
+	Path       string
+	RemoteAddr string
+
+	writeFn func(channel uint8, payload []byte) error
+	closeFn func()
+
+	mu       sync.Mutex
+	codecs   []av.CodecData
+	tracks   []*playerTrack
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// playerTrack is a single supported track of the player
+type playerTrack struct {
+	packetizer packetizer
+	channel    uint8
+	setup      bool
+}
+
+// newPlayer prepares player for the given codecs. Codecs which can't be sent over RTP are ignored
+func newPlayer(id, path, remoteAddr string, codecs []av.CodecData, writeFn func(channel uint8, payload []byte) error, closeFn func()) *Player {
+	player := &Player{
+		ID:         id,
+		Path:       path,
+		RemoteAddr: remoteAddr,
+		writeFn:    writeFn,
+		closeFn:    closeFn,
+		codecs:     codecs,
+		tracks:     make([]*playerTrack, len(codecs)),
+		done:       make(chan struct{}),
+	}
+	for i, codec := range codecs {
+		if p := newPacketizer(codec); p != nil {
+			player.tracks[i] = &playerTrack{packetizer: p}
+		}
+	}
+	return player
+}
+
+// hasTracks checks if there is at least one supported track
+func (player *Player) hasTracks() bool {
+	for _, track := range player.tracks {
+		if track != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setupTrack binds track to the interleaved channel. Returns false if there is no such track
+func (player *Player) setupTrack(idx int, channel uint8) bool {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	if idx < 0 || idx >= len(player.tracks) || player.tracks[idx] == nil {
+		return false
+	}
+	player.tracks[idx].channel = channel
+	player.tracks[idx].setup = true
+	return true
+}
+
+// ready checks if at least one track has been set up
+func (player *Player) ready() bool {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	for _, track := range player.tracks {
+		if track != nil && track.setup {
+			return true
+		}
+	}
+	return false
+}
+
+// CodecData returns codecs data which has been described to the client
+func (player *Player) CodecData() []av.CodecData {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	codecs := make([]av.CodecData, len(player.codecs))
+	copy(codecs, player.codecs)
+	return codecs
+}
+
+// SetCodecData updates parameters of the described codecs. Types of codecs must be the same
+func (player *Player) SetCodecData(codecs []av.CodecData) error {
+	player.mu.Lock()
+	defer player.mu.Unlock()
+	if len(codecs) != len(player.codecs) {
+		return ErrCodecsMismatch
+	}
+	for i := range codecs {
+		if codecs[i].Type() != player.codecs[i].Type() {
+			return ErrCodecsMismatch
+		}
+	}
+	for i, track := range player.tracks {
+		if track != nil {
+			track.packetizer.setCodecData(codecs[i])
+		}
+	}
+	player.codecs = codecs
+	return nil
+}
+
+// WritePacket sends packet to the client. Packets of tracks which have not been set up are skipped
+func (player *Player) WritePacket(pkt av.Packet) error {
+	player.mu.Lock()
+	if int(pkt.Idx) >= len(player.tracks) || player.tracks[pkt.Idx] == nil || !player.tracks[pkt.Idx].setup {
+		player.mu.Unlock()
+		return nil
+	}
+	track := player.tracks[pkt.Idx]
+	packets := track.packetizer.packetize(pkt)
+	player.mu.Unlock()
+	for _, buf := range packets {
+		if err := player.writeFn(track.channel, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done returns channel which is closed when client has gone
+func (player *Player) Done() <-chan struct{} {
+	return player.done
+}
+
+// Close disconnects client
+func (player *Player) Close() {
+	player.closeFn()
+}
+
+func (player *Player) finish() {
+	player.doneOnce.Do(func() {
+		close(player.done)
+	})
+}
@@ -0,0 +1,140 @@
+package rtspserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtspProtocol       = "RTSP/1.0"
+	maxRequestBodySize = 1024 * 1024
+)
+
+var (
+	ErrBadRequest = fmt.Errorf("rtsp: malformed request")
+)
+
+// request is RTSP request from client
+type request struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// readRequest reads RTSP request (request line, headers and body)
+func readRequest(br *bufio.Reader) (*request, error) {
+	reader := textproto.NewReader(br)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, ErrBadRequest
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	req := &request{
+		method: parts[0],
+		uri:    parts[1],
+		header: header,
+	}
+	if value := header.Get("Content-Length"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 || length > maxRequestBodySize {
+			return nil, ErrBadRequest
+		}
+		req.body = make([]byte, length)
+		if _, err := io.ReadFull(br, req.body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// path returns first segment of request URI path (it is used as stream identifier)
+func (req *request) path() string {
+	u, err := url.Parse(req.uri)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)[0]
+}
+
+// response is RTSP response to client. Header names are written as is
+type response struct {
+	status int
+	header map[string][]string
+	body   []byte
+}
+
+func newResponse(status int) *response {
+	return &response{
+		status: status,
+		header: make(map[string][]string),
+	}
+}
+
+// set replaces header values
+func (res *response) set(key string, values ...string) *response {
+	res.header[key] = values
+	return res
+}
+
+// write writes response for the given request
+func (res *response) write(w io.Writer, req *request) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %d %s\r\n", rtspProtocol, res.status, statusText(res.status))
+	if req != nil {
+		fmt.Fprintf(&sb, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	}
+	for key, values := range res.header {
+		for _, value := range values {
+			fmt.Fprintf(&sb, "%s: %s\r\n", key, value)
+		}
+	}
+	if len(res.body) > 0 {
+		fmt.Fprintf(&sb, "Content-Length: %d\r\n", len(res.body))
+	}
+	sb.WriteString("\r\n")
+	sb.Write(res.body)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func statusText(status int) string {
+	switch status {
+	case 200:
+		return "OK"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 415:
+		return "Unsupported Media Type"
+	case 454:
+		return "Session Not Found"
+	case 455:
+		return "Method Not Valid in This State"
+	case 461:
+		return "Unsupported Transport"
+	case 500:
+		return "Internal Server Error"
+	case 501:
+		return "Not Implemented"
+	default:
+		return "Internal Server Error"
+	}
+}
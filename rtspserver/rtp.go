@@ -0,0 +1,92 @@
+package rtspserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	rtpHeaderSize = 12
+	rtpVersion    = 2
+)
+
+var (
+	ErrRTPShort   = fmt.Errorf("rtp: packet is too short")
+	ErrRTPVersion = fmt.Errorf("rtp: wrong version")
+)
+
+// rtpPacket is a parsed RTP packet (RFC 3550)
+type rtpPacket struct {
+	marker         bool
+	payloadType    uint8
+	sequenceNumber uint16
+	timestamp      uint32
+	ssrc           uint32
+	payload        []byte
+}
+
+// parseRTP parses RTP packet. Payload refers to the given buffer
+func parseRTP(buf []byte) (rtpPacket, error) {
+	if len(buf) < rtpHeaderSize {
+		return rtpPacket{}, ErrRTPShort
+	}
+	if buf[0]>>6 != rtpVersion {
+		return rtpPacket{}, ErrRTPVersion
+	}
+	padding := buf[0]&0x20 != 0
+	extension := buf[0]&0x10 != 0
+	csrcCount := int(buf[0] & 0x0f)
+	pkt := rtpPacket{
+		marker:         buf[1]&0x80 != 0,
+		payloadType:    buf[1] & 0x7f,
+		sequenceNumber: binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:      binary.BigEndian.Uint32(buf[4:8]),
+		ssrc:           binary.BigEndian.Uint32(buf[8:12]),
+	}
+	offset := rtpHeaderSize + 4*csrcCount
+	if len(buf) < offset {
+		return rtpPacket{}, ErrRTPShort
+	}
+	if extension {
+		if len(buf) < offset+4 {
+			return rtpPacket{}, ErrRTPShort
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(buf[offset+2:offset+4]))
+		if len(buf) < offset {
+			return rtpPacket{}, ErrRTPShort
+		}
+	}
+	end := len(buf)
+	if padding && end > offset {
+		paddingLen := int(buf[end-1])
+		if end-offset < paddingLen {
+			return rtpPacket{}, ErrRTPShort
+		}
+		end -= paddingLen
+	}
+	pkt.payload = buf[offset:end]
+	return pkt, nil
+}
+
+// rtpTimeline converts 32-bit RTP timestamps (with possible wrapping) to the time relative to the first packet
+type rtpTimeline struct {
+	clockRate int64
+	started   bool
+	last      uint32
+	elapsed   int64
+}
+
+// toTime returns time passed from the first seen timestamp
+func (timeline *rtpTimeline) toTime(timestamp uint32) time.Duration {
+	if !timeline.started {
+		timeline.started = true
+		timeline.last = timestamp
+	}
+	timeline.elapsed += int64(int32(timestamp - timeline.last))
+	timeline.last = timestamp
+	if timeline.elapsed < 0 {
+		timeline.elapsed = 0
+	}
+	return time.Duration(timeline.elapsed * int64(time.Second) / timeline.clockRate)
+}
@@ -0,0 +1,53 @@
+package rtspserver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+)
+
+// trackControl returns value of 'control' attribute for the track with given index
+func trackControl(idx int) string {
+	return fmt.Sprintf("trackID=%d", idx)
+}
+
+// buildSDP describes the given codecs. Unsupported codecs are skipped, but they keep their indices
+func buildSDP(codecs []av.CodecData) []byte {
+	var sb strings.Builder
+	sb.WriteString("v=0\r\n")
+	sb.WriteString("o=- 0 0 IN IP4 127.0.0.1\r\n")
+	sb.WriteString("s=video-server\r\n")
+	sb.WriteString("c=IN IP4 0.0.0.0\r\n")
+	sb.WriteString("t=0 0\r\n")
+	for idx, codec := range codecs {
+		switch c := codec.(type) {
+		case h264parser.CodecData:
+			sps := c.SPS()
+			profileLevelID := ""
+			if len(sps) >= 4 {
+				profileLevelID = hex.EncodeToString(sps[1:4])
+			}
+			fmt.Fprintf(&sb, "m=video 0 RTP/AVP %d\r\n", payloadTypeVideo)
+			fmt.Fprintf(&sb, "a=rtpmap:%d H264/%d\r\n", payloadTypeVideo, videoClockRate)
+			fmt.Fprintf(&sb, "a=fmtp:%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s\r\n", payloadTypeVideo, profileLevelID, base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(c.PPS()))
+		case h265parser.CodecData:
+			fmt.Fprintf(&sb, "m=video 0 RTP/AVP %d\r\n", payloadTypeVideo)
+			fmt.Fprintf(&sb, "a=rtpmap:%d H265/%d\r\n", payloadTypeVideo, videoClockRate)
+			fmt.Fprintf(&sb, "a=fmtp:%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s\r\n", payloadTypeVideo, base64.StdEncoding.EncodeToString(c.VPS()), base64.StdEncoding.EncodeToString(c.SPS()), base64.StdEncoding.EncodeToString(c.PPS()))
+		case aacparser.CodecData:
+			fmt.Fprintf(&sb, "m=audio 0 RTP/AVP %d\r\n", payloadTypeAudio)
+			fmt.Fprintf(&sb, "a=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n", payloadTypeAudio, c.SampleRate(), c.ChannelLayout().Count())
+			fmt.Fprintf(&sb, "a=fmtp:%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s\r\n", payloadTypeAudio, hex.EncodeToString(c.MPEG4AudioConfigBytes()))
+		default:
+			continue
+		}
+		fmt.Fprintf(&sb, "a=control:%s\r\n", trackControl(idx))
+	}
+	return []byte(sb.String())
+}
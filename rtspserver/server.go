@@ -0,0 +1,485 @@
+package rtspserver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+const (
+	defaultRealm       = "video-server"
+	defaultReadTimeout = 60 * time.Second
+	// defaultWriteTimeout is a maximum duration of writing single interleaved frame to the playing client
+	defaultWriteTimeout = 10 * time.Second
+	interleavedMagic    = '$'
+)
+
+var (
+	ErrServerClosed = fmt.Errorf("rtsp: server closed")
+	// ErrPathNotFound should be returned by Server.PublishCredentials when there is no stream for the given path
+	ErrPathNotFound = fmt.Errorf("rtsp: path not found")
+	// ErrPublishForbidden should be returned by Server.PublishCredentials when publishing is not allowed for the given path
+	ErrPublishForbidden = fmt.Errorf("rtsp: publishing is forbidden")
+	// ErrUnsupportedTransport is reported when client requests transport other than interleaved (TCP) one
+	ErrUnsupportedTransport = fmt.Errorf("rtsp: unsupported transport")
+)
+
+// Server is RTSP server which accepts pushed streams (ANNOUNCE/RECORD) and serves streams to players (DESCRIBE/SETUP/PLAY). Only interleaved (TCP) transport is supported
+type Server struct {
+	Addr  string
+	Realm string
+	// ReadTimeout is a maximum duration between two incoming messages of the client
+	ReadTimeout time.Duration
+	// PublishCredentials returns credentials which are required to publish to the given path
+	PublishCredentials func(path string) (user string, password string, err error)
+	// HandlePublish is called when publishing session is ready (codecs data is known). Returned error rejects the session
+	HandlePublish func(session *Session) error
+	// DescribeStream returns codecs data of the stream which could be played from the given path. Should return ErrPathNotFound if there is no such stream
+	DescribeStream func(path string) ([]av.CodecData, error)
+	// HandlePlay is called when client starts playing. Handler should feed the player with packets until it is done. Returned error rejects the session
+	HandlePlay func(player *Player) error
+	// HandleError is called on client's errors (optional)
+	HandleError func(remoteAddr string, err error)
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// ListenAndServe listens on the TCP address and serves clients. It blocks until server is closed
+func (srv *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.mu.Lock()
+	srv.listener = listener
+	srv.mu.Unlock()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go newConn(srv, netConn).serve()
+	}
+}
+
+// Close stops listening
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	if srv.listener != nil {
+		return srv.listener.Close()
+	}
+	return nil
+}
+
+func (srv *Server) readTimeout() time.Duration {
+	if srv.ReadTimeout > 0 {
+		return srv.ReadTimeout
+	}
+	return defaultReadTimeout
+}
+
+func (srv *Server) realm() string {
+	if srv.Realm != "" {
+		return srv.Realm
+	}
+	return defaultRealm
+}
+
+func (srv *Server) reportError(remoteAddr string, err error) {
+	if srv.HandleError != nil && err != nil {
+		srv.HandleError(remoteAddr, err)
+	}
+}
+
+// conn is a single client connection
+type conn struct {
+	srv        *Server
+	netConn    net.Conn
+	br         *bufio.Reader
+	writeMu    sync.Mutex
+	auth       *authenticator
+	authorized bool
+
+	session   *Session
+	setupNum  int
+	channels  map[uint8]int
+	recording bool
+
+	player  *Player
+	playing bool
+}
+
+func newConn(srv *Server, netConn net.Conn) *conn {
+	return &conn{
+		srv:      srv,
+		netConn:  netConn,
+		br:       bufio.NewReaderSize(netConn, 64*1024),
+		auth:     newAuthenticator(srv.realm()),
+		channels: make(map[uint8]int),
+	}
+}
+
+func (c *conn) remoteAddr() string {
+	return c.netConn.RemoteAddr().String()
+}
+
+// serve reads requests and interleaved frames until connection is closed
+func (c *conn) serve() {
+	defer func() {
+		c.netConn.Close()
+		if c.session != nil {
+			c.session.finish()
+		}
+		if c.player != nil {
+			c.player.finish()
+		}
+	}()
+	for {
+		c.netConn.SetReadDeadline(time.Now().Add(c.srv.readTimeout()))
+		first, err := c.br.Peek(1)
+		if err != nil {
+			if err != io.EOF {
+				c.srv.reportError(c.remoteAddr(), err)
+			}
+			return
+		}
+		if first[0] == interleavedMagic {
+			err = c.readInterleaved()
+		} else {
+			err = c.handleRequest()
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.srv.reportError(c.remoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readInterleaved reads single '$'-prefixed frame and passes it to the session
+func (c *conn) readInterleaved() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		return err
+	}
+	size := int(header[2])<<8 | int(header[3])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if !c.recording {
+		return nil
+	}
+	mediaIdx, ok := c.channels[header[1]]
+	if !ok {
+		// RTCP or unknown channel
+		return nil
+	}
+	if c.session.handleRTP(mediaIdx, payload) {
+		if err := c.publish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish passes ready session to the handler
+func (c *conn) publish() error {
+	if c.srv.HandlePublish != nil {
+		if err := c.srv.HandlePublish(c.session); err != nil {
+			return err
+		}
+	}
+	c.session.markPublished()
+	return nil
+}
+
+// handleRequest reads single RTSP request and writes response for it
+func (c *conn) handleRequest() error {
+	req, err := readRequest(c.br)
+	if err != nil {
+		return err
+	}
+	var res *response
+	switch req.method {
+	case "OPTIONS":
+		res = newResponse(200).set("Public", "OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, RECORD, TEARDOWN, GET_PARAMETER, SET_PARAMETER")
+	case "DESCRIBE":
+		res = c.handleDescribe(req)
+	case "ANNOUNCE":
+		res = c.handleAnnounce(req)
+	case "SETUP":
+		if c.player != nil {
+			res = c.handlePlayerSetup(req)
+		} else {
+			res = c.handleSetup(req)
+		}
+	case "PLAY":
+		res = c.handlePlay(req)
+	case "RECORD":
+		res = c.handleRecord(req)
+	case "GET_PARAMETER", "SET_PARAMETER":
+		res = newResponse(200)
+	case "TEARDOWN":
+		c.writeResponse(newResponse(200), req)
+		return io.EOF
+	default:
+		res = newResponse(501)
+	}
+	if c.session != nil && res.status == 200 {
+		res.set("Session", c.session.ID)
+	}
+	if c.player != nil && res.status == 200 && req.method != "DESCRIBE" {
+		res.set("Session", c.player.ID)
+	}
+	if err := c.writeResponse(res, req); err != nil {
+		return err
+	}
+	if req.method == "RECORD" && res.status == 200 && c.session.ready() {
+		c.session.collectCodecs()
+		return c.publish()
+	}
+	if req.method == "PLAY" && res.status == 200 && !c.playing {
+		c.playing = true
+		if c.srv.HandlePlay != nil {
+			return c.srv.HandlePlay(c.player)
+		}
+	}
+	return nil
+}
+
+// writeInterleaved writes single '$'-prefixed frame to the client
+func (c *conn) writeInterleaved(channel uint8, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.netConn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+	header := []byte{interleavedMagic, channel, byte(len(payload) >> 8), byte(len(payload))}
+	if _, err := c.netConn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.netConn.Write(payload)
+	return err
+}
+
+func (c *conn) writeResponse(res *response, req *request) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return res.write(c.netConn, req)
+}
+
+// checkPublishAuth checks if client is allowed to publish to the path. Returns nil if it is
+func (c *conn) checkPublishAuth(req *request, path string) *response {
+	if c.srv.PublishCredentials == nil {
+		return newResponse(403)
+	}
+	user, password, err := c.srv.PublishCredentials(path)
+	if err != nil {
+		if err == ErrPathNotFound {
+			return newResponse(404)
+		}
+		return newResponse(403)
+	}
+	if user == "" {
+		// Publishing requires credentials
+		return newResponse(403)
+	}
+	if !c.auth.validate(req.method, req.header.Get("Authorization"), user, password) {
+		return newResponse(401).set("WWW-Authenticate", c.auth.challenges()...)
+	}
+	return nil
+}
+
+func (c *conn) handleDescribe(req *request) *response {
+	if c.session != nil || c.playing {
+		return newResponse(455)
+	}
+	if c.srv.DescribeStream == nil {
+		return newResponse(404)
+	}
+	path := req.path()
+	codecs, err := c.srv.DescribeStream(path)
+	if err != nil {
+		if err == ErrPathNotFound {
+			return newResponse(404)
+		}
+		return newResponse(500)
+	}
+	player := newPlayer(newSessionID(), path, c.remoteAddr(), codecs, c.writeInterleaved, func() { c.netConn.Close() })
+	if !player.hasTracks() {
+		return newResponse(415)
+	}
+	c.player = player
+	res := newResponse(200).set("Content-Type", "application/sdp").set("Content-Base", strings.TrimSuffix(req.uri, "/")+"/")
+	res.body = buildSDP(codecs)
+	return res
+}
+
+func (c *conn) handlePlayerSetup(req *request) *response {
+	if c.playing {
+		return newResponse(455)
+	}
+	transport := req.header.Get("Transport")
+	if !strings.Contains(transport, "TCP") && !strings.Contains(transport, "interleaved=") {
+		return newResponse(461)
+	}
+	trackIdx := c.matchTrack(req.uri)
+	if trackIdx < 0 {
+		return newResponse(404)
+	}
+	rtpChannel, rtcpChannel := uint8(2*trackIdx), uint8(2*trackIdx+1)
+	if value := transportParam(transport, "interleaved"); value != "" {
+		channels := strings.SplitN(value, "-", 2)
+		if n, err := strconv.Atoi(channels[0]); err == nil && n >= 0 && n < 255 {
+			rtpChannel, rtcpChannel = uint8(n), uint8(n+1)
+		}
+	}
+	if !c.player.setupTrack(trackIdx, rtpChannel) {
+		return newResponse(404)
+	}
+	c.setupNum++
+	return newResponse(200).set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", rtpChannel, rtcpChannel))
+}
+
+// matchTrack finds described track by control attribute. Tracks are picked in order of SETUP requests if nothing matches
+func (c *conn) matchTrack(uri string) int {
+	for i, track := range c.player.tracks {
+		if track == nil {
+			continue
+		}
+		if strings.HasSuffix(uri, "/"+trackControl(i)) {
+			return i
+		}
+	}
+	n := 0
+	for i, track := range c.player.tracks {
+		if track == nil {
+			continue
+		}
+		if n == c.setupNum {
+			return i
+		}
+		n++
+	}
+	return -1
+}
+
+func (c *conn) handlePlay(req *request) *response {
+	if c.player == nil || !c.player.ready() {
+		return newResponse(455)
+	}
+	if sessionID := strings.SplitN(req.header.Get("Session"), ";", 2)[0]; sessionID != "" && sessionID != c.player.ID {
+		return newResponse(454)
+	}
+	return newResponse(200).set("Range", "npt=0.000-")
+}
+
+func (c *conn) handleAnnounce(req *request) *response {
+	if c.session != nil || c.player != nil {
+		return newResponse(455)
+	}
+	path := req.path()
+	if res := c.checkPublishAuth(req, path); res != nil {
+		return res
+	}
+	c.authorized = true
+	if !strings.HasPrefix(req.header.Get("Content-Type"), "application/sdp") {
+		return newResponse(415)
+	}
+	_, medias := sdp.Parse(string(req.body))
+	session := newSession(newSessionID(), path, c.remoteAddr(), medias, func() { c.netConn.Close() })
+	if !session.hasTracks() {
+		return newResponse(415)
+	}
+	c.session = session
+	return newResponse(200)
+}
+
+func (c *conn) handleSetup(req *request) *response {
+	if c.session == nil || !c.authorized || c.recording {
+		return newResponse(455)
+	}
+	transport := req.header.Get("Transport")
+	if !strings.Contains(transport, "TCP") && !strings.Contains(transport, "interleaved=") {
+		c.srv.reportError(c.remoteAddr(), fmt.Errorf("%w: %s", ErrUnsupportedTransport, transport))
+		return newResponse(461)
+	}
+	mediaIdx := c.matchMedia(req.uri)
+	if mediaIdx < 0 {
+		return newResponse(404)
+	}
+	rtpChannel, rtcpChannel := uint8(2*mediaIdx), uint8(2*mediaIdx+1)
+	if value := transportParam(transport, "interleaved"); value != "" {
+		channels := strings.SplitN(value, "-", 2)
+		if n, err := strconv.Atoi(channels[0]); err == nil && n >= 0 && n < 255 {
+			rtpChannel, rtcpChannel = uint8(n), uint8(n+1)
+		}
+	}
+	c.channels[rtpChannel] = mediaIdx
+	c.setupNum++
+	return newResponse(200).set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", rtpChannel, rtcpChannel))
+}
+
+// matchMedia finds media by control attribute. Medias are picked in order of SETUP requests if nothing matches
+func (c *conn) matchMedia(uri string) int {
+	for i, media := range c.session.medias {
+		if media.Control == "" {
+			continue
+		}
+		if uri == media.Control || strings.HasSuffix(uri, "/"+media.Control) {
+			return i
+		}
+	}
+	if c.setupNum < len(c.session.medias) {
+		return c.setupNum
+	}
+	return -1
+}
+
+func (c *conn) handleRecord(req *request) *response {
+	if c.session == nil || !c.authorized || len(c.channels) == 0 {
+		return newResponse(455)
+	}
+	if sessionID := strings.SplitN(req.header.Get("Session"), ";", 2)[0]; sessionID != "" && sessionID != c.session.ID {
+		return newResponse(454)
+	}
+	c.recording = true
+	return newResponse(200)
+}
+
+// transportParam returns value of the parameter of 'Transport' header
+func transportParam(transport, key string) string {
+	for _, part := range strings.Split(transport, ";") {
+		keyval := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(keyval) == 2 && keyval[0] == key {
+			return keyval[1]
+		}
+	}
+	return ""
+}
+
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,206 @@
+package rtspserver
+
+import (
+	"sync"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+const (
+	sessionPacketsBuffer = 3000
+)
+
+// Session is a publishing session (ANNOUNCE/RECORD) of RTSP client
+type Session struct {
+	ID         string
+	Path       string
+	RemoteAddr string
+
+	medias  []sdp.Media
+	tracks  []*sessionTrack
+	closeFn func()
+
+	mu           sync.RWMutex
+	codecs       []av.CodecData
+	published    bool
+	packets      chan *av.Packet
+	codecUpdates chan struct{}
+	done         chan struct{}
+	doneOnce     sync.Once
+}
+
+// sessionTrack is a single supported media of the session
+type sessionTrack struct {
+	idx          int8
+	control      string
+	depacketizer depacketizer
+}
+
+// newSession prepares session for the announced medias. Medias with unsupported codecs are ignored
+func newSession(id, path, remoteAddr string, medias []sdp.Media, closeFn func()) *Session {
+	session := &Session{
+		ID:           id,
+		Path:         path,
+		RemoteAddr:   remoteAddr,
+		medias:       medias,
+		tracks:       make([]*sessionTrack, len(medias)),
+		closeFn:      closeFn,
+		packets:      make(chan *av.Packet, sessionPacketsBuffer),
+		codecUpdates: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	idx := int8(0)
+	for i, media := range medias {
+		var d depacketizer
+		switch media.Type {
+		case av.H264:
+			var sps, pps []byte
+			for _, ps := range media.SpropParameterSets {
+				if len(ps) == 0 {
+					continue
+				}
+				switch ps[0] & 0x1f {
+				case 7:
+					sps = ps
+				case 8:
+					pps = ps
+				}
+			}
+			d = newVideoDepacketizer(false, nil, sps, pps, media.TimeScale)
+		case av.H265:
+			d = newVideoDepacketizer(true, media.SpropVPS, media.SpropSPS, media.SpropPPS, media.TimeScale)
+		case av.AAC:
+			codec, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(media.Config)
+			if err != nil {
+				continue
+			}
+			d = newAACDepacketizer(codec, media.SizeLength, media.IndexLength)
+		default:
+			continue
+		}
+		session.tracks[i] = &sessionTrack{
+			idx:          idx,
+			control:      media.Control,
+			depacketizer: d,
+		}
+		idx++
+	}
+	return session
+}
+
+// hasTracks checks if there is at least one supported media
+func (session *Session) hasTracks() bool {
+	for _, track := range session.tracks {
+		if track != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ready checks if codec data is known for every supported media
+func (session *Session) ready() bool {
+	for _, track := range session.tracks {
+		if track != nil && track.depacketizer.codecData() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// collectCodecs updates codecs list from depacketizers
+func (session *Session) collectCodecs() {
+	codecs := make([]av.CodecData, 0, len(session.tracks))
+	for _, track := range session.tracks {
+		if track != nil {
+			codecs = append(codecs, track.depacketizer.codecData())
+		}
+	}
+	session.mu.Lock()
+	session.codecs = codecs
+	session.mu.Unlock()
+}
+
+// handleRTP passes RTP packet of the given media to its depacketizer. Returns true if session became ready for publishing
+func (session *Session) handleRTP(mediaIdx int, buf []byte) bool {
+	if mediaIdx < 0 || mediaIdx >= len(session.tracks) || session.tracks[mediaIdx] == nil {
+		return false
+	}
+	pkt, err := parseRTP(buf)
+	if err != nil {
+		return false
+	}
+	track := session.tracks[mediaIdx]
+	packets, codecChanged := track.depacketizer.push(pkt)
+
+	session.mu.RLock()
+	published := session.published
+	session.mu.RUnlock()
+	becameReady := false
+	if !published {
+		if !session.ready() {
+			return false
+		}
+		session.collectCodecs()
+		becameReady = true
+	} else if codecChanged {
+		session.collectCodecs()
+		select {
+		case session.codecUpdates <- struct{}{}:
+		default:
+		}
+	}
+	for i := range packets {
+		packets[i].Idx = track.idx
+		select {
+		case session.packets <- &packets[i]:
+		default:
+			// Consumer is too slow: drop packet
+		}
+	}
+	return becameReady
+}
+
+// markPublished marks that session has been passed to the consumer
+func (session *Session) markPublished() {
+	session.mu.Lock()
+	session.published = true
+	session.mu.Unlock()
+}
+
+// CodecData returns codecs data of the supported medias
+func (session *Session) CodecData() []av.CodecData {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	codecs := make([]av.CodecData, len(session.codecs))
+	copy(codecs, session.codecs)
+	return codecs
+}
+
+// Packets returns channel of incoming packets
+func (session *Session) Packets() <-chan *av.Packet {
+	return session.packets
+}
+
+// CodecUpdates returns channel which is notified when codecs data has been changed
+func (session *Session) CodecUpdates() <-chan struct{} {
+	return session.codecUpdates
+}
+
+// Done returns channel which is closed when publisher has gone
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+// Close disconnects publisher
+func (session *Session) Close() {
+	session.closeFn()
+}
+
+func (session *Session) finish() {
+	session.doneOnce.Do(func() {
+		close(session.done)
+	})
+}
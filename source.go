@@ -0,0 +1,53 @@
+package videoserver
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/google/uuid"
+)
+
+type SourceSignal uint8
+
+const (
+	// SOURCE_SIGNAL_CODEC_UPDATE is sent when codecs data of the source has been changed
+	SOURCE_SIGNAL_CODEC_UPDATE = SourceSignal(iota)
+	// SOURCE_SIGNAL_STOP is sent when source can't produce packets anymore
+	SOURCE_SIGNAL_STOP
+)
+
+// Source is a producer of packets for the stream (e.g. RTSP or RTMP client, looping file, RTSP publisher)
+type Source interface {
+	// CodecData returns current codecs data of the source
+	CodecData() []av.CodecData
+	// Packets returns channel of incoming packets
+	Packets() <-chan *av.Packet
+	// Signals returns channel of lifecycle signals
+	Signals() <-chan SourceSignal
+	// Close disconnects from the source
+	Close()
+}
+
+// SourceOptions is a set of options for dialing to the source
+type SourceOptions struct {
+	URL              string
+	DisableAudio     bool
+	DialTimeout      time.Duration
+	ReadWriteTimeout time.Duration
+}
+
+// dialSource connects to the source of the given type. Pushed streams wait for the publisher instead
+func (app *Application) dialSource(streamID uuid.UUID, typ SourceType, options SourceOptions) (Source, error) {
+	switch typ {
+	case SOURCE_TYPE_RTSP:
+		return dialRTSPSource(options)
+	case SOURCE_TYPE_RTMP:
+		return dialRTMPSource(options)
+	case SOURCE_TYPE_FILE:
+		return dialFileSource(options)
+	case SOURCE_TYPE_RTSP_PUSH:
+		return dialPushSource(app.publishers, streamID, options.DialTimeout)
+	default:
+		return nil, ErrSourceTypeNotSupported
+	}
+}
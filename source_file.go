@@ -0,0 +1,203 @@
+package videoserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/pkg/errors"
+)
+
+const (
+	// fileSourceFrameDuration is a fallback gap between the last packet of the file and the first packet of the next loop
+	fileSourceFrameDuration = 40 * time.Millisecond
+)
+
+// fileDemuxer is a common interface for MP4 and TS demuxers
+type fileDemuxer interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+}
+
+// fileSource is a Source implementation which replays local MP4 or TS file in real time, looping forever.
+// Timestamps are shifted on every loop so they are monotonic for the whole lifetime of the source
+type fileSource struct {
+	path    string
+	isTS    bool
+	file    *os.File
+	streams []av.CodecData
+	codecs  codecsFilter
+	packets chan *av.Packet
+	signals chan SourceSignal
+	done    chan struct{}
+}
+
+// dialFileSource opens file and starts replaying it. URL could be either plain path or 'file://' URI
+func dialFileSource(options SourceOptions) (*fileSource, error) {
+	path := strings.TrimPrefix(options.URL, "file://")
+	source := &fileSource{
+		path:    path,
+		isTS:    strings.ToLower(filepath.Ext(path)) == ".ts",
+		packets: make(chan *av.Packet, 3000),
+		signals: make(chan SourceSignal, 100),
+		done:    make(chan struct{}),
+	}
+	demuxer, err := source.open()
+	if err != nil {
+		return nil, err
+	}
+	codecData, err := demuxer.Streams()
+	if err != nil {
+		source.file.Close()
+		return nil, errors.Wrapf(err, "Can't probe streams of file '%s'", path)
+	}
+	// Keep only video tracks if audio is disabled (RTSP client does the same thing)
+	supported := make(codecTypesSet, len(codecData))
+	for _, codec := range codecData {
+		if codec.Type().IsVideo() || !options.DisableAudio {
+			supported[codec.Type()] = struct{}{}
+		}
+	}
+	source.streams = codecData
+	source.codecs = newCodecsFilter(codecData, supported)
+	go source.replay(demuxer)
+	return source, nil
+}
+
+// open (re)opens file and prepares demuxer for it
+func (source *fileSource) open() (fileDemuxer, error) {
+	if source.file != nil {
+		source.file.Close()
+	}
+	file, err := os.Open(source.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't open file '%s'", source.path)
+	}
+	source.file = file
+	if source.isTS {
+		demuxer := ts.NewDemuxer(file)
+		// Keep access units whole. They are converted to AVCC in readPacket
+		demuxer.AnnexB = true
+		return demuxer, nil
+	}
+	return mp4.NewDemuxer(file), nil
+}
+
+// readPacket reads next packet. H264 access units of TS files are converted from Annex B to AVCC
+func (source *fileSource) readPacket(demuxer fileDemuxer) (av.Packet, error) {
+	pkt, err := demuxer.ReadPacket()
+	if err != nil || !source.isTS || int(pkt.Idx) >= len(source.streams) || source.streams[pkt.Idx].Type() != av.H264 {
+		return pkt, err
+	}
+	// TS demuxer prefixes whole Annex B payload with its length
+	if len(pkt.Data) > 4 {
+		if data, ok := lengthPrefixedNALUs(pkt.Data[4:], av.H264); ok {
+			pkt.Data = data
+		}
+	}
+	return pkt, nil
+}
+
+// replay sends packets in real time. Demuxer is recreated on the end of file.
+// Last timestamps are tracked per track since audio and video are interleaved by chunks and must not be clamped to each other
+func (source *fileSource) replay(demuxer fileDemuxer) {
+	defer source.file.Close()
+	wallStart := time.Now()
+	offset := time.Duration(0)
+	tracksNum := len(source.codecs.codecs)
+	lastTimes := make([]time.Duration, tracksNum)
+	lastDurations := make([]time.Duration, tracksNum)
+	for i := range lastDurations {
+		lastDurations[i] = fileSourceFrameDuration
+	}
+	for {
+		loopStart := time.Duration(-1)
+		packetsNum := 0
+		for {
+			pkt, err := source.readPacket(demuxer)
+			if err != nil {
+				break
+			}
+			if !source.codecs.remap(&pkt) {
+				continue
+			}
+			if loopStart < 0 {
+				loopStart = pkt.Time
+			}
+			// Shift timestamps so they are continued after the previous loop
+			pkt.Time = pkt.Time - loopStart + offset
+			if pkt.Time < lastTimes[pkt.Idx] {
+				pkt.Time = lastTimes[pkt.Idx]
+			}
+			if pkt.Duration > 0 {
+				lastDurations[pkt.Idx] = pkt.Duration
+			}
+			lastTimes[pkt.Idx] = pkt.Time
+			packetsNum++
+
+			// Real time pacing
+			if delay := time.Until(wallStart.Add(pkt.Time)); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-source.done:
+					return
+				}
+			}
+			select {
+			case source.packets <- &pkt:
+			case <-source.done:
+				return
+			}
+		}
+		if packetsNum == 0 {
+			// Nothing could be read from the file: there is no sense to loop
+			select {
+			case source.signals <- SOURCE_SIGNAL_STOP:
+			case <-source.done:
+			}
+			return
+		}
+		// Next loop starts after the longest track so none of them goes backwards
+		for idx := range lastTimes {
+			if end := lastTimes[idx] + lastDurations[idx]; end > offset {
+				offset = end
+			}
+		}
+		var err error
+		demuxer, err = source.open()
+		if err == nil {
+			_, err = demuxer.Streams()
+		}
+		if err != nil {
+			select {
+			case source.signals <- SOURCE_SIGNAL_STOP:
+			case <-source.done:
+			}
+			return
+		}
+	}
+}
+
+// CodecData returns codecs data of the file
+func (source *fileSource) CodecData() []av.CodecData {
+	return source.codecs.codecs
+}
+
+// Packets returns channel of incoming packets
+func (source *fileSource) Packets() <-chan *av.Packet {
+	return source.packets
+}
+
+// Signals returns channel of lifecycle signals
+func (source *fileSource) Signals() <-chan SourceSignal {
+	return source.signals
+}
+
+// Close stops replaying
+func (source *fileSource) Close() {
+	close(source.done)
+}
@@ -0,0 +1,162 @@
+package videoserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/LdDl/video-server/rtspserver"
+	"github.com/deepch/vdk/av"
+	"github.com/google/uuid"
+)
+
+// publishersRegistry binds RTSP publishing sessions to the streams
+type publishersRegistry struct {
+	sync.Mutex
+	pending map[uuid.UUID]chan *rtspserver.Session
+	active  map[uuid.UUID]*rtspserver.Session
+}
+
+func newPublishersRegistry() *publishersRegistry {
+	return &publishersRegistry{
+		pending: make(map[uuid.UUID]chan *rtspserver.Session),
+		active:  make(map[uuid.UUID]*rtspserver.Session),
+	}
+}
+
+// queue returns queue of pending publishers for the given stream
+func (registry *publishersRegistry) queue(streamID uuid.UUID) chan *rtspserver.Session {
+	registry.Lock()
+	defer registry.Unlock()
+	ch, ok := registry.pending[streamID]
+	if !ok {
+		ch = make(chan *rtspserver.Session, 1)
+		registry.pending[streamID] = ch
+	}
+	return ch
+}
+
+// add puts new publisher into the queue. Only one publisher per stream is allowed
+func (registry *publishersRegistry) add(streamID uuid.UUID, session *rtspserver.Session) error {
+	registry.Lock()
+	active, ok := registry.active[streamID]
+	registry.Unlock()
+	if ok {
+		select {
+		case <-active.Done():
+		default:
+			return ErrPublisherExists
+		}
+	}
+	select {
+	case registry.queue(streamID) <- session:
+		return nil
+	default:
+		return ErrPublisherExists
+	}
+}
+
+// wait waits for the publisher of the given stream
+func (registry *publishersRegistry) wait(streamID uuid.UUID, timeout time.Duration) (*rtspserver.Session, error) {
+	ch := registry.queue(streamID)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case session := <-ch:
+			select {
+			case <-session.Done():
+				// Publisher has gone before stream has been started
+				continue
+			default:
+			}
+			registry.Lock()
+			registry.active[streamID] = session
+			registry.Unlock()
+			return session, nil
+		case <-deadline.C:
+			return nil, ErrNoPublisher
+		}
+	}
+}
+
+// release forgets active publisher of the given stream
+func (registry *publishersRegistry) release(streamID uuid.UUID, session *rtspserver.Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.active[streamID] == session {
+		delete(registry.active, streamID)
+	}
+}
+
+// pushSource is a Source implementation for streams which are pushed to the RTSP server
+type pushSource struct {
+	streamID uuid.UUID
+	registry *publishersRegistry
+	session  *rtspserver.Session
+	signals  chan SourceSignal
+	done     chan struct{}
+}
+
+// dialPushSource waits for the publisher of the given stream
+func dialPushSource(registry *publishersRegistry, streamID uuid.UUID, timeout time.Duration) (*pushSource, error) {
+	if registry == nil {
+		return nil, ErrRTSPServerDisabled
+	}
+	session, err := registry.wait(streamID, timeout)
+	if err != nil {
+		return nil, err
+	}
+	source := &pushSource{
+		streamID: streamID,
+		registry: registry,
+		session:  session,
+		signals:  make(chan SourceSignal, 100),
+		done:     make(chan struct{}),
+	}
+	go source.translateSignals()
+	return source, nil
+}
+
+// translateSignals converts session events to the source signals
+func (source *pushSource) translateSignals() {
+	for {
+		select {
+		case <-source.done:
+			return
+		case <-source.session.CodecUpdates():
+			select {
+			case source.signals <- SOURCE_SIGNAL_CODEC_UPDATE:
+			case <-source.done:
+				return
+			}
+		case <-source.session.Done():
+			select {
+			case source.signals <- SOURCE_SIGNAL_STOP:
+			case <-source.done:
+			}
+			return
+		}
+	}
+}
+
+// CodecData returns codecs data announced by publisher
+func (source *pushSource) CodecData() []av.CodecData {
+	return source.session.CodecData()
+}
+
+// Packets returns channel of incoming packets
+func (source *pushSource) Packets() <-chan *av.Packet {
+	return source.session.Packets()
+}
+
+// Signals returns channel of lifecycle signals
+func (source *pushSource) Signals() <-chan SourceSignal {
+	return source.signals
+}
+
+// Close disconnects publisher
+func (source *pushSource) Close() {
+	close(source.done)
+	source.session.Close()
+	source.registry.release(source.streamID, source.session)
+}
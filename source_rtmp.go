@@ -0,0 +1,98 @@
+package videoserver
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+	"github.com/pkg/errors"
+)
+
+// rtmpSource is a Source implementation for RTMP client (pull mode)
+type rtmpSource struct {
+	conn             *rtmp.Conn
+	codecs           codecsFilter
+	readWriteTimeout time.Duration
+	packets          chan *av.Packet
+	signals          chan SourceSignal
+	done             chan struct{}
+}
+
+// dialRTMPSource connects to RTMP server and starts reading packets
+func dialRTMPSource(options SourceOptions) (*rtmpSource, error) {
+	conn, err := rtmp.DialTimeout(options.URL, options.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if options.ReadWriteTimeout > 0 {
+		conn.NetConn().SetDeadline(time.Now().Add(options.ReadWriteTimeout))
+	}
+	codecData, err := conn.Streams()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Can't probe RTMP streams")
+	}
+	// Keep only video tracks if audio is disabled (RTSP client does the same thing)
+	supported := make(codecTypesSet, len(codecData))
+	for _, codec := range codecData {
+		if codec.Type().IsVideo() || !options.DisableAudio {
+			supported[codec.Type()] = struct{}{}
+		}
+	}
+	source := &rtmpSource{
+		conn:             conn,
+		codecs:           newCodecsFilter(codecData, supported),
+		readWriteTimeout: options.ReadWriteTimeout,
+		packets:          make(chan *av.Packet, 3000),
+		signals:          make(chan SourceSignal, 100),
+		done:             make(chan struct{}),
+	}
+	go source.readPackets()
+	return source, nil
+}
+
+// readPackets reads packets from RTMP connection until error or closing
+func (source *rtmpSource) readPackets() {
+	for {
+		if source.readWriteTimeout > 0 {
+			source.conn.NetConn().SetDeadline(time.Now().Add(source.readWriteTimeout))
+		}
+		pkt, err := source.conn.ReadPacket()
+		if err != nil {
+			select {
+			case source.signals <- SOURCE_SIGNAL_STOP:
+			case <-source.done:
+			}
+			return
+		}
+		if !source.codecs.remap(&pkt) {
+			continue
+		}
+		select {
+		case source.packets <- &pkt:
+		case <-source.done:
+			return
+		}
+	}
+}
+
+// CodecData returns codecs data of RTMP stream
+func (source *rtmpSource) CodecData() []av.CodecData {
+	return source.codecs.codecs
+}
+
+// Packets returns channel of incoming packets
+func (source *rtmpSource) Packets() <-chan *av.Packet {
+	return source.packets
+}
+
+// Signals returns channel of lifecycle signals
+func (source *rtmpSource) Signals() <-chan SourceSignal {
+	return source.signals
+}
+
+// Close disconnects from RTMP server
+func (source *rtmpSource) Close() {
+	close(source.done)
+	source.conn.Close()
+}
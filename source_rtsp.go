@@ -0,0 +1,80 @@
+package videoserver
+
+import (
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtspv2"
+)
+
+// rtspSource is a Source implementation for RTSP client
+type rtspSource struct {
+	session *rtspv2.RTSPClient
+	signals chan SourceSignal
+	done    chan struct{}
+}
+
+// dialRTSPSource connects to RTSP server
+func dialRTSPSource(options SourceOptions) (*rtspSource, error) {
+	session, err := rtspv2.Dial(rtspv2.RTSPClientOptions{
+		URL:              options.URL,
+		DisableAudio:     options.DisableAudio,
+		DialTimeout:      options.DialTimeout,
+		ReadWriteTimeout: options.ReadWriteTimeout,
+		Debug:            false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	source := &rtspSource{
+		session: session,
+		signals: make(chan SourceSignal, 100),
+		done:    make(chan struct{}),
+	}
+	go source.translateSignals()
+	return source, nil
+}
+
+// translateSignals converts RTSP client signals to the source ones
+func (source *rtspSource) translateSignals() {
+	for {
+		select {
+		case <-source.done:
+			return
+		case signal := <-source.session.Signals:
+			var sourceSignal SourceSignal
+			switch signal {
+			case rtspv2.SignalCodecUpdate:
+				sourceSignal = SOURCE_SIGNAL_CODEC_UPDATE
+			case rtspv2.SignalStreamRTPStop:
+				sourceSignal = SOURCE_SIGNAL_STOP
+			default:
+				continue
+			}
+			select {
+			case source.signals <- sourceSignal:
+			case <-source.done:
+				return
+			}
+		}
+	}
+}
+
+// CodecData returns current codecs data of RTSP session
+func (source *rtspSource) CodecData() []av.CodecData {
+	return source.session.CodecData
+}
+
+// Packets returns channel of incoming packets
+func (source *rtspSource) Packets() <-chan *av.Packet {
+	return source.session.OutgoingPacketQueue
+}
+
+// Signals returns channel of lifecycle signals
+func (source *rtspSource) Signals() <-chan SourceSignal {
+	return source.signals
+}
+
+// Close disconnects from RTSP server
+func (source *rtspSource) Close() {
+	close(source.done)
+	source.session.Close()
+}
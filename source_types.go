@@ -0,0 +1,52 @@
+package videoserver
+
+import (
+	"net/url"
+	"strings"
+)
+
+type SourceType uint16
+
+const (
+	SOURCE_TYPE_UNDEFINED = SourceType(iota)
+	SOURCE_TYPE_RTSP
+	SOURCE_TYPE_RTMP
+	SOURCE_TYPE_FILE
+	SOURCE_TYPE_RTSP_PUSH
+)
+
+func (iotaIdx SourceType) String() string {
+	return [...]string{"undefined", "rtsp", "rtmp", "file", "rtsp_push"}[iotaIdx]
+}
+
+// MarshalJSON returns name of the source type
+func (iotaIdx SourceType) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + iotaIdx.String() + `"`), nil
+}
+
+var (
+	supportedSourceTypes = map[string]SourceType{
+		"rtsp":      SOURCE_TYPE_RTSP,
+		"rtmp":      SOURCE_TYPE_RTMP,
+		"file":      SOURCE_TYPE_FILE,
+		"rtsp_push": SOURCE_TYPE_RTSP_PUSH,
+	}
+)
+
+func sourceTypeExists(typeName string) (SourceType, bool) {
+	v, ok := supportedSourceTypes[strings.ToLower(typeName)]
+	return v, ok
+}
+
+// sourceTypeFor returns type of the source. If type name is empty then it is guessed by URL scheme (RTSP is the fallback)
+func sourceTypeFor(typeName string, sourceURL string) (SourceType, bool) {
+	if typeName != "" {
+		return sourceTypeExists(typeName)
+	}
+	if u, err := url.Parse(sourceURL); err == nil {
+		if typ, ok := sourceTypeExists(u.Scheme); ok {
+			return typ, true
+		}
+	}
+	return SOURCE_TYPE_RTSP, true
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"io"
 )
 
 type ArchiveUnit struct {
@@ -10,8 +11,22 @@ type ArchiveUnit struct {
 	FileName    string
 }
 
+// DiskUsage is a space of the disk in bytes
+type DiskUsage struct {
+	Free  uint64
+	Total uint64
+}
+
 type ArchiveStorage interface {
 	Type() StorageType
 	MakeBucket(string) error
 	UploadFile(context.Context, ArchiveUnit) (string, error)
+	// ObjectName returns location of the segment inside the bucket (path to the file for filesystem)
+	ObjectName(ArchiveUnit) string
+	// OpenFile opens stored segment for reading
+	OpenFile(context.Context, ArchiveUnit) (io.ReadSeekCloser, error)
+	// RemoveFile deletes stored segment
+	RemoveFile(context.Context, ArchiveUnit) error
+	// DiskUsage returns space of the disk where bucket is stored
+	DiskUsage(bucket string) (DiskUsage, error)
 }
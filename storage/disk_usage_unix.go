@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+func diskUsage(path string) (DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return DiskUsage{}, err
+	}
+	return DiskUsage{
+		// Space available for unprivileged user
+		Free:  uint64(stat.Bavail) * uint64(stat.Bsize),
+		Total: uint64(stat.Blocks) * uint64(stat.Bsize),
+	}, nil
+}
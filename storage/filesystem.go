@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 )
 
 var ErrNotImplementedYet = fmt.Errorf("not implemented yet")
@@ -29,3 +31,25 @@ func (storage *FileSystemProvider) MakeBucket(bucket string) error {
 func (storage *FileSystemProvider) UploadFile(ctx context.Context, object ArchiveUnit) (string, error) {
 	return "", ErrNotImplementedYet
 }
+
+// ObjectName returns path to the segment. Bucket is a directory for filesystem storage
+func (storage *FileSystemProvider) ObjectName(object ArchiveUnit) string {
+	return filepath.Join(object.Bucket, object.SegmentName)
+}
+
+func (storage *FileSystemProvider) OpenFile(ctx context.Context, object ArchiveUnit) (io.ReadSeekCloser, error) {
+	return os.Open(storage.ObjectName(object))
+}
+
+// RemoveFile deletes the file. Missing file is not an error
+func (storage *FileSystemProvider) RemoveFile(ctx context.Context, object ArchiveUnit) error {
+	err := os.Remove(storage.ObjectName(object))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (storage *FileSystemProvider) DiskUsage(bucket string) (DiskUsage, error) {
+	return diskUsage(bucket)
+}
@@ -3,9 +3,9 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/lifecycle"
 )
 
 type MinioProvider struct {
@@ -33,24 +33,12 @@ func (m *MinioProvider) MakeBucket(bucket string) error {
 		minio.MakeBucketOptions{
 			ObjectLocking: true,
 		})
-	config := lifecycle.NewConfiguration()
-	config.Rules = []lifecycle.Rule{
-		{
-			ID:     "expire-bucket",
-			Status: "Enabled",
-			Expiration: lifecycle.Expiration{
-				Days: 2,
-			},
-		},
-	}
-
-	_ = m.client.SetBucketLifecycle(context.Background(), bucket, config)
 	return nil
 }
 
 // UploadFile loads file to MinIO. Do not provide FileName field in ArchiveUnit object if you want to use Payload bytes; otherwise file will be loaded from filesystem by FileName field
 func (m *MinioProvider) UploadFile(ctx context.Context, object ArchiveUnit) (string, error) {
-	fname := fmt.Sprintf("%s/%s", m.Path, object.SegmentName)
+	fname := m.ObjectName(object)
 	bucket := m.DefaultBucket
 	if object.Bucket != "" {
 		bucket = object.Bucket
@@ -66,3 +54,50 @@ func (m *MinioProvider) UploadFile(ctx context.Context, object ArchiveUnit) (str
 	)
 	return object.SegmentName, err
 }
+
+// ObjectName returns name of the object in the bucket
+func (m *MinioProvider) ObjectName(object ArchiveUnit) string {
+	return fmt.Sprintf("%s/%s", m.Path, object.SegmentName)
+}
+
+// OpenFile returns reader of the object. Object is fetched lazily (by ranges on seeking)
+func (m *MinioProvider) OpenFile(ctx context.Context, object ArchiveUnit) (io.ReadSeekCloser, error) {
+	bucket := m.DefaultBucket
+	if object.Bucket != "" {
+		bucket = object.Bucket
+	}
+	obj, err := m.client.GetObject(ctx, bucket, m.ObjectName(object), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// Errors (e.g. missing object) are reported on the first request only
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// RemoveFile deletes the object. Bucket is versioned due object locking, so the version itself is removed instead of adding delete marker. Missing object is not an error
+func (m *MinioProvider) RemoveFile(ctx context.Context, object ArchiveUnit) error {
+	bucket := m.DefaultBucket
+	if object.Bucket != "" {
+		bucket = object.Bucket
+	}
+	fname := m.ObjectName(object)
+	info, err := m.client.StatObject(ctx, bucket, fname, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil
+		}
+		return err
+	}
+	return m.client.RemoveObject(ctx, bucket, fname, minio.RemoveObjectOptions{
+		VersionID: info.VersionID,
+	})
+}
+
+// DiskUsage is not available for MinIO
+func (m *MinioProvider) DiskUsage(bucket string) (DiskUsage, error) {
+	return DiskUsage{}, ErrNotImplementedYet
+}
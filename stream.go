@@ -1,21 +1,16 @@
 package videoserver
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/deepch/vdk/format/rtspv2"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	pingDuration        = 15 * time.Second
-	pingDurationRestart = pingDuration + 1*time.Second
-	dialTimeoutDuration = 33 * time.Second
-	readTimeoutDuration = 33 * time.Second
-)
-
 type StopSignal uint8
 
 const (
@@ -23,52 +18,81 @@ const (
 	STOP_SIGNAL_NO_VIDEO
 	STOP_SIGNAL_DISCONNECT
 	STOP_SIGNAL_STOP_DIAL
+	// Stream is being disabled, deleted or server is shutting down
+	STOP_SIGNAL_TEARDOWN
 )
 
-// runStream runs RTSP grabbing process
-func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, archiveEnabled bool, streamVerboseLevel VerboseLevel) error {
-	var stopHlsCast, stopMP4Cast chan StopSignal
+// runStream runs grabbing process for the stream's source. Outputs (HLS, MP4) are stopped and flushed before return.
+// Closing of failback channel interrupts the process with ErrStreamFailback, closing of idle channel - with ErrStreamIdle. Done context tears the stream down
+func (app *Application) runStream(ctx context.Context, streamID uuid.UUID, url string, sourceType SourceType, reconnectPolicy ReconnectPolicy, failback, idle <-chan struct{}, hlsEnabled, archiveEnabled, audioEnabled bool, streamVerboseLevel VerboseLevel) error {
+	var stopHlsCast, stopDashCast, stopMP4Cast chan StopSignal
 
+	// HLS and DASH writers failures must not stop the source, so their errors are handled apart from MP4 ones
+	var hlsErrorSignal, dashErrorSignal chan error
 	if hlsEnabled {
 		stopHlsCast = make(chan StopSignal, 1)
+		hlsErrorSignal = make(chan error, 1)
+	}
+	// DASH writer is not needed for probing, so it is picked up here rather than passed by caller
+	dashEnabled := app.Streams.TypeExistsForStream(streamID, STREAM_TYPE_DASH)
+	if dashEnabled {
+		stopDashCast = make(chan StopSignal, 1)
+		dashErrorSignal = make(chan error, 1)
 	}
 	if archiveEnabled {
 		stopMP4Cast = make(chan StopSignal, 1)
 	}
 
 	errorSignal := make(chan error, 1)
+	reconfigure, err := app.Streams.GetReconfigureSignalForStream(streamID)
+	if err != nil {
+		return errors.Wrapf(err, "Can't get reconfigure signal for stream %s", streamID)
+	}
+	timeline, err := app.Streams.GetTimelineForStream(streamID)
+	if err != nil {
+		return errors.Wrapf(err, "Can't get timeline for stream %s", streamID)
+	}
 
 	if streamVerboseLevel > VERBOSE_NONE {
-		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DIAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Msg("Trying to dial")
+		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DIAL).Str("stream_id", streamID.String()).Str("stream_url", url).Str("source_type", sourceType.String()).Bool("hls_enabled", hlsEnabled).Bool("audio_enabled", audioEnabled).Msg("Trying to dial")
 	}
-	session, err := rtspv2.Dial(rtspv2.RTSPClientOptions{
+	session, err := app.dialSource(streamID, sourceType, SourceOptions{
 		URL:              url,
-		DisableAudio:     true,
-		DialTimeout:      dialTimeoutDuration,
-		ReadWriteTimeout: readTimeoutDuration,
-		Debug:            false,
+		DisableAudio:     !audioEnabled,
+		DialTimeout:      reconnectPolicy.DialTimeout,
+		ReadWriteTimeout: reconnectPolicy.ReadTimeout,
 	})
 	if err != nil {
-		return errors.Wrapf(err, "Can't connect to stream '%s'", url)
+		return errors.Wrapf(fmt.Errorf("%w: %w", ErrStreamDial, err), "Can't connect to stream '%s'", url)
 	}
+	// Timestamps of the new session start from scratch
+	timeline.restart()
+	// Every output gets exactly one stop signal, so it never blocks the runner
+	stopSignal := STOP_SIGNAL_STOP_DIAL
+	var castWG sync.WaitGroup
 	defer func() {
 		if streamVerboseLevel > VERBOSE_NONE {
-			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DIAL).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Closing connection")
+			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DIAL).Str("stream_id", streamID.String()).Str("stream_url", url).Any("stop_signal", stopSignal).Msg("Closing connection")
 		}
 		if hlsEnabled {
-			stopHlsCast <- STOP_SIGNAL_STOP_DIAL
+			stopHlsCast <- stopSignal
+		}
+		if dashEnabled {
+			stopDashCast <- stopSignal
 		}
 		if archiveEnabled {
-			stopMP4Cast <- STOP_SIGNAL_STOP_DIAL
+			stopMP4Cast <- stopSignal
 		}
 		session.Close()
+		// Let outputs close their segments properly
+		castWG.Wait()
 	}()
 
-	if len(session.CodecData) != 0 {
+	if len(session.CodecData()) != 0 {
 		if streamVerboseLevel > VERBOSE_NONE {
-			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_CODEC_MET).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Any("codec_data", session.CodecData).Msg("Found codec. Adding this one")
+			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_CODEC_MET).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Any("codec_data", session.CodecData()).Msg("Found codec. Adding this one")
 		}
-		err = app.Streams.AddCodecForStream(streamID, session.CodecData)
+		err = app.Streams.AddCodecForStream(streamID, session.CodecData())
 		if err != nil {
 			return errors.Wrapf(err, "Can't update codec data for stream %s on empty codecs", streamID)
 		}
@@ -82,8 +106,8 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 	}
 
 	isAudioOnly := false
-	if len(session.CodecData) == 1 {
-		if session.CodecData[0].Type().IsAudio() {
+	if len(session.CodecData()) == 1 {
+		if session.CodecData()[0].Type().IsAudio() {
 			if streamVerboseLevel > VERBOSE_NONE {
 				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_AUDIO_MET).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Msg("Only audio")
 			}
@@ -95,7 +119,7 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 		if streamVerboseLevel > VERBOSE_NONE {
 			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Need to start casting for HLS")
 		}
-		err = app.startHlsCast(streamID, stopHlsCast)
+		err = app.startHlsCast(streamID, stopHlsCast, hlsErrorSignal, &castWG)
 		if err != nil {
 			if streamVerboseLevel > VERBOSE_NONE {
 				log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't start HLS casting")
@@ -103,6 +127,18 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 		}
 	}
 
+	if dashEnabled {
+		if streamVerboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Need to start casting for DASH")
+		}
+		err = app.startDashCast(streamID, stopDashCast, dashErrorSignal, &castWG)
+		if err != nil {
+			if streamVerboseLevel > VERBOSE_NONE {
+				log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't start DASH casting")
+			}
+		}
+	}
+
 	if archiveEnabled {
 		if streamVerboseLevel > VERBOSE_NONE {
 			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_MP4_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Need to start casting to MP4 archive")
@@ -111,7 +147,7 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 		if archive == nil {
 			log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_MP4_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Empty archive configuration for the given stream")
 		} else {
-			err = app.startMP4Cast(archive, streamID, stopMP4Cast, errorSignal, streamVerboseLevel)
+			err = app.startMP4Cast(archive, streamID, stopMP4Cast, errorSignal, &castWG, streamVerboseLevel)
 			if err != nil {
 				if streamVerboseLevel > VERBOSE_NONE {
 					log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_MP4_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't start MP4 archive process")
@@ -120,25 +156,22 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 		}
 	}
 
-	pingStream := time.NewTimer(pingDuration)
+	pingStream := time.NewTimer(reconnectPolicy.NoVideoTimeout)
+	isOnline := false
 	for {
 		select {
 		case <-pingStream.C:
 			log.Error().Err(ErrStreamHasNoVideo).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_EXIT_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Stream has no video")
-			if hlsEnabled {
-				stopHlsCast <- STOP_SIGNAL_NO_VIDEO
-			}
-			if archiveEnabled {
-				stopMP4Cast <- STOP_SIGNAL_NO_VIDEO
-			}
+			stopSignal = STOP_SIGNAL_NO_VIDEO
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_NO_VIDEO, "")
 			return errors.Wrapf(ErrStreamHasNoVideo, "URL is '%s'", url)
-		case signals := <-session.Signals:
+		case signals := <-session.Signals():
 			switch signals {
-			case rtspv2.SignalCodecUpdate:
+			case SOURCE_SIGNAL_CODEC_UPDATE:
 				if streamVerboseLevel > VERBOSE_NONE {
-					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_CODEC_UPDATE_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Any("codec_data", session.CodecData).Msg("Recieved update codec signal")
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_CODEC_UPDATE_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Any("codec_data", session.CodecData()).Msg("Recieved update codec signal")
 				}
-				err = app.Streams.AddCodecForStream(streamID, session.CodecData)
+				err = app.Streams.AddCodecForStream(streamID, session.CodecData())
 				if err != nil {
 					return errors.Wrapf(err, "Can't update codec data for stream %s on codecs update signal", streamID)
 				}
@@ -146,25 +179,23 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 				if err != nil {
 					return errors.Wrapf(err, "Can't update status for stream %s after codecs update", streamID)
 				}
-			case rtspv2.SignalStreamRTPStop:
+				if isOnline {
+					app.Streams.UpdateStateForStream(streamID, STREAM_STATE_ONLINE, "codecs have been updated")
+				}
+			case SOURCE_SIGNAL_STOP:
 				if streamVerboseLevel > VERBOSE_NONE {
 					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_STOP_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Recieved stop signal")
 				}
-				if hlsEnabled {
-					stopHlsCast <- STOP_SIGNAL_DISCONNECT
-				}
-				if archiveEnabled {
-					stopMP4Cast <- STOP_SIGNAL_DISCONNECT
-				}
+				stopSignal = STOP_SIGNAL_DISCONNECT
 				err = app.Streams.UpdateStreamStatus(streamID, false)
 				if err != nil {
 					return errors.Wrapf(err, "Can't update status for stream %s after RTP stops", streamID)
 				}
 				return errors.Wrapf(ErrStreamDisconnected, "URL is '%s'", url)
 			default:
-				log.Info().Str("warn", SCOPE_STREAMING).Str("event", EVENT_STREAMING_UNKNOWN_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Int("signal", signals).Msg("Other signal")
+				log.Info().Str("warn", SCOPE_STREAMING).Str("event", EVENT_STREAMING_UNKNOWN_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Uint8("signal", uint8(signals)).Msg("Other signal")
 			}
-		case packetAV := <-session.OutgoingPacketQueue:
+		case packetAV := <-session.Packets():
 			if streamVerboseLevel > VERBOSE_ADD {
 				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Recieved outgoing packet from queue")
 			}
@@ -172,33 +203,107 @@ func (app *Application) runStream(streamID uuid.UUID, url string, hlsEnabled, ar
 				if streamVerboseLevel > VERBOSE_ADD {
 					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("only_audio", isAudioOnly).Bool("is_keyframe", packetAV.IsKeyFrame).Msg("Need to reset ping for stream")
 				}
-				pingStream.Reset(pingDurationRestart)
+				pingStream.Reset(reconnectPolicy.NoVideoTimeout)
+				if !isOnline {
+					// Stream is healthy: next failure should be retried with initial delay
+					isOnline = true
+					app.Streams.ResetReconnectAttempts(streamID)
+					app.Streams.UpdateStateForStream(streamID, STREAM_STATE_ONLINE, "")
+				}
 			}
 			if streamVerboseLevel > VERBOSE_ADD {
 				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("only_audio", isAudioOnly).Bool("is_keyframe", packetAV.IsKeyFrame).Msg("Casting packet")
 			}
-			err = app.Streams.CastPacket(streamID, *packetAV, hlsEnabled, archiveEnabled)
+			pck := timeline.normalize(*packetAV)
+			if pck.discontinuity && streamVerboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DISCONTINUITY).Str("stream_id", streamID.String()).Str("stream_url", url).Int8("pck_idx", packetAV.Idx).Dur("pck_time", packetAV.Time).Dur("normalized_time", pck.Time).Msg("Timeline discontinuity")
+			}
+			err = app.Streams.CastPacket(streamID, pck, hlsEnabled, dashEnabled, archiveEnabled)
 			if err != nil {
-				if hlsEnabled {
-					if streamVerboseLevel > VERBOSE_NONE {
-						log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("only_audio", isAudioOnly).Bool("is_keyframe", packetAV.IsKeyFrame).Msg("Need to stop HLS cast")
-					}
-					stopHlsCast <- STOP_SIGNAL_ERR
-				}
-				if archiveEnabled {
-					if streamVerboseLevel > VERBOSE_NONE {
-						log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("only_audio", isAudioOnly).Bool("is_keyframe", packetAV.IsKeyFrame).Msg("Need to stop MP4 cast")
-					}
-					stopMP4Cast <- STOP_SIGNAL_ERR
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_PACKET_SIGNAL).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("only_audio", isAudioOnly).Bool("is_keyframe", packetAV.IsKeyFrame).Msg("Need to stop HLS and MP4 casts")
 				}
+				stopSignal = STOP_SIGNAL_ERR
 				errStatus := app.Streams.UpdateStreamStatus(streamID, false)
 				if errStatus != nil {
 					return errors.Wrapf(err, "Can't update status for stream %s after casting", streamID)
 				}
 				return errors.Wrapf(err, "Can't cast packet %s (%s)", streamID, url)
 			}
+		case <-ctx.Done():
+			stopSignal = STOP_SIGNAL_TEARDOWN
+			if errors.Is(context.Cause(ctx), ErrStreamRestart) {
+				stopSignal = STOP_SIGNAL_STOP_DIAL
+			}
+			return ctx.Err()
+		case <-reconfigure:
+			// Outputs have been changed at runtime: source stays connected, only HLS and DASH writers are started or stopped
+			dashRequired := app.Streams.TypeExistsForStream(streamID, STREAM_TYPE_DASH)
+			if dashRequired && !dashEnabled {
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("DASH output has been enabled. Need to start casting for DASH")
+				}
+				stopDashCast = make(chan StopSignal, 1)
+				dashErrorSignal = make(chan error, 1)
+				err = app.startDashCast(streamID, stopDashCast, dashErrorSignal, &castWG)
+				if err != nil {
+					log.Warn().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't start DASH casting")
+				} else {
+					dashEnabled = true
+				}
+			} else if !dashRequired && dashEnabled {
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("DASH output has been disabled. Need to stop casting for DASH")
+				}
+				stopDashCast <- STOP_SIGNAL_TEARDOWN
+				dashEnabled = false
+			}
+			hlsRequired := app.Streams.TypeExistsForStream(streamID, STREAM_TYPE_HLS)
+			if hlsRequired && !hlsEnabled {
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("HLS output has been enabled. Need to start casting for HLS")
+				}
+				stopHlsCast = make(chan StopSignal, 1)
+				hlsErrorSignal = make(chan error, 1)
+				err = app.startHlsCast(streamID, stopHlsCast, hlsErrorSignal, &castWG)
+				if err != nil {
+					log.Warn().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't start HLS casting")
+					continue
+				}
+				hlsEnabled = true
+			} else if !hlsRequired && hlsEnabled {
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("HLS output has been disabled. Need to stop casting for HLS")
+				}
+				stopHlsCast <- STOP_SIGNAL_TEARDOWN
+				hlsEnabled = false
+			}
+		case <-failback:
+			if streamVerboseLevel > VERBOSE_NONE {
+				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_FAILBACK).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Primary source is healthy again. Need to fail back")
+			}
+			return errors.Wrapf(ErrStreamFailback, "URL is '%s'", url)
+		case <-idle:
+			if streamVerboseLevel > VERBOSE_NONE {
+				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_IDLE).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Stream has no viewers. Need to disconnect")
+			}
+			return errors.Wrapf(ErrStreamIdle, "URL is '%s'", url)
 		case errS := <-errorSignal:
 			return errors.Wrapf(errS, "Recieved error signal from MP4 casting")
+		case errS := <-hlsErrorSignal:
+			// Other outputs keep going. HLS writer is started again on the next reconnect or reconfiguration
+			log.Warn().Err(errS).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_HLS_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("HLS casting has failed. Need to stop casting for HLS")
+			if hlsEnabled {
+				stopHlsCast <- STOP_SIGNAL_ERR
+				hlsEnabled = false
+			}
+		case errS := <-dashErrorSignal:
+			// Other outputs keep going. DASH writer is started again on the next reconnect or reconfiguration
+			log.Warn().Err(errS).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DASH_CAST).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("DASH casting has failed. Need to stop casting for DASH")
+			if dashEnabled {
+				stopDashCast <- STOP_SIGNAL_ERR
+				dashEnabled = false
+			}
 		}
 	}
 }
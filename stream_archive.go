@@ -8,4 +8,8 @@ type StreamArchiveWrapper struct {
 	bucket        string
 	bucketPath    string
 	msPerSegment  int64
+	index         *archiveIndex
+	retention     ArchiveRetentionPolicy
+	// Set once storage has reported that it can't tell disk usage
+	diskUsageUnsupported bool
 }
@@ -1,6 +1,9 @@
 package videoserver
 
 import (
+	"context"
+	"time"
+
 	"github.com/deepch/vdk/av"
 	"github.com/google/uuid"
 )
@@ -8,23 +11,65 @@ import (
 // StreamConfiguration is a configuration parameters for specific stream
 type StreamConfiguration struct {
 	URL                  string               `json:"url"`
+	URLs                 []string             `json:"urls"`
+	ActiveURL            string               `json:"active_url"`
+	SourceType           SourceType           `json:"source_type"`
 	Status               bool                 `json:"status"`
+	State                StreamState          `json:"state"`
+	StateSince           time.Time            `json:"state_since"`
 	SupportedOutputTypes []StreamType         `json:"supported_output_types"`
 	Codecs               []av.CodecData       `json:"codecs"`
+	VideoCodec           string               `json:"video_codec"`
+	ReconnectAttempts    int                  `json:"reconnect_attempts"`
+	NextRetryAt          *time.Time           `json:"next_retry_at,omitempty"`
+	OnDemand             bool                 `json:"on_demand"`
+	HLSSegmentFormat     HLSSegmentFormat     `json:"hls_segment_format"`
 	Clients              map[uuid.UUID]viewer `json:"-"`
-	hlsChanel            chan av.Packet
-	mp4Chanel            chan av.Packet
+	hlsChanel            chan streamPacket
+	dashChanel           chan streamPacket
+	mp4Chanel            chan streamPacket
 	verboseLevel         VerboseLevel
-	archive              *StreamArchiveWrapper
+	audioEnabled         bool
+	publishUser          string
+	publishPassword      string
+	reconnectPolicy      ReconnectPolicy
+	idleTimeout          time.Duration
+	lastDemandAt         time.Time
+	demand               chan struct{}
+	stateHistory         []StreamStateTransition
+	errors               []StreamError
+	// reconfigure wakes the runner up when outputs of the stream have been changed
+	reconfigure chan struct{}
+	// Runner's handles: cancel stops the runner, done is closed when runner exits
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	archive *StreamArchiveWrapper
+	// timeline is used by the runner only, so it is not guarded
+	timeline *timestampNormalizer
 }
 
 // NewStreamConfiguration returns default configuration
 func NewStreamConfiguration(streamURL string, supportedTypes []StreamType) *StreamConfiguration {
 	return &StreamConfiguration{
 		URL:                  streamURL,
+		URLs:                 []string{streamURL},
 		Clients:              make(map[uuid.UUID]viewer),
-		hlsChanel:            make(chan av.Packet, 100),
-		mp4Chanel:            make(chan av.Packet, 100),
+		hlsChanel:            make(chan streamPacket, 100),
+		dashChanel:           make(chan streamPacket, 100),
+		mp4Chanel:            make(chan streamPacket, 100),
+		timeline:             newTimestampNormalizer(),
+		demand:               make(chan struct{}, 1),
+		reconfigure:          make(chan struct{}, 1),
+		StateSince:           time.Now(),
 		SupportedOutputTypes: supportedTypes,
 	}
 }
+
+// requestDemand marks the stream as watched and wakes up on-demand stream if it waits for viewers
+func (stream *StreamConfiguration) requestDemand() {
+	stream.lastDemandAt = time.Now()
+	select {
+	case stream.demand <- struct{}{}:
+	default:
+	}
+}
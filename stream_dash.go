@@ -0,0 +1,29 @@
+package videoserver
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+func (app *Application) startDashCast(streamID uuid.UUID, stopCast chan StopSignal, errorSignal chan error, castWG *sync.WaitGroup) error {
+	app.Streams.Lock()
+	defer app.Streams.Unlock()
+	stream, ok := app.Streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	castWG.Add(1)
+	go func(id uuid.UUID, dashChanel chan streamPacket, stop chan StopSignal) {
+		defer castWG.Done()
+		err := app.startDash(id, dashChanel, stop)
+		if err == nil {
+			return
+		}
+		log.Error().Err(err).Str("scope", SCOPE_DASH).Str("event", EVENT_DASH_START_CAST).Str("stream_id", id.String()).Msg("Error on DASH cast start")
+		errorSignal <- err
+		drainCast(dashChanel, stop)
+	}(streamID, stream.dashChanel, stopCast)
+	return nil
+}
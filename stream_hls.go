@@ -1,23 +1,45 @@
 package videoserver
 
 import (
-	"github.com/deepch/vdk/av"
+	"sync"
+
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
-func (app *Application) startHlsCast(streamID uuid.UUID, stopCast chan StopSignal) error {
+func (app *Application) startHlsCast(streamID uuid.UUID, stopCast chan StopSignal, errorSignal chan error, castWG *sync.WaitGroup) error {
 	app.Streams.Lock()
 	defer app.Streams.Unlock()
 	stream, ok := app.Streams.store[streamID]
 	if !ok {
 		return ErrStreamNotFound
 	}
-	go func(id uuid.UUID, hlsChanel chan av.Packet, stop chan StopSignal) {
-		err := app.startHls(id, hlsChanel, stop)
-		if err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_START_CAST).Str("stream_id", id.String()).Msg("Error on HLS cast start")
+	castWG.Add(1)
+	go func(id uuid.UUID, hlsChanel chan streamPacket, stop chan StopSignal) {
+		defer castWG.Done()
+		var err error
+		if app.HLS.LowLatency {
+			err = app.startLLHls(id, hlsChanel, stop)
+		} else {
+			err = app.startHls(id, hlsChanel, stop)
+		}
+		if err == nil {
+			return
 		}
+		log.Error().Err(err).Str("scope", SCOPE_HLS).Str("event", EVENT_HLS_START_CAST).Str("stream_id", id.String()).Msg("Error on HLS cast start")
+		errorSignal <- err
+		drainCast(hlsChanel, stop)
 	}(streamID, stream.hlsChanel, stopCast)
 	return nil
 }
+
+// drainCast reads packets of the failed writer until it is stopped. Packets are still casted until the runner handles the error, so the channel must not block other outputs
+func drainCast(ch chan streamPacket, stop chan StopSignal) {
+	for {
+		select {
+		case <-ch:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package videoserver
 
 import (
-	"github.com/deepch/vdk/av"
+	"sync"
+
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
-func (app *Application) startMP4Cast(archive *StreamArchiveWrapper, streamID uuid.UUID, stopCast chan StopSignal, errorSignal chan error, streamVerboseLevel VerboseLevel) error {
+func (app *Application) startMP4Cast(archive *StreamArchiveWrapper, streamID uuid.UUID, stopCast chan StopSignal, errorSignal chan error, castWG *sync.WaitGroup, streamVerboseLevel VerboseLevel) error {
 	if archive == nil {
 		return ErrNullArchive
 	}
@@ -17,12 +18,16 @@ func (app *Application) startMP4Cast(archive *StreamArchiveWrapper, streamID uui
 		return ErrStreamNotFound
 	}
 	channel := stream.mp4Chanel
-	go func(arch *StreamArchiveWrapper, id uuid.UUID, mp4Chanel chan av.Packet, stop chan StopSignal, verbose VerboseLevel) {
+	castWG.Add(1)
+	go func(arch *StreamArchiveWrapper, id uuid.UUID, mp4Chanel chan streamPacket, stop chan StopSignal, verbose VerboseLevel) {
+		defer castWG.Done()
 		err := app.startMP4(arch, id, mp4Chanel, stop, verbose)
-		if err != nil {
-			log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_START_CAST).Str("stream_id", id.String()).Msg("Error on MP4 cast start")
+		if err == nil {
+			return
 		}
+		log.Error().Err(err).Str("scope", SCOPE_ARCHIVE).Str("event", EVENT_ARCHIVE_START_CAST).Str("stream_id", id.String()).Msg("Error on MP4 cast start")
 		errorSignal <- err
+		drainCast(mp4Chanel, stop)
 	}(archive, streamID, channel, stopCast, streamVerboseLevel)
 	return nil
 }
@@ -0,0 +1,98 @@
+package videoserver
+
+import (
+	"time"
+)
+
+type StreamState uint16
+
+const (
+	STREAM_STATE_IDLE = StreamState(iota)
+	STREAM_STATE_DIALING
+	STREAM_STATE_ONLINE
+	STREAM_STATE_NO_VIDEO
+	STREAM_STATE_RECONNECTING
+	STREAM_STATE_FAILED
+	STREAM_STATE_STOPPED
+)
+
+func (iotaIdx StreamState) String() string {
+	return [...]string{"idle", "dialing", "online", "no_video", "reconnecting", "failed", "stopped"}[iotaIdx]
+}
+
+// MarshalJSON returns name of the stream state
+func (iotaIdx StreamState) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + iotaIdx.String() + `"`), nil
+}
+
+const (
+	// stateHistorySize is max number of transitions kept for every stream
+	stateHistorySize = 50
+	// errorsHistorySize is max number of errors kept for every stream
+	errorsHistorySize = 10
+)
+
+// StreamStateTransition is a single change of the stream state
+type StreamStateTransition struct {
+	From   StreamState `json:"from"`
+	To     StreamState `json:"to"`
+	At     time.Time   `json:"at"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// StreamError is an error which has been met by the stream runner
+type StreamError struct {
+	At    time.Time   `json:"at"`
+	State StreamState `json:"state"`
+	Error string      `json:"error"`
+}
+
+// StreamLifecycle is a snapshot of the stream state with its history
+type StreamLifecycle struct {
+	StreamID          string                  `json:"stream_id"`
+	State             StreamState             `json:"state"`
+	StateSince        time.Time               `json:"state_since"`
+	Status            bool                    `json:"status"`
+	ActiveURL         string                  `json:"active_url"`
+	ReconnectAttempts int                     `json:"reconnect_attempts"`
+	NextRetryAt       *time.Time              `json:"next_retry_at,omitempty"`
+	History           []StreamStateTransition `json:"history"`
+	Errors            []StreamError           `json:"errors"`
+}
+
+// setState moves the stream into new state. Transition into the same state is recorded only if there is a reason for it
+func (stream *StreamConfiguration) setState(state StreamState, reason string) bool {
+	if stream.State == state && reason == "" {
+		return false
+	}
+	now := time.Now()
+	stream.stateHistory = appendBounded(stream.stateHistory, StreamStateTransition{
+		From:   stream.State,
+		To:     state,
+		At:     now,
+		Reason: reason,
+	}, stateHistorySize)
+	if stream.State != state {
+		stream.StateSince = now
+	}
+	stream.State = state
+	return true
+}
+
+// addError remembers error for the stream
+func (stream *StreamConfiguration) addError(err error) {
+	stream.errors = appendBounded(stream.errors, StreamError{
+		At:    time.Now(),
+		State: stream.State,
+		Error: err.Error(),
+	}, errorsHistorySize)
+}
+
+// appendBounded appends item to the list and drops the oldest items if list exceeds the size
+func appendBounded[T any](list []T, item T, size int) []T {
+	list = append(list, item)
+	if len(list) > size {
+		list = append(list[:0], list[len(list)-size:]...)
+	}
+	return list
+}
@@ -9,21 +9,31 @@ const (
 	STREAM_TYPE_RTSP
 	STREAM_TYPE_HLS
 	STREAM_TYPE_MSE
+	STREAM_TYPE_WEBRTC
+	STREAM_TYPE_DASH
+	STREAM_TYPE_FLV
 )
 
 func (iotaIdx StreamType) String() string {
-	return [...]string{"undefined", "rtsp", "hls", "mse"}[iotaIdx]
+	return [...]string{"undefined", "rtsp", "hls", "mse", "webrtc", "dash", "flv"}[iotaIdx]
 }
 
 var (
 	supportedOutputStreamTypes = map[StreamType]struct{}{
-		STREAM_TYPE_HLS: {},
-		STREAM_TYPE_MSE: {},
+		STREAM_TYPE_RTSP:   {},
+		STREAM_TYPE_HLS:    {},
+		STREAM_TYPE_MSE:    {},
+		STREAM_TYPE_WEBRTC: {},
+		STREAM_TYPE_DASH:   {},
+		STREAM_TYPE_FLV:    {},
 	}
 	supportedStreamTypes = map[string]StreamType{
-		"rtsp": STREAM_TYPE_RTSP,
-		"hls":  STREAM_TYPE_HLS,
-		"mse":  STREAM_TYPE_MSE,
+		"rtsp":   STREAM_TYPE_RTSP,
+		"hls":    STREAM_TYPE_HLS,
+		"mse":    STREAM_TYPE_MSE,
+		"webrtc": STREAM_TYPE_WEBRTC,
+		"dash":   STREAM_TYPE_DASH,
+		"flv":    STREAM_TYPE_FLV,
 	}
 )
 
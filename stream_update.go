@@ -0,0 +1,180 @@
+package videoserver
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// StreamUpdate is a new configuration of the existing stream
+type StreamUpdate struct {
+	URLs        []string
+	SourceType  SourceType
+	OutputTypes []StreamType
+	Audio       bool
+	OnDemand    bool
+	IdleTimeout time.Duration
+	// HLS writer is restarted along with the source when segment format has been changed
+	HLSSegmentFormat HLSSegmentFormat
+	PublishUser      string
+	PublishPassword  string
+}
+
+// StreamUpdateResult describes what has been changed and restarted by the stream update
+type StreamUpdateResult struct {
+	StreamID        string   `json:"stream_id"`
+	Changed         []string `json:"changed"`
+	SourceRestarted bool     `json:"source_restarted"`
+	HLSStarted      bool     `json:"hls_started"`
+	HLSStopped      bool     `json:"hls_stopped"`
+	DASHStarted     bool     `json:"dash_started"`
+	DASHStopped     bool     `json:"dash_stopped"`
+	MSEStopped      bool     `json:"mse_stopped"`
+	RTSPStopped     bool     `json:"rtsp_stopped"`
+	WebRTCStopped   bool     `json:"webrtc_stopped"`
+	FLVStopped      bool     `json:"flv_stopped"`
+}
+
+// UpdateStream applies new configuration to the existing stream. Only affected parts are restarted:
+// source is reconnected on source changes, HLS and DASH writers are started or stopped on output types changes
+func (app *Application) UpdateStream(streamID uuid.UUID, update StreamUpdate) (StreamUpdateResult, error) {
+	result := StreamUpdateResult{
+		StreamID: streamID.String(),
+		Changed:  []string{},
+	}
+	app.Streams.Lock()
+	stream, ok := app.Streams.store[streamID]
+	if !ok {
+		app.Streams.Unlock()
+		return result, ErrStreamNotFound
+	}
+	if stream.archive != nil && update.OnDemand {
+		app.Streams.Unlock()
+		return result, errors.Wrap(ErrOnDemandWithArchive, "Can't update stream")
+	}
+	restartSource := false
+	if !equalStrings(stream.URLs, update.URLs) {
+		result.Changed = append(result.Changed, "urls")
+		restartSource = true
+	}
+	if stream.SourceType != update.SourceType {
+		result.Changed = append(result.Changed, "type")
+		restartSource = true
+	}
+	if stream.audioEnabled != update.Audio {
+		result.Changed = append(result.Changed, "audio")
+		restartSource = true
+	}
+	if stream.OnDemand != update.OnDemand || (update.OnDemand && stream.idleTimeout != update.IdleTimeout) {
+		result.Changed = append(result.Changed, "on_demand")
+		restartSource = true
+	}
+	if stream.HLSSegmentFormat != update.HLSSegmentFormat {
+		result.Changed = append(result.Changed, "hls")
+		if typeExists(STREAM_TYPE_HLS, update.OutputTypes) {
+			restartSource = true
+		}
+	}
+	if stream.publishUser != update.PublishUser || stream.publishPassword != update.PublishPassword {
+		// Affects only the next publishers
+		result.Changed = append(result.Changed, "publish")
+	}
+	hlsWas, hlsNow := typeExists(STREAM_TYPE_HLS, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_HLS, update.OutputTypes)
+	mseWas, mseNow := typeExists(STREAM_TYPE_MSE, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_MSE, update.OutputTypes)
+	rtspWas, rtspNow := typeExists(STREAM_TYPE_RTSP, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_RTSP, update.OutputTypes)
+	dashWas, dashNow := typeExists(STREAM_TYPE_DASH, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_DASH, update.OutputTypes)
+	webrtcWas, webrtcNow := typeExists(STREAM_TYPE_WEBRTC, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_WEBRTC, update.OutputTypes)
+	flvWas, flvNow := typeExists(STREAM_TYPE_FLV, stream.SupportedOutputTypes), typeExists(STREAM_TYPE_FLV, update.OutputTypes)
+	outputsChanged := !equalStreamTypes(stream.SupportedOutputTypes, update.OutputTypes)
+	if outputsChanged {
+		result.Changed = append(result.Changed, "output_types")
+	}
+
+	stream.URL = update.URLs[0]
+	stream.URLs = update.URLs
+	stream.SourceType = update.SourceType
+	stream.audioEnabled = update.Audio
+	stream.OnDemand = update.OnDemand
+	stream.idleTimeout = update.IdleTimeout
+	stream.HLSSegmentFormat = update.HLSSegmentFormat
+	stream.publishUser = update.PublishUser
+	stream.publishPassword = update.PublishPassword
+	stream.SupportedOutputTypes = update.OutputTypes
+	verboseLevel := stream.verboseLevel
+	reconfigure := stream.reconfigure
+	app.Streams.Unlock()
+
+	if verboseLevel > VERBOSE_NONE {
+		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_UPDATE).Str("stream_id", streamID.String()).Strs("changed", result.Changed).Msg("Stream has been updated")
+	}
+
+	if mseWas && !mseNow {
+		app.Streams.DisconnectViewersOfType(streamID, STREAM_TYPE_MSE, "MSE output has been disabled")
+		result.MSEStopped = true
+	}
+	if rtspWas && !rtspNow {
+		app.Streams.DisconnectViewersOfType(streamID, STREAM_TYPE_RTSP, "RTSP output has been disabled")
+		result.RTSPStopped = true
+	}
+	if webrtcWas && !webrtcNow {
+		app.Streams.DisconnectViewersOfType(streamID, STREAM_TYPE_WEBRTC, "WebRTC output has been disabled")
+		result.WebRTCStopped = true
+	}
+	if flvWas && !flvNow {
+		app.Streams.DisconnectViewersOfType(streamID, STREAM_TYPE_FLV, "FLV output has been disabled")
+		result.FLVStopped = true
+	}
+	if restartSource {
+		// Runner picks up the new outputs on restart too
+		err := app.RestartStream(streamID)
+		if err != nil {
+			return result, errors.Wrap(err, "Can't restart stream")
+		}
+		result.SourceRestarted = true
+		result.HLSStarted = !hlsWas && hlsNow
+		result.HLSStopped = hlsWas && !hlsNow
+		result.DASHStarted = !dashWas && dashNow
+		result.DASHStopped = dashWas && !dashNow
+		return result, nil
+	}
+	if hlsWas != hlsNow || dashWas != dashNow {
+		select {
+		case reconfigure <- struct{}{}:
+		default:
+		}
+		result.HLSStarted = !hlsWas && hlsNow
+		result.HLSStopped = hlsWas && !hlsNow
+		result.DASHStarted = !dashWas && dashNow
+		result.DASHStopped = dashWas && !dashNow
+	}
+	return result, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalStreamTypes compares sets of stream types
+func equalStreamTypes(a, b []StreamType) bool {
+	for _, typ := range a {
+		if !typeExists(typ, b) {
+			return false
+		}
+	}
+	for _, typ := range b {
+		if !typeExists(typ, a) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,8 @@ package videoserver
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,7 +12,8 @@ import (
 )
 
 const (
-	restartStreamDuration = 5 * time.Second
+	// streamStopTimeout is how long StopStream waits for outputs to be flushed
+	streamStopTimeout = 30 * time.Second
 )
 
 // StartStreams starts all video streams
@@ -21,53 +24,249 @@ func (app *Application) StartStreams() {
 	}
 }
 
-// StartStream starts single video stream
+// StartStream starts single video stream. Stream keeps running until StopStream is called
 func (app *Application) StartStream(streamID uuid.UUID) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	done := make(chan struct{})
+	err := app.Streams.attachRunner(streamID, cancel, done)
+	if err != nil {
+		cancel(nil)
+		log.Error().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RUN).Str("stream_id", streamID.String()).Msg("Can't start stream runner")
+		return
+	}
 	go func(id uuid.UUID) {
-		err := app.RunStream(context.Background(), id)
+		defer close(done)
+		defer cancel(nil)
+		err := app.RunStream(ctx, id)
 		if err != nil {
 			log.Error().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RUN).Str("stream_id", id.String()).Msg("Error on stream runner")
 		}
 	}(streamID)
 }
 
+// StopStream stops runner of the given stream (source, HLS and MP4 outputs) and disconnects its viewers with the given reason
+func (app *Application) StopStream(streamID uuid.UUID, reason string) error {
+	err := app.stopRunner(streamID, nil)
+	if err != nil {
+		return err
+	}
+	app.Streams.DisconnectViewers(streamID, reason)
+	if app.Streams.GetVerboseLevelForStream(streamID) > VERBOSE_NONE {
+		log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_STOP).Str("stream_id", streamID.String()).Str("reason", reason).Msg("Stream has been stopped")
+	}
+	return nil
+}
+
+// RestartStream restarts runner of the given stream (e.g. after source has been changed). Viewers stay attached and HLS playlist is not finalized
+func (app *Application) RestartStream(streamID uuid.UUID) error {
+	err := app.stopRunner(streamID, ErrStreamRestart)
+	if err != nil {
+		return err
+	}
+	app.StartStream(streamID)
+	return nil
+}
+
+// stopRunner cancels runner of the given stream with the given cause and waits until it exits
+func (app *Application) stopRunner(streamID uuid.UUID, cause error) error {
+	cancel, done, err := app.Streams.detachRunner(streamID)
+	if err != nil {
+		return err
+	}
+	if cancel == nil {
+		return nil
+	}
+	cancel(cause)
+	select {
+	case <-done:
+	case <-time.After(streamStopTimeout):
+		log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_STOP).Str("stream_id", streamID.String()).Dur("timeout", streamStopTimeout).Msg("Stream runner has not been stopped in time")
+	}
+	return nil
+}
+
+// DeleteStream stops the given stream and removes it from the storage
+func (app *Application) DeleteStream(streamID uuid.UUID, reason string) error {
+	err := app.StopStream(streamID, reason)
+	if err != nil {
+		return err
+	}
+	app.Streams.Lock()
+	delete(app.Streams.store, streamID)
+	app.Streams.Unlock()
+	return nil
+}
+
+// StopStreams stops every stream (e.g. on shutdown)
+func (app *Application) StopStreams(reason string) {
+	streamsIDs := app.Streams.GetAllStreamsIDS()
+	var wg sync.WaitGroup
+	for i := range streamsIDs {
+		wg.Add(1)
+		go func(id uuid.UUID) {
+			defer wg.Done()
+			app.StopStream(id, reason)
+		}(streamsIDs[i])
+	}
+	wg.Wait()
+}
+
 func (app *Application) RunStream(ctx context.Context, streamID uuid.UUID) error {
-	url, supportedTypes := app.Streams.GetStreamInfo(streamID)
-	if url == "" {
+	if !app.Streams.StreamExists(streamID) {
 		return ErrStreamNotFound
 	}
+	_, supportedTypes := app.Streams.GetStreamInfo(streamID)
+	urls, err := app.Streams.GetSourceURLsForStream(streamID)
+	if err != nil {
+		return errors.Wrap(err, "Can't get source URLs")
+	}
 	hlsEnabled := typeExists(STREAM_TYPE_HLS, supportedTypes)
 	archiveEnabled, err := app.Streams.IsArchiveEnabledForStream(streamID)
 	if err != nil {
 		return errors.Wrap(err, "Can't enable archive")
 	}
+	audioEnabled, err := app.Streams.IsAudioEnabledForStream(streamID)
+	if err != nil {
+		return errors.Wrap(err, "Can't enable audio")
+	}
+	sourceType, err := app.Streams.GetSourceTypeForStream(streamID)
+	if err != nil {
+		return errors.Wrap(err, "Can't get source type")
+	}
+	reconnectPolicy, err := app.Streams.GetReconnectPolicyForStream(streamID)
+	if err != nil {
+		return errors.Wrap(err, "Can't get reconnect policy")
+	}
+	onDemand, _, err := app.Streams.GetOnDemandForStream(streamID)
+	if err != nil {
+		return errors.Wrap(err, "Can't get on-demand mode")
+	}
 	streamVerboseLevel := app.Streams.GetVerboseLevelForStream(streamID)
-	app.startLoop(ctx, streamID, url, hlsEnabled, archiveEnabled, streamVerboseLevel)
+	app.startLoop(ctx, streamID, urls, sourceType, reconnectPolicy, onDemand, hlsEnabled, archiveEnabled, audioEnabled, streamVerboseLevel)
 	return nil
 }
 
-// startLoop starts stream loop with dialing to certain RTSP
-func (app *Application) startLoop(ctx context.Context, streamID uuid.UUID, url string, hlsEnabled, archiveEnabled bool, streamVerboseLevel VerboseLevel) {
+// startLoop starts stream loop with dialing to certain source. Reconnects are delayed according to the policy.
+// If there are backup URLs, stream fails over to the next one when dialing fails or source has no video, and fails back to the primary one once it is healthy again.
+// On-demand stream dials the source only while there are viewers
+func (app *Application) startLoop(ctx context.Context, streamID uuid.UUID, urls []string, sourceType SourceType, reconnectPolicy ReconnectPolicy, onDemand, hlsEnabled, archiveEnabled, audioEnabled bool, streamVerboseLevel VerboseLevel) {
+	// Pushed streams do not dial anything, so there is nothing to fail over to
+	failoverEnabled := len(urls) > 1 && sourceType != SOURCE_TYPE_RTSP_PUSH
+	urlIdx := 0
+	var demand <-chan struct{}
+	if onDemand {
+		var err error
+		demand, err = app.Streams.GetDemandSignalForStream(streamID)
+		if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DEMAND).Str("stream_id", streamID.String()).Msg("Can't get demand signal")
+			return
+		}
+	}
 	for {
+		url := urls[urlIdx]
+		failedOver := false
 		select {
 		case <-ctx.Done():
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_STOPPED, "")
 			if streamVerboseLevel > VERBOSE_NONE {
 				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DONE).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream is done")
 			}
 			return
 		default:
+			if onDemand && !app.waitDemand(ctx, streamID, demand, streamVerboseLevel) {
+				continue
+			}
 			if streamVerboseLevel > VERBOSE_NONE {
-				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_START).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream must be establishment")
+				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_START).Str("stream_id", streamID.String()).Str("stream_url", url).Str("source_type", sourceType.String()).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Bool("audio_enabled", audioEnabled).Msg("Stream must be establishment")
+			}
+			// Outputs could be changed at runtime
+			hlsEnabled = app.Streams.TypeExistsForStream(streamID, STREAM_TYPE_HLS)
+			app.Streams.UpdateNextRetryForStream(streamID, time.Time{})
+			app.Streams.UpdateActiveURLForStream(streamID, url)
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_DIALING, url)
+			var failback, idle <-chan struct{}
+			watchCtx, cancelWatch := context.WithCancel(ctx)
+			if failoverEnabled && urlIdx != 0 {
+				failback = app.probeSource(watchCtx, streamID, urls[0], sourceType, reconnectPolicy, audioEnabled, streamVerboseLevel)
+			}
+			if onDemand {
+				idle = app.watchIdle(watchCtx, streamID)
+			}
+			err := app.runStream(ctx, streamID, url, sourceType, reconnectPolicy, failback, idle, hlsEnabled, archiveEnabled, audioEnabled, streamVerboseLevel)
+			cancelWatch()
+			if ctx.Err() != nil {
+				app.Streams.UpdateStreamStatus(streamID, false)
+				app.Streams.UpdateStateForStream(streamID, STREAM_STATE_STOPPED, "")
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DONE).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream is done")
+				}
+				return
+			}
+			if errors.Is(err, ErrStreamIdle) {
+				// Next viewer should get fresh codecs and the primary source
+				app.Streams.UpdateStreamStatus(streamID, false)
+				app.Streams.AddCodecForStream(streamID, nil)
+				app.Streams.ResetReconnectAttempts(streamID)
+				app.Streams.UpdateStateForStream(streamID, STREAM_STATE_IDLE, "no viewers")
+				urlIdx = 0
+				continue
+			}
+			if errors.Is(err, ErrStreamFailback) {
+				if streamVerboseLevel > VERBOSE_NONE {
+					log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_FAILBACK).Str("stream_id", streamID.String()).Str("stream_url", url).Str("primary_url", urls[0]).Msg("Failing back to the primary source")
+				}
+				app.Streams.UpdateStateForStream(streamID, STREAM_STATE_RECONNECTING, "failing back to the primary source")
+				urlIdx = 0
+				continue
+			}
+			if errors.Is(err, ErrNoPublisher) {
+				// Waiting for a publisher is not a failure: pushed stream goes back to waiting at once and never runs out of attempts
+				app.Streams.ResetReconnectAttempts(streamID)
+				app.Streams.UpdateStateForStream(streamID, STREAM_STATE_IDLE, "waiting for publisher")
+				continue
 			}
-			err := app.runStream(streamID, url, hlsEnabled, archiveEnabled, streamVerboseLevel)
 			if err != nil {
+				app.Streams.AddErrorForStream(streamID, err)
 				log.Error().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RESTART).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Can't start stream")
 			}
+			if failoverEnabled && (errors.Is(err, ErrStreamDial) || errors.Is(err, ErrStreamHasNoVideo)) {
+				urlIdx = (urlIdx + 1) % len(urls)
+				failedOver = urlIdx != 0
+				log.Warn().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_FAILOVER).Str("stream_id", streamID.String()).Str("stream_url", url).Str("next_url", urls[urlIdx]).Msg("Failing over to the next source")
+			}
+		}
+		attempt, err := app.Streams.IncreaseReconnectAttempts(streamID)
+		if err != nil {
+			log.Error().Err(err).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RESTART).Str("stream_id", streamID.String()).Str("stream_url", url).Msg("Can't update reconnect attempts")
+			return
+		}
+		if reconnectPolicy.AttemptsExceeded(attempt) {
+			log.Error().Err(ErrReconnectAttemptsExceeded).Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RESTART).Str("stream_id", streamID.String()).Str("stream_url", url).Int("max_attempts", reconnectPolicy.MaxAttempts).Msg("Stream is stopped")
+			app.Streams.UpdateStreamStatus(streamID, false)
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_FAILED, ErrReconnectAttemptsExceeded.Error())
+			return
+		}
+		if failedOver {
+			// Backup source is tried at once. Delay is applied only after every source has failed
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_RECONNECTING, "failing over to "+urls[urlIdx])
+			continue
+		}
+		delay := reconnectPolicy.Delay(attempt)
+		app.Streams.UpdateNextRetryForStream(streamID, time.Now().Add(delay))
+		app.Streams.UpdateStateForStream(streamID, STREAM_STATE_RECONNECTING, fmt.Sprintf("attempt %d in %s", attempt, delay.Round(time.Millisecond)))
+		if streamVerboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RESTART).Str("stream_id", streamID.String()).Str("stream_url", url).Int("attempt", attempt).Dur("restart_duration", delay).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream must be re-establishment")
+		}
+		select {
+		case <-ctx.Done():
+			app.Streams.UpdateNextRetryForStream(streamID, time.Time{})
+			app.Streams.UpdateStateForStream(streamID, STREAM_STATE_STOPPED, "")
 			if streamVerboseLevel > VERBOSE_NONE {
-				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_RESTART).Str("stream_id", streamID.String()).Str("stream_url", url).Dur("restart_duration", restartStreamDuration).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream must be re-establishment")
+				log.Info().Str("scope", SCOPE_STREAMING).Str("event", EVENT_STREAMING_DONE).Str("stream_id", streamID.String()).Str("stream_url", url).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", archiveEnabled).Msg("Stream is done")
 			}
+			return
+		case <-time.After(delay):
 		}
-		time.Sleep(restartStreamDuration)
 	}
 }
 
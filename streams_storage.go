@@ -1,12 +1,16 @@
 package videoserver
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
@@ -22,6 +26,13 @@ func NewStreamsStorageDefault() StreamsStorage {
 	return StreamsStorage{store: make(map[uuid.UUID]*StreamConfiguration)}
 }
 
+// MarshalJSON returns JSON representation of every stream in storage
+func (streams *StreamsStorage) MarshalJSON() ([]byte, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	return json.Marshal(streams.store)
+}
+
 // GetStreamInfo returns stream URL and its supported output types
 func (streams *StreamsStorage) GetStreamInfo(streamID uuid.UUID) (string, []StreamType) {
 	streams.Lock()
@@ -65,7 +76,7 @@ func (streams *StreamsStorage) TypeExistsForStream(streamID uuid.UUID, streamTyp
 	return ok && typeEnabled
 }
 
-// AddCodecForStream appends new codecs data for the given stream
+// AddCodecForStream appends new codecs data for the given stream and notifies viewers about it
 func (streams *StreamsStorage) AddCodecForStream(streamID uuid.UUID, codecs []av.CodecData) error {
 	streams.Lock()
 	defer streams.Unlock()
@@ -74,9 +85,17 @@ func (streams *StreamsStorage) AddCodecForStream(streamID uuid.UUID, codecs []av
 		return ErrStreamNotFound
 	}
 	stream.Codecs = codecs
+	stream.VideoCodec = videoCodecName(codecs)
 	if stream.verboseLevel > VERBOSE_SIMPLE {
 		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CODEC_ADD).Str("stream_id", streamID.String()).Any("codec_data", codecs).Msg("Add codec")
 	}
+	if len(codecs) == 0 {
+		return nil
+	}
+	// Viewers have to re-initialize their muxers: codecs or timeline could be changed
+	for _, client := range stream.Clients {
+		client.notifyCodecs()
+	}
 	return nil
 }
 
@@ -91,9 +110,14 @@ func (streams *StreamsStorage) GetCodecsDataForStream(streamID uuid.UUID) ([]av.
 	codecs := make([]av.CodecData, len(stream.Codecs))
 	for i, iface := range stream.Codecs {
 		switch codecType := iface.(type) {
-		case aacparser.CodecData, h264parser.CodecData:
+		case aacparser.CodecData, h264parser.CodecData, h265parser.CodecData:
 			codecs[i] = codecType
 		default:
+			if iface.Type().IsAudio() {
+				// Audio codecs (G.711, Opus and etc.) are passed as is. Every output decides on its own whether it can hold it
+				codecs[i] = iface
+				continue
+			}
 			return nil, fmt.Errorf("unknown codec type: %T", iface)
 		}
 	}
@@ -115,24 +139,95 @@ func (streams *StreamsStorage) UpdateStreamStatus(streamID uuid.UUID, status boo
 	return nil
 }
 
-// AddViewer adds client to the given stream. Return newly client ID, buffered channel for stream on success
-func (streams *StreamsStorage) AddViewer(streamID uuid.UUID) (uuid.UUID, chan av.Packet, error) {
+// UpdateStateForStream moves the given stream into new state
+func (streams *StreamsStorage) UpdateStateForStream(streamID uuid.UUID, state StreamState, reason string) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	prevState := stream.State
+	if stream.setState(state, reason) && stream.verboseLevel > VERBOSE_SIMPLE {
+		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_STATE_UPDATE).Str("stream_id", streamID.String()).Str("from", prevState.String()).Str("to", state.String()).Str("reason", reason).Msg("State update")
+	}
+	return nil
+}
+
+// AddErrorForStream remembers error which has been met by the given stream
+func (streams *StreamsStorage) AddErrorForStream(streamID uuid.UUID, err error) error {
 	streams.Lock()
 	defer streams.Unlock()
 	stream, ok := streams.store[streamID]
 	if !ok {
-		return uuid.UUID{}, nil, ErrStreamNotFound
+		return ErrStreamNotFound
+	}
+	stream.addError(err)
+	return nil
+}
+
+// IsReconnectingStream checks if the source of the given stream is temporary lost and runner tries to bring it back
+func (streams *StreamsStorage) IsReconnectingStream(streamID uuid.UUID) bool {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return false
+	}
+	switch stream.State {
+	case STREAM_STATE_DIALING, STREAM_STATE_NO_VIDEO, STREAM_STATE_RECONNECTING:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetLifecycleForStream returns COPY of the state, transitions history and last errors for the given stream
+func (streams *StreamsStorage) GetLifecycleForStream(streamID uuid.UUID) (StreamLifecycle, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return StreamLifecycle{}, ErrStreamNotFound
+	}
+	lifecycle := StreamLifecycle{
+		StreamID:          streamID.String(),
+		State:             stream.State,
+		StateSince:        stream.StateSince,
+		Status:            stream.Status,
+		ActiveURL:         stream.ActiveURL,
+		ReconnectAttempts: stream.ReconnectAttempts,
+		History:           make([]StreamStateTransition, len(stream.stateHistory)),
+		Errors:            make([]StreamError, len(stream.errors)),
+	}
+	if stream.NextRetryAt != nil {
+		nextRetry := *stream.NextRetryAt
+		lifecycle.NextRetryAt = &nextRetry
+	}
+	copy(lifecycle.History, stream.stateHistory)
+	copy(lifecycle.Errors, stream.errors)
+	return lifecycle, nil
+}
+
+// AddViewer adds client to the given stream. Return newly client ID, viewer with buffered channel for stream on success
+func (streams *StreamsStorage) AddViewer(streamID uuid.UUID, kind StreamType) (uuid.UUID, viewer, error) {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return uuid.UUID{}, viewer{}, ErrStreamNotFound
 	}
 	clientID, err := uuid.NewUUID()
 	if err != nil {
-		return uuid.UUID{}, nil, err
+		return uuid.UUID{}, viewer{}, err
 	}
 	if stream.verboseLevel > VERBOSE_SIMPLE {
 		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CLIENT_ADD).Str("stream_id", streamID.String()).Str("client_id", clientID.String()).Msg("Add client")
 	}
-	ch := make(chan av.Packet, 100)
-	stream.Clients[clientID] = viewer{c: ch}
-	return clientID, ch, nil
+	client := newViewer(kind)
+	stream.Clients[clientID] = client
+	stream.requestDemand()
+	return clientID, client, nil
 }
 
 // DeleteViewer removes given client from the stream
@@ -147,10 +242,103 @@ func (streams *StreamsStorage) DeleteViewer(streamID, clientID uuid.UUID) {
 		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CLIENT_DELETE).Str("stream_id", streamID.String()).Str("client_id", clientID.String()).Msg("Delete client")
 	}
 	delete(stream.Clients, clientID)
+	// Idle period of on-demand stream starts when the last viewer leaves
+	stream.lastDemandAt = time.Now()
+}
+
+// DisconnectViewers asks every client of the given stream to leave it with the given reason
+func (streams *StreamsStorage) DisconnectViewers(streamID uuid.UUID, reason string) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return
+	}
+	for clientID, client := range stream.Clients {
+		if stream.verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CLIENT_KICK).Str("stream_id", streamID.String()).Str("client_id", clientID.String()).Str("reason", reason).Msg("Disconnect client")
+		}
+		client.kick(reason)
+	}
 }
 
-// CastPacket cast AV Packet to viewers and possible to HLS/MP4 channels
-func (streams *StreamsStorage) CastPacket(streamID uuid.UUID, pck av.Packet, hlsEnabled, archiveEnabled bool) error {
+// DisconnectViewersOfType asks clients of the given stream which have been connected through the given output to leave it
+func (streams *StreamsStorage) DisconnectViewersOfType(streamID uuid.UUID, kind StreamType, reason string) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return
+	}
+	for clientID, client := range stream.Clients {
+		if client.kind != kind {
+			continue
+		}
+		if stream.verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CLIENT_KICK).Str("stream_id", streamID.String()).Str("client_id", clientID.String()).Str("reason", reason).Msg("Disconnect client")
+		}
+		client.kick(reason)
+	}
+}
+
+// GetTimelineForStream returns timestamps normalizer of the given stream
+func (streams *StreamsStorage) GetTimelineForStream(streamID uuid.UUID) (*timestampNormalizer, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	return stream.timeline, nil
+}
+
+// GetReconfigureSignalForStream returns channel which receives signal when outputs of the given stream have been changed
+func (streams *StreamsStorage) GetReconfigureSignalForStream(streamID uuid.UUID) (<-chan struct{}, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	return stream.reconfigure, nil
+}
+
+// attachRunner remembers handles of the stream's runner. Stream can't have two runners at once
+func (streams *StreamsStorage) attachRunner(streamID uuid.UUID, cancel context.CancelCauseFunc, done chan struct{}) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	if stream.done != nil {
+		select {
+		case <-stream.done:
+		default:
+			return ErrStreamIsRunning
+		}
+	}
+	stream.cancel = cancel
+	stream.done = done
+	return nil
+}
+
+// detachRunner returns and forgets handles of the stream's runner. Handles are nil if stream has not been started
+func (streams *StreamsStorage) detachRunner(streamID uuid.UUID) (context.CancelCauseFunc, chan struct{}, error) {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return nil, nil, ErrStreamNotFound
+	}
+	cancel, done := stream.cancel, stream.done
+	stream.cancel = nil
+	stream.done = nil
+	return cancel, done, nil
+}
+
+// CastPacket cast AV Packet to viewers and possible to HLS/DASH/MP4 channels
+func (streams *StreamsStorage) CastPacket(streamID uuid.UUID, pck streamPacket, hlsEnabled, dashEnabled, archiveEnabled bool) error {
 	streams.Lock()
 	stream, ok := streams.store[streamID]
 	if !ok {
@@ -167,6 +355,12 @@ func (streams *StreamsStorage) CastPacket(streamID uuid.UUID, pck av.Packet, hls
 		}
 		stream.hlsChanel <- pck
 	}
+	if dashEnabled {
+		if stream.verboseLevel > VERBOSE_ADD {
+			log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CAST_PACKET).Str("stream_id", streamID.String()).Bool("dash_enabled", dashEnabled).Int("clients_num", len(stream.Clients)).Msg("Cast packet to DASH")
+		}
+		stream.dashChanel <- pck
+	}
 	if archiveEnabled {
 		if stream.verboseLevel > VERBOSE_ADD {
 			log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CAST_PACKET).Str("stream_id", streamID.String()).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", stream.archive != nil).Int("clients_num", len(stream.Clients)).Msg("Cast packet to MP4")
@@ -176,11 +370,14 @@ func (streams *StreamsStorage) CastPacket(streamID uuid.UUID, pck av.Packet, hls
 	if stream.verboseLevel > VERBOSE_ADD {
 		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CAST_PACKET).Str("stream_id", streamID.String()).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", stream.archive != nil).Int("clients_num", len(stream.Clients)).Msg("Cast packet to viewers")
 	}
+	// Sends to viewers never block, so clients could be iterated under lock
+	streams.RLock()
 	for _, v := range stream.Clients {
 		if len(v.c) < cap(v.c) {
 			v.c <- pck
 		}
 	}
+	streams.RUnlock()
 	if stream.verboseLevel > VERBOSE_ADD {
 		log.Info().Str("scope", SCOPE_STREAM).Str("event", EVENT_STREAM_CAST_PACKET).Str("stream_id", streamID.String()).Bool("hls_enabled", hlsEnabled).Bool("archive_enabled", stream.archive != nil).Int("clients_num", len(stream.Clients)).Msg("Done casting")
 	}
@@ -209,6 +406,171 @@ func (streams *StreamsStorage) IsArchiveEnabledForStream(streamID uuid.UUID) (bo
 	return stream.archive != nil, nil
 }
 
+// IsAudioEnabledForStream returns whenever audio passthrough has been enabled for stream
+func (streams *StreamsStorage) IsAudioEnabledForStream(streamID uuid.UUID) (bool, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return false, ErrStreamNotFound
+	}
+	return stream.audioEnabled, nil
+}
+
+// GetHLSSegmentFormatForStream returns container of HLS segments for the given stream
+func (streams *StreamsStorage) GetHLSSegmentFormatForStream(streamID uuid.UUID) (HLSSegmentFormat, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return HLS_SEGMENT_FORMAT_TS, ErrStreamNotFound
+	}
+	return stream.HLSSegmentFormat, nil
+}
+
+// GetSourceTypeForStream returns type of the source for the given stream
+func (streams *StreamsStorage) GetSourceTypeForStream(streamID uuid.UUID) (SourceType, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return SOURCE_TYPE_UNDEFINED, ErrStreamNotFound
+	}
+	return stream.SourceType, nil
+}
+
+// GetPublishCredentialsForStream returns credentials for publishers of the given stream and type of its source
+func (streams *StreamsStorage) GetPublishCredentialsForStream(streamID uuid.UUID) (string, string, SourceType, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return "", "", SOURCE_TYPE_UNDEFINED, ErrStreamNotFound
+	}
+	return stream.publishUser, stream.publishPassword, stream.SourceType, nil
+}
+
+// GetSourceURLsForStream returns ordered list of source URLs for the given stream. The first one is the primary
+func (streams *StreamsStorage) GetSourceURLsForStream(streamID uuid.UUID) ([]string, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	urls := make([]string, len(stream.URLs))
+	copy(urls, stream.URLs)
+	return urls, nil
+}
+
+// UpdateActiveURLForStream sets source URL which is currently used by the given stream
+func (streams *StreamsStorage) UpdateActiveURLForStream(streamID uuid.UUID, url string) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	stream.ActiveURL = url
+	return nil
+}
+
+// GetReconnectPolicyForStream returns reconnect policy for the given stream
+func (streams *StreamsStorage) GetReconnectPolicyForStream(streamID uuid.UUID) (ReconnectPolicy, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ReconnectPolicy{}, ErrStreamNotFound
+	}
+	return stream.reconnectPolicy, nil
+}
+
+// IncreaseReconnectAttempts increments number of failed reconnect attempts in a row. Returns new number of attempts
+func (streams *StreamsStorage) IncreaseReconnectAttempts(streamID uuid.UUID) (int, error) {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return 0, ErrStreamNotFound
+	}
+	stream.ReconnectAttempts++
+	return stream.ReconnectAttempts, nil
+}
+
+// ResetReconnectAttempts resets number of failed reconnect attempts (e.g. when stream is online again)
+func (streams *StreamsStorage) ResetReconnectAttempts(streamID uuid.UUID) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	stream.ReconnectAttempts = 0
+	return nil
+}
+
+// UpdateNextRetryForStream sets time of the next reconnect attempt. Zero time means that there is no scheduled attempt
+func (streams *StreamsStorage) UpdateNextRetryForStream(streamID uuid.UUID, nextRetry time.Time) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	if nextRetry.IsZero() {
+		stream.NextRetryAt = nil
+		return nil
+	}
+	stream.NextRetryAt = &nextRetry
+	return nil
+}
+
+// GetOnDemandForStream returns whenever the stream is connected on demand only and its idle timeout
+func (streams *StreamsStorage) GetOnDemandForStream(streamID uuid.UUID) (bool, time.Duration, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return false, 0, ErrStreamNotFound
+	}
+	return stream.OnDemand, stream.idleTimeout, nil
+}
+
+// RequestDemandForStream marks the given stream as watched (e.g. on HLS playlist request). On-demand stream is started if it waits for viewers
+func (streams *StreamsStorage) RequestDemandForStream(streamID uuid.UUID) error {
+	streams.Lock()
+	defer streams.Unlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return ErrStreamNotFound
+	}
+	stream.requestDemand()
+	return nil
+}
+
+// GetDemandSignalForStream returns channel which receives signal on every demand for the given stream
+func (streams *StreamsStorage) GetDemandSignalForStream(streamID uuid.UUID) (<-chan struct{}, error) {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	return stream.demand, nil
+}
+
+// HasDemandForStream checks if the given stream has viewers or has been requested during its idle timeout
+func (streams *StreamsStorage) HasDemandForStream(streamID uuid.UUID) bool {
+	streams.RLock()
+	defer streams.RUnlock()
+	stream, ok := streams.store[streamID]
+	if !ok {
+		return false
+	}
+	return len(stream.Clients) > 0 || time.Since(stream.lastDemandAt) < stream.idleTimeout
+}
+
 // UpdateArchiveStorageForStream updates archive storage configuration (it override existing one!)
 func (streams *StreamsStorage) UpdateArchiveStorageForStream(streamID uuid.UUID, archiveStorage *StreamArchiveWrapper) error {
 	streams.Lock()
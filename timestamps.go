@@ -0,0 +1,106 @@
+package videoserver
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+const (
+	// maxTimestampJump is max gap between packets of the same track which is still considered as continuous timeline
+	maxTimestampJump = 10 * time.Second
+	// maxTimestampRegression is max backward step of the track's timestamp (RTP jitter, B-frames reordering) which is clamped instead of being treated as discontinuity
+	maxTimestampRegression = 1 * time.Second
+	// defaultPacketDuration is used to continue timeline when packet has no duration
+	defaultPacketDuration = 40 * time.Millisecond
+)
+
+// streamPacket is a packet with normalized timestamp
+type streamPacket struct {
+	av.Packet
+	// discontinuity marks the first packet of the track after timeline break (source reconnect, camera clock jump, RTP wraparound)
+	discontinuity bool
+}
+
+// trackTimeline is a state of the single track's timeline
+type trackTimeline struct {
+	last time.Duration
+	// resync tells that timeline has been re-anchored (new session or jump of another track), so the next packet is not checked against the previous one
+	resync bool
+}
+
+// timestampNormalizer makes timestamps of the stream's packets monotonic across source sessions and clock jumps.
+// Offset is shared by every track, so relative timing of tracks (A/V sync) of the source is kept
+type timestampNormalizer struct {
+	tracks map[int8]*trackTimeline
+	offset time.Duration
+	// anchored tells that offset has been evaluated for the current session
+	anchored bool
+	// end is the end of the whole output timeline
+	end time.Duration
+	// anchor tells that tracks should continue the previous timeline instead of the source's one
+	anchor bool
+}
+
+func newTimestampNormalizer() *timestampNormalizer {
+	return &timestampNormalizer{
+		tracks: make(map[int8]*trackTimeline),
+	}
+}
+
+// restart tells that new source session begins, so its timestamps are not related to the previous ones
+func (normalizer *timestampNormalizer) restart() {
+	if len(normalizer.tracks) > 0 {
+		normalizer.anchor = true
+	}
+	// Last timestamps are kept, so every track stays monotonic
+	for _, track := range normalizer.tracks {
+		track.resync = true
+	}
+	normalizer.anchored = false
+}
+
+// normalize shifts packet's timestamp to the output timeline and marks discontinuities
+func (normalizer *timestampNormalizer) normalize(pck av.Packet) streamPacket {
+	out := streamPacket{Packet: pck}
+	if !normalizer.anchored {
+		// The first packet of the session defines offset for every track
+		normalizer.offset = 0
+		if normalizer.anchor {
+			normalizer.offset = normalizer.end - pck.Time
+		}
+		normalizer.anchored = true
+	}
+	track, ok := normalizer.tracks[pck.Idx]
+	if !ok {
+		track = &trackTimeline{}
+		normalizer.tracks[pck.Idx] = track
+		out.discontinuity = normalizer.anchor
+	} else if track.resync {
+		track.resync = false
+		out.discontinuity = true
+	} else if t := pck.Time + normalizer.offset; track.last-t > maxTimestampRegression || t-track.last > maxTimestampJump {
+		// Clock of the source has jumped: every track is re-anchored together
+		normalizer.offset = normalizer.end - pck.Time
+		out.discontinuity = true
+		for _, other := range normalizer.tracks {
+			if other != track {
+				other.resync = true
+			}
+		}
+	}
+	out.Time = pck.Time + normalizer.offset
+	if ok && out.Time < track.last {
+		// Small regression: keep timeline monotonic
+		out.Time = track.last
+	}
+	track.last = out.Time
+	duration := pck.Duration
+	if duration <= 0 {
+		duration = defaultPacketDuration
+	}
+	if end := out.Time + duration; end > normalizer.end {
+		normalizer.end = end
+	}
+	return out
+}
@@ -1,10 +1,13 @@
 package videoserver
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // https://github.com/trailofbits/go-mutexasserts/blob/master/mutex.go#L15
@@ -47,3 +50,24 @@ func ensureDir(dirName string) error {
 	}
 	return err
 }
+
+// waitFile polls filesystem until the file appears. Returns false if timeout is reached or context is done
+func waitFile(ctx context.Context, fileSystem http.FileSystem, fileName string, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if file, err := fileSystem.Open(fileName); err == nil {
+			file.Close()
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline.C:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,10 +1,43 @@
 package videoserver
 
-import (
-	"github.com/deepch/vdk/av"
-)
-
-// viewer is just an wrapping alias to chan for av.Packet
+// viewer is a subscriber of the stream's packets
 type viewer struct {
-	c chan av.Packet
+	// kind is an output which viewer has been connected through
+	kind StreamType
+	c    chan streamPacket
+	// disconnect receives reason why viewer must leave the stream
+	disconnect chan string
+	// codecs receives signal when stream's codecs have been changed (e.g. source has been reconnected)
+	codecs chan struct{}
+}
+
+func newViewer(kind StreamType) viewer {
+	return viewer{
+		kind:       kind,
+		c:          make(chan streamPacket, 100),
+		disconnect: make(chan string, 1),
+		codecs:     make(chan struct{}, 1),
+	}
+}
+
+// kick asks viewer to leave the stream with the given reason. Only the first reason is delivered
+func (v viewer) kick(reason string) {
+	select {
+	case v.disconnect <- reason:
+	default:
+	}
+}
+
+// notifyCodecs tells viewer that codecs have been changed. Packets which have been queued for the previous codecs are dropped
+func (v viewer) notifyCodecs() {
+	for len(v.c) > 0 {
+		select {
+		case <-v.c:
+		default:
+		}
+	}
+	select {
+	case v.codecs <- struct{}{}:
+	default:
+	}
 }
@@ -0,0 +1,332 @@
+package videoserver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/LdDl/video-server/configuration"
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// webrtcMTU keeps RTP packets small enough for the most of networks (including SRTP overhead)
+	webrtcMTU = 1200
+	// webrtcClockRate is a clock rate of video RTP timestamps
+	webrtcClockRate = 90000
+)
+
+var (
+	webrtcConnectTimeout = 30 * time.Second
+)
+
+// webrtcPlayback keeps WebRTC API and active WHEP sessions
+type webrtcPlayback struct {
+	sync.Mutex
+	api      *webrtc.API
+	sessions map[uuid.UUID]*whepSession
+}
+
+// newWebRTCPlayback prepares WebRTC API for the given settings
+func newWebRTCPlayback(cfg configuration.WebRTCConfiguration) (*webrtcPlayback, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't register codecs")
+	}
+	interceptors := &interceptor.Registry{}
+	err = webrtc.RegisterDefaultInterceptors(mediaEngine, interceptors)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't register interceptors")
+	}
+	settings := webrtc.SettingEngine{}
+	if cfg.PortMin != 0 || cfg.PortMax != 0 {
+		err = settings.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad UDP ports range [%d; %d]", cfg.PortMin, cfg.PortMax)
+		}
+	}
+	if len(cfg.HostIPs) > 0 {
+		settings.SetNAT1To1IPs(cfg.HostIPs, webrtc.ICECandidateTypeHost)
+	}
+	settings.SetLite(cfg.ICELite)
+	return &webrtcPlayback{
+		api:      webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptors), webrtc.WithSettingEngine(settings)),
+		sessions: make(map[uuid.UUID]*whepSession),
+	}, nil
+}
+
+// whepSession is a single WebRTC viewer of the stream
+type whepSession struct {
+	id        uuid.UUID
+	streamID  uuid.UUID
+	pc        *webrtc.PeerConnection
+	track     *webrtc.TrackLocalStaticRTP
+	connected chan struct{}
+	done      chan struct{}
+	// Guard channels above since connection state could be reported more than once
+	connectedOnce sync.Once
+	doneOnce      sync.Once
+}
+
+// newSession negotiates new peer connection for the given SDP offer and returns SDP answer
+func (playback *webrtcPlayback) newSession(ctx context.Context, streamID uuid.UUID, codec h264parser.CodecData, offer string) (*whepSession, string, error) {
+	pc, err := playback.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Can't create peer connection")
+	}
+	session := &whepSession{
+		id:        uuid.New(),
+		streamID:  streamID,
+		pc:        pc,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	answer, err := session.negotiate(ctx, codec, offer)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	playback.Lock()
+	playback.sessions[session.id] = session
+	playback.Unlock()
+	return session, answer, nil
+}
+
+func (session *whepSession) negotiate(ctx context.Context, codec h264parser.CodecData, offer string) (string, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   webrtcClockRate,
+		SDPFmtpLine: h264Fmtp(codec),
+	}, "video", session.streamID.String())
+	if err != nil {
+		return "", errors.Wrap(err, "Can't create track")
+	}
+	session.track = track
+	sender, err := session.pc.AddTrack(track)
+	if err != nil {
+		return "", errors.Wrap(err, "Can't add track")
+	}
+	// RTCP must be read so interceptors (e.g. NACK responder) could work
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	session.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			session.connectedOnce.Do(func() {
+				close(session.connected)
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			session.finish()
+		}
+	})
+	err = session.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", errors.Wrap(ErrWebRTCBadOffer, err.Error())
+	}
+	answer, err := session.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", errors.Wrap(ErrWebRTCBadOffer, err.Error())
+	}
+	// WHEP has no trickle ICE here: all candidates are sent in the answer
+	gathered := webrtc.GatheringCompletePromise(session.pc)
+	err = session.pc.SetLocalDescription(answer)
+	if err != nil {
+		return "", errors.Wrap(err, "Can't set local description")
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return "", errors.Wrap(ctx.Err(), "Can't gather ICE candidates")
+	}
+	return session.pc.LocalDescription().SDP, nil
+}
+
+func (session *whepSession) finish() {
+	session.doneOnce.Do(func() {
+		close(session.done)
+	})
+}
+
+// closeSession terminates session with the given ID
+func (playback *webrtcPlayback) closeSession(streamID, sessionID uuid.UUID) error {
+	playback.Lock()
+	session, ok := playback.sessions[sessionID]
+	playback.Unlock()
+	if !ok || session.streamID != streamID {
+		return ErrWHEPSessionNotFound
+	}
+	session.finish()
+	return nil
+}
+
+// serve feeds WebRTC client with packets of the stream until either client or stream has gone
+func (playback *webrtcPlayback) serve(streamsStorage *StreamsStorage, session *whepSession, clientID uuid.UUID, client viewer, verboseLevel VerboseLevel) {
+	defer func() {
+		streamsStorage.DeleteViewer(session.streamID, clientID)
+		session.pc.Close()
+		playback.Lock()
+		delete(playback.sessions, session.id)
+		playback.Unlock()
+		if verboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Msg("Session has been closed")
+		}
+	}()
+	var webrtcCodecs codecsFilter
+	packetizer := newH264RTPPacketizer()
+	// updateCodecs applies new codecs of the stream. Session can't be renegotiated, so it is closed if there is no H264 anymore
+	updateCodecs := func() bool {
+		codecData, err := streamsStorage.GetCodecsDataForStream(session.streamID)
+		if err != nil {
+			return false
+		}
+		webrtcCodecs = newCodecsFilter(codecData, webrtcSupportedCodecs)
+		if len(webrtcCodecs.codecs) == 0 {
+			if verboseLevel > VERBOSE_NONE {
+				log.Warn().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Any("codecs", codecData).Msg("Codecs have been changed. Client needs to reconnect")
+			}
+			return false
+		}
+		packetizer.setCodecData(webrtcCodecs.codecs[0].(h264parser.CodecData))
+		return true
+	}
+	if !updateCodecs() {
+		return
+	}
+	connectTimeout := time.NewTimer(webrtcConnectTimeout)
+	defer connectTimeout.Stop()
+	connected := session.connected
+	var isConnected, start bool
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-connected:
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Msg("Peer has been connected")
+			}
+			isConnected = true
+			connected = nil
+			connectTimeout.Stop()
+		case <-connectTimeout.C:
+			if verboseLevel > VERBOSE_NONE {
+				log.Warn().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Msg("Peer has not been connected in time")
+			}
+			return
+		case reason := <-client.disconnect:
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Str("reason", reason).Msg("Client has been disconnected by server")
+			}
+			return
+		case <-client.codecs:
+			if !updateCodecs() {
+				return
+			}
+			start = false
+		case pck := <-client.c:
+			// Codecs signal is sent before the first packet of the new codecs, so it has to be handled first
+			select {
+			case <-client.codecs:
+				if !updateCodecs() {
+					return
+				}
+				start = false
+			default:
+			}
+			if !isConnected || !webrtcCodecs.remap(&pck.Packet) {
+				continue
+			}
+			if pck.IsKeyFrame {
+				start = true
+			} else if pck.discontinuity {
+				start = false
+			}
+			if !start {
+				continue
+			}
+			for _, packet := range packetizer.packetize(pck.Packet) {
+				err := session.track.WriteRTP(packet)
+				if err != nil {
+					if verboseLevel > VERBOSE_SIMPLE {
+						log.Warn().Err(err).Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("stream_id", session.streamID.String()).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Msg("Can't write RTP packet")
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// h264RTPPacketizer splits H264 access units into RTP packets (RFC 6184). Parameter sets are sent before every keyframe
+type h264RTPPacketizer struct {
+	payloader     codecs.H264Payloader
+	sequencer     rtp.Sequencer
+	timestampBase uint32
+	sps           []byte
+	pps           []byte
+}
+
+func newH264RTPPacketizer() *h264RTPPacketizer {
+	return &h264RTPPacketizer{
+		sequencer:     rtp.NewRandomSequencer(),
+		timestampBase: rand.Uint32(),
+	}
+}
+
+func (p *h264RTPPacketizer) setCodecData(codec h264parser.CodecData) {
+	p.sps = codec.SPS()
+	p.pps = codec.PPS()
+}
+
+func (p *h264RTPPacketizer) packetize(pck av.Packet) []*rtp.Packet {
+	nalus, _ := h264parser.SplitNALUs(pck.Data)
+	if pck.IsKeyFrame {
+		nalus = append([][]byte{p.sps, p.pps}, nalus...)
+	}
+	// Payloader expects Annex B byte stream
+	annexB := make([]byte, 0, len(pck.Data)+len(p.sps)+len(p.pps)+4*len(nalus))
+	for _, nalu := range nalus {
+		annexB = append(annexB, 0, 0, 0, 1)
+		annexB = append(annexB, nalu...)
+	}
+	payloads := p.payloader.Payload(webrtcMTU-12, annexB)
+	timestamp := p.timestampBase + uint32(int64(pck.Time+pck.CompositionTime)*webrtcClockRate/int64(time.Second))
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: p.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+	}
+	return packets
+}
+
+// h264Fmtp returns SDP format parameters for the given H264 codec
+func h264Fmtp(codec h264parser.CodecData) string {
+	profileLevelID := "42e01f"
+	if sps := codec.SPS(); len(sps) >= 4 {
+		profileLevelID = fmt.Sprintf("%02x%02x%02x", sps[1], sps[2], sps[3])
+	}
+	return fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s", profileLevelID)
+}
@@ -0,0 +1,122 @@
+package videoserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// WHEPWrapper returns WHEP handler: client sends SDP offer and gets SDP answer and URL of the session
+func WHEPWrapper(streamsStorage *StreamsStorage, playback *webrtcPlayback, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Try to start WHEP session")
+		}
+		streamIDSTR := ctx.Param("stream_id")
+		streamID, err := uuid.Parse(streamIDSTR)
+		if err != nil {
+			errReason := fmt.Sprintf("Not valid UUID: '%s'", streamIDSTR)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": errReason})
+			return
+		}
+		if ctx.ContentType() != "application/sdp" {
+			ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"Error": "Content-Type must be 'application/sdp'"})
+			return
+		}
+		if !streamsStorage.TypeExistsForStream(streamID, STREAM_TYPE_WEBRTC) {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": "No WebRTC output for the stream"})
+			return
+		}
+		offer, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		clientID, client, err := streamsStorage.AddViewer(streamID, STREAM_TYPE_WEBRTC)
+		if err != nil {
+			errReason := "Can't add client to the queue"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Msg(errReason)
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": errReason})
+			return
+		}
+		// Codecs are unknown until the source is connected (e.g. on-demand stream has just been started by this viewer)
+		codecData, err := waitCodecs(streamsStorage, streamID, client.codecs, codecsTimeout)
+		if err != nil || len(codecData) == 0 {
+			streamsStorage.DeleteViewer(streamID, clientID)
+			errReason := "Can't extract codec for stream"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+			}
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"Error": errReason})
+			return
+		}
+		webrtcCodecs := newCodecsFilter(codecData, webrtcSupportedCodecs)
+		if len(webrtcCodecs.dropped) > 0 && verboseLevel > VERBOSE_NONE {
+			log.Warn().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_CODEC_SKIP).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Strs("codecs", webrtcCodecs.droppedNames()).Msg("Some codecs are not supported by WebRTC. Skipping them")
+		}
+		if len(webrtcCodecs.codecs) == 0 {
+			streamsStorage.DeleteViewer(streamID, clientID)
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(ErrWebRTCNoCodecs.Error())
+			}
+			ctx.JSON(http.StatusNotAcceptable, gin.H{"Error": ErrWebRTCNoCodecs.Error()})
+			return
+		}
+		session, answer, err := playback.newSession(ctx.Request.Context(), streamID, webrtcCodecs.codecs[0].(h264parser.CodecData), string(offer))
+		if err != nil {
+			streamsStorage.DeleteViewer(streamID, clientID)
+			errReason := "Can't negotiate WebRTC session"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+			}
+			if errors.Cause(err) == ErrWebRTCBadOffer {
+				ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+				return
+			}
+			ctx.JSON(http.StatusInternalServerError, gin.H{"Error": errReason})
+			return
+		}
+		if verboseLevel > VERBOSE_NONE {
+			log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_SESSION).Str("remote", ctx.Request.RemoteAddr).Str("stream_id", streamIDSTR).Str("session_id", session.id.String()).Str("client_id", clientID.String()).Msg("Session has been started")
+		}
+		go playback.serve(streamsStorage, session, clientID, client, verboseLevel)
+		ctx.Header("Location", fmt.Sprintf("/whep/%s/%s", streamID, session.id))
+		ctx.Data(http.StatusCreated, "application/sdp", []byte(answer))
+	}
+}
+
+// WHEPDeleteWrapper returns handler which terminates WHEP session
+func WHEPDeleteWrapper(playback *webrtcPlayback, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_WHEP).Str("event", EVENT_WHEP_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Msg("Try to stop WHEP session")
+		}
+		streamID, err := uuid.Parse(ctx.Param("stream_id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		sessionID, err := uuid.Parse(ctx.Param("session_id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		err = playback.closeSession(streamID, sessionID)
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusOK)
+	}
+}
@@ -3,8 +3,10 @@ package videoserver
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/deepch/vdk/av"
 	"github.com/deepch/vdk/format/mp4f"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -15,6 +17,7 @@ var (
 	keyFramesTimeout = 10 * time.Second
 	deadlineTimeout  = 10 * time.Second
 	controlTimeout   = 10 * time.Second
+	codecsTimeout    = 20 * time.Second
 )
 
 // wshandler is a websocket handler for user connection
@@ -23,6 +26,8 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 	var mseExists, clientAdded bool
 
 	streamIDSTR := r.FormValue("stream_id")
+	// Client should report whether it is capable to decode HEVC (e.g. via MediaSource.isTypeSupported)
+	hevcSupported, _ := strconv.ParseBool(r.FormValue("hevc"))
 	if verboseLevel > VERBOSE_SIMPLE {
 		log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Msg("MSE Connected")
 	}
@@ -62,16 +67,8 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 		log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Bool("mse_exists", mseExists).Msg("Validate stream type")
 	}
 	if mseExists {
-		err = conn.SetWriteDeadline(time.Now().Add(deadlineTimeout))
-		if err != nil {
-			errReason := "Can't set deadline"
-			if verboseLevel > VERBOSE_NONE {
-				log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("event", EVENT_WS_PING).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Msg(errReason)
-			}
-			closeWSwithError(conn, 1011, errReason)
-			return
-		}
-		clientID, ch, err := streamsStorage.AddViewer(streamID)
+		var client viewer
+		clientID, client, err = streamsStorage.AddViewer(streamID, STREAM_TYPE_MSE)
 		if err != nil {
 			errReason := "Can't add client to the queue"
 			if verboseLevel > VERBOSE_NONE {
@@ -85,7 +82,8 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 			log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("Client has been added")
 		}
 
-		codecData, err := streamsStorage.GetCodecsDataForStream(streamID)
+		// Codecs are unknown until the source is connected (e.g. on-demand stream has just been started by this viewer)
+		codecData, err := waitCodecs(streamsStorage, streamID, client.codecs, codecsTimeout)
 		if err != nil {
 			errReason := "Can't extract codec for stream"
 			if verboseLevel > VERBOSE_NONE {
@@ -98,59 +96,118 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 			log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg("Validate codecs")
 		}
 
-		if len(codecData) == 0 {
-			errReason := "No codec information"
-			if verboseLevel > VERBOSE_NONE {
-				log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+		var muxer *mp4f.Muxer
+		var mseCodecs codecsFilter
+		// setupMuxer prepares new muxer for the given codecs and sends meta and initialization segment to the client
+		setupMuxer := func(codecData []av.CodecData) bool {
+			if len(codecData) == 0 {
+				errReason := "No codec information"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
 			}
-			closeWSwithError(conn, 1011, errReason)
-			return
-		}
-		muxer := mp4f.NewMuxer(nil)
-		err = muxer.WriteHeader(codecData)
-		if err != nil {
-			errReason := "Can't write codec information to the header"
-			if verboseLevel > VERBOSE_NONE {
-				log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(errReason)
+			mseCodecs = newCodecsFilter(codecData, mseSupportedCodecs)
+			if len(mseCodecs.dropped) > 0 && verboseLevel > VERBOSE_NONE {
+				log.Warn().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_CODEC_SKIP).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Strs("codecs", mseCodecs.droppedNames()).Msg("Some codecs are not supported by MSE muxer. Skipping them")
+			}
+			if len(mseCodecs.codecs) == 0 {
+				errReason := "No codecs supported by MSE"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
+			}
+			if hasCodecType(mseCodecs.codecs, av.H265) && !hevcSupported {
+				errReason := "HEVC is not supported by the client"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(errReason)
+				}
+				closeWSwithError(conn, 1003, errReason)
+				return false
+			}
+			codecData = mseCodecs.codecs
+			err := conn.SetWriteDeadline(time.Now().Add(deadlineTimeout))
+			if err != nil {
+				errReason := "Can't set deadline"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("event", EVENT_WS_PING).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
+			}
+			muxer = mp4f.NewMuxer(nil)
+			err = muxer.WriteHeader(codecData)
+			if err != nil {
+				errReason := "Can't write codec information to the header"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
+			}
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg("Write header to muxer")
 			}
-			closeWSwithError(conn, 1011, errReason)
-			return
-		}
-		if verboseLevel > VERBOSE_SIMPLE {
-			log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg("Write header to muxer")
-		}
 
-		meta, init := muxer.GetInit(codecData)
-		if verboseLevel > VERBOSE_SIMPLE {
-			log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Get meta information")
-		}
+			meta, init := muxer.GetInit(codecData)
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Get meta information")
+			}
 
-		err = conn.WriteMessage(websocket.BinaryMessage, append([]byte{9}, meta...))
-		if err != nil {
-			errReason := "Can't write meta information"
-			if verboseLevel > VERBOSE_NONE {
-				log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Msg(errReason)
+			err = conn.WriteMessage(websocket.BinaryMessage, append([]byte{9}, meta...))
+			if err != nil {
+				errReason := "Can't write meta information"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
 			}
-			closeWSwithError(conn, 1011, errReason)
-			return
-		}
-		if verboseLevel > VERBOSE_SIMPLE {
-			log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Send meta information")
-		}
-		err = conn.WriteMessage(websocket.BinaryMessage, init)
-		if err != nil {
-			errReason := "Can't write initialization information"
-			if verboseLevel > VERBOSE_NONE {
-				log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg(errReason)
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Send meta information")
 			}
-			closeWSwithError(conn, 1011, errReason)
-			return
+			err = conn.WriteMessage(websocket.BinaryMessage, init)
+			if err != nil {
+				errReason := "Can't write initialization information"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
+			}
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Info().Str("remote_addr", r.RemoteAddr).Str("event", EVENT_WS_UPGRADER).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Send initialization message")
+			}
+			return true
 		}
-		if verboseLevel > VERBOSE_SIMPLE {
-			log.Info().Str("remote_addr", r.RemoteAddr).Str("event", EVENT_WS_UPGRADER).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg("Send initialization message")
+		if !setupMuxer(codecData) {
+			return
 		}
 
 		var start bool
+		// reinitMuxer re-sends meta and initialization segment for the new codecs on the same connection
+		reinitMuxer := func() bool {
+			codecData, err := streamsStorage.GetCodecsDataForStream(streamID)
+			if err != nil {
+				errReason := "Can't extract codec for stream"
+				if verboseLevel > VERBOSE_NONE {
+					log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_REINIT).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
+				}
+				closeWSwithError(conn, 1011, errReason)
+				return false
+			}
+			if verboseLevel > VERBOSE_NONE {
+				log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_REINIT).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Msg("Codecs have been changed. Re-initializing muxer")
+			}
+			if !setupMuxer(codecData) {
+				return false
+			}
+			start = false
+			return true
+		}
 		quitCh := make(chan bool)
 		rxPingCh := make(chan bool)
 
@@ -164,7 +221,7 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 					quit <- true
 					errReason := "Can't read message"
 					if verboseLevel > VERBOSE_NONE {
-						log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg(errReason)
+						log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
 					}
 					closeWSwithError(conn, 1011, errReason)
 					return
@@ -193,6 +250,11 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 		for {
 			select {
 			case <-noKeyFrames.C:
+				if streamsStorage.IsReconnectingStream(streamID) {
+					// Source is going to be back: keep the client until then
+					noKeyFrames.Reset(keyFramesTimeout)
+					continue
+				}
 				if verboseLevel > VERBOSE_SIMPLE {
 					log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("No keyframes has been met")
 				}
@@ -210,12 +272,33 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 				if err != nil {
 					errReason := "Can't write PONG message"
 					if verboseLevel > VERBOSE_NONE {
-						log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("event", EVENT_WS_PING).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Any("codecs", codecData).Str("meta", meta).Any("init", init).Msg(errReason)
+						log.Error().Err(err).Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("event", EVENT_WS_PING).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg(errReason)
 					}
 					closeWSwithError(conn, 1011, errReason)
 					return
 				}
-			case pck := <-ch:
+			case reason := <-client.disconnect:
+				if verboseLevel > VERBOSE_SIMPLE {
+					log.Info().Str("scope", SCOPE_WS_HANDLER).Str("event", EVENT_WS_UPGRADER).Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Str("reason", reason).Msg("Client has been disconnected by server")
+				}
+				closeWSwithError(conn, 1001, reason)
+				return
+			case <-client.codecs:
+				if !reinitMuxer() {
+					return
+				}
+			case pck := <-client.c:
+				// Codecs signal is sent before the first packet of the new codecs, so it has to be handled first
+				select {
+				case <-client.codecs:
+					if !reinitMuxer() {
+						return
+					}
+				default:
+				}
+				if !mseCodecs.remap(&pck.Packet) {
+					continue
+				}
 				if verboseLevel > VERBOSE_ADD {
 					log.Info().Str("remote_addr", r.RemoteAddr).Str("stream_id", streamIDSTR).Str("client_id", clientID.String()).Msg("Packet has been recieved from stream source")
 				}
@@ -225,6 +308,9 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 					}
 					noKeyFrames.Reset(keyFramesTimeout)
 					start = true
+				} else if pck.discontinuity && mseCodecs.codecs[pck.Idx].Type().IsVideo() {
+					// Timeline has been broken: decoder has to wait for the next keyframe
+					start = false
 				}
 				if !start {
 					if verboseLevel > VERBOSE_ADD {
@@ -232,7 +318,7 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 					}
 					continue
 				}
-				ready, buf, err := muxer.WritePacket(pck, false)
+				ready, buf, err := muxer.WritePacket(pck.Packet, false)
 				if err != nil {
 					errReason := "Can't write packet to the muxer"
 					if verboseLevel > VERBOSE_NONE {
@@ -275,6 +361,23 @@ func wshandler(wsUpgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Re
 	}
 }
 
+// waitCodecs waits until codecs for the given stream are known. Returns empty list if timeout is reached
+func waitCodecs(streamsStorage *StreamsStorage, streamID uuid.UUID, codecsChanged <-chan struct{}, timeout time.Duration) ([]av.CodecData, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		codecData, err := streamsStorage.GetCodecsDataForStream(streamID)
+		if err != nil || len(codecData) != 0 {
+			return codecData, err
+		}
+		select {
+		case <-codecsChanged:
+		case <-deadline.C:
+			return codecData, nil
+		}
+	}
+}
+
 func prepareError(code int16, message string) []byte {
 	buf := make([]byte, 0, 2+len(message))
 	h, l := uint8(code>>8), uint8(code&0xff)
@@ -3,7 +3,9 @@ package videoserver
 import (
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -17,7 +19,7 @@ import (
 // @todo: eliminate this regexp and use the third party
 var uuidRegExp = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-4[a-fA-F0-9]{3}-[8|9|aA|bB][a-fA-F0-9]{3}-[a-fA-F0-9]{12}")
 
-// StartVideoServer initializes "video" server and run it (MSE-websockets and HLS-static files)
+// StartVideoServer initializes "video" server and run it (MSE-websockets, HLS/DASH-static files, HLS VOD over archive, HTTP-FLV and WebRTC via WHEP)
 func (app *Application) StartVideoServer() {
 	log.Info().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_PREPARE).Msg("Preparing to start WS Server")
 
@@ -50,7 +52,12 @@ func (app *Application) StartVideoServer() {
 		router.Use(cors.New(*app.CorsConfig))
 	}
 	router.GET("/ws/:stream_id", WebSocketWrapper(&app.Streams, &wsUpgrader, app.VideoServerCfg.Verbose))
-	router.GET("/hls/:file", HLSWrapper(&app.HLS, app.VideoServerCfg.Verbose))
+	router.GET("/hls/:file", HLSWrapper(&app.HLS, app.hlsStorage, &app.Streams, app.llhls, app.VideoServerCfg.Verbose))
+	router.GET("/dash/:file", DASHWrapper(&app.HLS, app.hlsStorage, &app.Streams, app.VideoServerCfg.Verbose))
+	router.GET("/flv/:stream_id", FLVWrapper(&app.Streams, app.VideoServerCfg.Verbose))
+	router.GET("/vod/:stream_id/:file", HLSVODWrapper(&app.Streams, app.VideoServerCfg.Verbose))
+	router.POST("/whep/:stream_id", WHEPWrapper(&app.Streams, app.webrtc, app.VideoServerCfg.Verbose))
+	router.DELETE("/whep/:stream_id/:session_id", WHEPDeleteWrapper(app.webrtc, app.VideoServerCfg.Verbose))
 
 	url := fmt.Sprintf("%s:%d", app.VideoServerCfg.Host, app.VideoServerCfg.Port)
 	s := &http.Server{
@@ -79,14 +86,14 @@ func WebSocketWrapper(streamsStorage *StreamsStorage, wsUpgrader *websocket.Upgr
 	}
 }
 
-// HLSWrapper returns HLS handler (static files)
-func HLSWrapper(hlsConf *HLSInfo, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+// HLSWrapper returns HLS handler (files of the given storage). Playlist request starts on-demand stream. LL-HLS playlists are served from memory with blocking reload support
+func HLSWrapper(hlsConf *HLSInfo, hlsFiles hlsStorage, streamsStorage *StreamsStorage, llhls *llhlsRegistry, verboseLevel VerboseLevel) func(ctx *gin.Context) {
 	return func(ctx *gin.Context) {
 		if verboseLevel > VERBOSE_SIMPLE {
 			log.Info().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("hls_dir", hlsConf.Directory).Msg("Call HLS")
 		}
 		file := ctx.Param("file")
-		_, err := uuid.Parse(uuidRegExp.FindString(file))
+		streamID, err := uuid.Parse(uuidRegExp.FindString(file))
 		if err != nil {
 			errReason := "Not valid UUId"
 			if verboseLevel > VERBOSE_NONE {
@@ -95,10 +102,98 @@ func HLSWrapper(hlsConf *HLSInfo, verboseLevel VerboseLevel) func(ctx *gin.Conte
 			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
 			return
 		}
+		if filepath.Ext(file) == ".m3u8" {
+			// Error could be ignored: request for unknown stream will end up with 404
+			streamsStorage.RequestDemandForStream(streamID)
+			onDemand, _, _ := streamsStorage.GetOnDemandForStream(streamID)
+			if onDemand {
+				waitFile(ctx.Request.Context(), hlsFiles, file, onDemandPlaylistTimeout)
+			}
+			if playlist := llhls.get(streamID); playlist != nil {
+				serveLLHLSPlaylist(ctx, playlist, verboseLevel)
+				return
+			}
+		} else if playlist := llhls.get(streamID); playlist != nil {
+			// Part from EXT-X-PRELOAD-HINT is requested before it is ready
+			if msn, part, ok := playlist.parsePartName(file); ok {
+				playlist.wait(ctx.Request.Context(), msn, part)
+			}
+		}
 		ctx.Header("Cache-Control", "no-cache")
 		if verboseLevel > VERBOSE_SIMPLE {
 			log.Info().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("hls_dir", hlsConf.Directory).Msg("Send file")
 		}
-		ctx.FileFromFS(file, http.Dir(hlsConf.Directory))
+		ctx.FileFromFS(file, hlsFiles)
+	}
+}
+
+// DASHWrapper returns DASH handler (files of the given storage, shared with HLS). Manifest request starts on-demand stream
+func DASHWrapper(hlsConf *HLSInfo, dashFiles hlsStorage, streamsStorage *StreamsStorage, verboseLevel VerboseLevel) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("dash_dir", hlsConf.Directory).Msg("Call DASH")
+		}
+		file := ctx.Param("file")
+		streamID, err := uuid.Parse(uuidRegExp.FindString(file))
+		if err != nil {
+			errReason := "Not valid UUId"
+			if verboseLevel > VERBOSE_NONE {
+				log.Error().Err(err).Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("dash_dir", hlsConf.Directory).Msg(errReason)
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		if filepath.Ext(file) == ".mpd" {
+			// Error could be ignored: request for unknown stream will end up with 404
+			streamsStorage.RequestDemandForStream(streamID)
+			onDemand, _, _ := streamsStorage.GetOnDemandForStream(streamID)
+			if onDemand {
+				waitFile(ctx.Request.Context(), dashFiles, file, onDemandPlaylistTimeout)
+			}
+			ctx.Header("Content-Type", "application/dash+xml")
+		}
+		ctx.Header("Cache-Control", "no-cache")
+		if verboseLevel > VERBOSE_SIMPLE {
+			log.Info().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Str("dash_dir", hlsConf.Directory).Msg("Send file")
+		}
+		ctx.FileFromFS(file, dashFiles)
+	}
+}
+
+// serveLLHLSPlaylist sends LL-HLS playlist. Request with _HLS_msn (and optional _HLS_part) is blocked until the given segment (part) is available
+func serveLLHLSPlaylist(ctx *gin.Context, playlist *llhlsPlaylist, verboseLevel VerboseLevel) {
+	msnSTR, part := ctx.Query("_HLS_msn"), -1
+	if partSTR := ctx.Query("_HLS_part"); partSTR != "" {
+		if msnSTR == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": "_HLS_part requires _HLS_msn"})
+			return
+		}
+		value, err := strconv.Atoi(partSTR)
+		if err != nil || value < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Not valid _HLS_part: '%s'", partSTR)})
+			return
+		}
+		part = value
+	}
+	if msnSTR != "" {
+		msn, err := strconv.ParseUint(msnSTR, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Not valid _HLS_msn: '%s'", msnSTR)})
+			return
+		}
+		ready, err := playlist.wait(ctx.Request.Context(), msn, part)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+		if !ready {
+			if verboseLevel > VERBOSE_SIMPLE {
+				log.Warn().Str("scope", SCOPE_WS_SERVER).Str("event", EVENT_WS_REQUEST).Str("method", ctx.Request.Method).Str("route", ctx.Request.URL.Path).Str("remote", ctx.Request.RemoteAddr).Uint64("msn", msn).Int("part", part).Msg("Blocking playlist reload timed out")
+			}
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"Error": "Requested part is not available yet"})
+			return
+		}
 	}
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist.encode())
 }